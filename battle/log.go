@@ -0,0 +1,245 @@
+package battle
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"surrealchemist.com/mass-showdown-backend/dex"
+	"surrealchemist.com/mass-showdown-backend/messages"
+)
+
+// A line of a battle's log as spectators see it.
+type LogLine struct {
+	// Counts up from 1 for each line in the room, starting over if the room's log is
+	// replayed from the beginning.
+	Seq  uint64 `json:"seq"`
+	Turn int    `json:"turn"`
+	// The protocol message type, e.g. "move" or "-damage", and its arguments, for clients
+	// that want more than the text.
+	Kind string   `json:"kind"`
+	Args []string `json:"args"`
+	Text string   `json:"text"`
+}
+
+// Applies a server message's events to their room's state, like Apply, and returns the
+// log lines for the events spectators would see. events must have been decoded from sm.
+func (t *Tracker) ApplyMessage(sm *messages.ServerMessage, events []messages.Event) []LogLine {
+	if !strings.HasPrefix(sm.RoomID, "battle-") {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+	var lines []LogLine
+	for i, e := range events {
+		s := t.apply(sm.RoomID, e)
+		text := s.describe(e)
+		if text == "" {
+			continue
+		}
+		s.logged++
+		lines = append(lines, LogLine{
+			Seq:  s.logged,
+			Turn: s.Turn,
+			Kind: e.Kind(),
+			Args: sm.Messages[i].Data,
+			Text: text,
+		})
+	}
+	return lines
+}
+
+// Describes the event in a line of the battle log, or returns "" if spectators don't need
+// to see it.
+func (s *State) describe(ev messages.Event) string {
+	switch e := ev.(type) {
+	case *messages.StartEvent:
+		return "The battle started!"
+	case *messages.TurnEvent:
+		return fmt.Sprintf("Turn %d", e.Turn)
+	case *messages.WinEvent:
+		return fmt.Sprintf("%s won the battle!", e.Winner)
+	case *messages.TieEvent:
+		return "The battle ended in a tie!"
+	case *messages.MoveEvent:
+		return fmt.Sprintf("%s used %s!", s.name(e.Pokemon), e.Move)
+	case *messages.SwitchEvent:
+		if e.Type == "drag" {
+			return fmt.Sprintf("%s was dragged out!", s.name(e.Pokemon))
+		}
+		if e.Type == "switch" {
+			return fmt.Sprintf("%s sent out %s!", s.player(e.Pokemon.Side), e.Pokemon.Name)
+		}
+	case *messages.DetailsChangeEvent:
+		return fmt.Sprintf("%s transformed into %s!", s.name(e.Pokemon), dex.ParseDetails(e.Details).Species)
+	case *messages.HealthEvent:
+		text := fmt.Sprintf("%s's HP changed", s.name(e.Pokemon))
+		switch e.Type {
+		case "-damage":
+			text = fmt.Sprintf("%s lost HP", s.name(e.Pokemon))
+		case "-heal":
+			text = fmt.Sprintf("%s restored HP", s.name(e.Pokemon))
+		}
+		if from, ok := e.Tags["from"]; ok {
+			text += " from " + effectName(from)
+		}
+		return fmt.Sprintf("%s! (%d%%)", text, int(math.Round(float64(e.Condition.Fraction())*100)))
+	case *messages.FaintEvent:
+		return fmt.Sprintf("%s fainted!", s.name(e.Pokemon))
+	case *messages.StatusEvent:
+		names, ok := statusNames[e.Status]
+		if !ok {
+			names = [2]string{"got " + e.Status, e.Status}
+		}
+		if e.Cure {
+			return fmt.Sprintf("%s was cured of its %s.", s.name(e.Pokemon), names[1])
+		}
+		return fmt.Sprintf("%s %s!", s.name(e.Pokemon), names[0])
+	case *messages.BoostEvent:
+		return describeBoost(s.name(e.Pokemon), e)
+	case *messages.ClearBoostEvent:
+		if e.All {
+			return "All stat changes were eliminated!"
+		}
+		return fmt.Sprintf("%s's stat changes were removed!", s.name(e.Pokemon))
+	case *messages.WeatherEvent:
+		switch {
+		case e.Upkeep:
+			return ""
+		case e.Weather == "none":
+			return "The weather cleared up."
+		}
+		return fmt.Sprintf("The weather became %s.", weatherName(e.Weather))
+	case *messages.FieldEvent:
+		if e.End {
+			return fmt.Sprintf("%s ended.", effectName(e.Condition))
+		}
+		return fmt.Sprintf("%s started!", effectName(e.Condition))
+	case *messages.SideConditionEvent:
+		if e.End {
+			return fmt.Sprintf("%s ended on %s's side.", effectName(e.Condition), s.player(e.Side))
+		}
+		return fmt.Sprintf("%s was set up on %s's side!", effectName(e.Condition), s.player(e.Side))
+	case *messages.TerastallizeEvent:
+		return fmt.Sprintf("%s terastallized into the %s type!", s.name(e.Pokemon), e.TeraType)
+	case *messages.ItemEvent:
+		if e.End {
+			return fmt.Sprintf("%s lost its %s.", s.name(e.Pokemon), e.Item)
+		}
+		return fmt.Sprintf("%s has %s.", s.name(e.Pokemon), e.Item)
+	case *messages.AbilityEvent:
+		return fmt.Sprintf("%s's %s!", s.name(e.Pokemon), e.Ability)
+	case *messages.GenericEvent:
+		return s.describeMinor(e)
+	}
+	return ""
+}
+
+// Describes the minor messages that only have generic events.
+func (s *State) describeMinor(e *messages.GenericEvent) string {
+	name := ""
+	if len(e.Data) > 0 {
+		if id, err := messages.ParsePokemonIdent(e.Data[0]); err == nil {
+			name = s.name(id)
+		}
+	}
+	switch e.Type {
+	case "-crit":
+		return "A critical hit!"
+	case "-supereffective":
+		return "It's super effective!"
+	case "-resisted":
+		return "It's not very effective..."
+	case "-immune":
+		return fmt.Sprintf("It doesn't affect %s...", name)
+	case "-miss":
+		return "The attack missed!"
+	case "-fail":
+		return "But it failed!"
+	case "cant":
+		return fmt.Sprintf("%s can't move!", name)
+	}
+	return ""
+}
+
+// The player's username, falling back to their player ID before it's known.
+func (s *State) player(id string) string {
+	if sd, ok := s.Sides[id]; ok && sd.Username != "" {
+		return sd.Username
+	}
+	return id
+}
+
+// Names a Pokémon along with its player, like "Anonycat's Sparky", since both sides can
+// have the same species out.
+func (s *State) name(id messages.PokemonIdent) string {
+	return fmt.Sprintf("%s's %s", s.player(id.Side), id.Name)
+}
+
+// What happens when a Pokémon gets each status, and what it's cured of.
+var statusNames = map[string][2]string{
+	"brn": {"was burned", "burn"},
+	"par": {"was paralyzed", "paralysis"},
+	"slp": {"fell asleep", "sleep"},
+	"frz": {"was frozen solid", "freeze"},
+	"psn": {"was poisoned", "poison"},
+	"tox": {"was badly poisoned", "poison"},
+}
+
+var statNames = map[string]string{
+	"atk":      "Attack",
+	"def":      "Defense",
+	"spa":      "Sp. Atk",
+	"spd":      "Sp. Def",
+	"spe":      "Speed",
+	"accuracy": "accuracy",
+	"evasion":  "evasiveness",
+}
+
+func describeBoost(name string, e *messages.BoostEvent) string {
+	stat := statNames[e.Stat]
+	if stat == "" {
+		stat = e.Stat
+	}
+	if e.Type == "-setboost" {
+		return fmt.Sprintf("%s's %s was set to %+d!", name, stat, e.Amount)
+	}
+	var change string
+	switch n := e.Amount; {
+	case n == 0 && e.Type == "-boost":
+		change = "won't go any higher"
+	case n == 0:
+		change = "won't go any lower"
+	case n == 1:
+		change = "rose"
+	case n == 2:
+		change = "rose sharply"
+	case n > 2:
+		change = "rose drastically"
+	case n == -1:
+		change = "fell"
+	case n == -2:
+		change = "harshly fell"
+	default:
+		change = "severely fell"
+	}
+	return fmt.Sprintf("%s's %s %s!", name, stat, change)
+}
+
+func weatherName(weather string) string {
+	switch weather {
+	case "SunnyDay":
+		return "harsh sunlight"
+	case "RainDance":
+		return "rain"
+	case "Sandstorm":
+		return "a sandstorm"
+	case "DesolateLand":
+		return "extremely harsh sunlight"
+	case "PrimordialSea":
+		return "heavy rain"
+	case "DeltaStream":
+		return "strong winds"
+	}
+	return strings.ToLower(weather)
+}
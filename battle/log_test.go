@@ -0,0 +1,92 @@
+package battle_test
+
+import (
+	"testing"
+
+	"surrealchemist.com/mass-showdown-backend/battle"
+	"surrealchemist.com/mass-showdown-backend/messages"
+)
+
+func feedLog(t *testing.T, tr *battle.Tracker, frame string) []battle.LogLine {
+	t.Helper()
+	sm, err := messages.ParseServerMessage([]byte(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := messages.DecodeEvents(sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr.ApplyMessage(sm, events)
+}
+
+func TestTrackerLogsBattle(t *testing.T) {
+	tr := battle.NewTracker()
+	start := `>battle-gen9randombattle-4
+|init|battle
+|player|p1|Anonycat|60|1200
+|player|p2|Anonybird|113|1300
+|gen|9
+|start
+|switch|p1a: Sparky|Pikachu, L59, F|180/180
+|switch|p2a: Groudon|Groudon, L60|100/100
+|turn|1`
+	lines := feedLog(t, tr, start)
+	want := []string{
+		"The battle started!",
+		"Anonycat sent out Sparky!",
+		"Anonybird sent out Groudon!",
+		"Turn 1",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("Expected %d lines but got %+v", len(want), lines)
+	}
+	for i, l := range lines {
+		if l.Text != want[i] || l.Seq != uint64(i+1) {
+			t.Errorf("Expected line %d to be %q but got %+v", i+1, want[i], l)
+		}
+	}
+
+	lines = feedLog(t, tr, `>battle-gen9randombattle-4
+|
+|t:|1700000000
+|move|p1a: Sparky|Thunderbolt|p2a: Groudon
+|-immune|p2a: Groudon
+|move|p2a: Groudon|Precipice Blades|p1a: Sparky
+|-supereffective|p1a: Sparky
+|-damage|p1a: Sparky|0 fnt
+|faint|p1a: Sparky
+|-boost|p2a: Groudon|atk|2
+|-weather|SunnyDay|[upkeep]
+|-status|p2a: Groudon|brn
+|-damage|p2a: Groudon|94/100 brn|[from] brn
+|win|Anonybird`)
+	want = []string{
+		"Anonycat's Sparky used Thunderbolt!",
+		"It doesn't affect Anonybird's Groudon...",
+		"Anonybird's Groudon used Precipice Blades!",
+		"It's super effective!",
+		"Anonycat's Sparky lost HP! (0%)",
+		"Anonycat's Sparky fainted!",
+		"Anonybird's Groudon's Attack rose sharply!",
+		"Anonybird's Groudon was burned!",
+		"Anonybird's Groudon lost HP from brn! (94%)",
+		"Anonybird won the battle!",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("Expected %d lines but got %+v", len(want), lines)
+	}
+	for i, l := range lines {
+		if l.Text != want[i] {
+			t.Errorf("Expected line %q but got %q", want[i], l.Text)
+		}
+	}
+	if first := lines[0]; first.Seq != 5 || first.Turn != 1 || first.Kind != "move" || len(first.Args) != 3 {
+		t.Errorf("Expected the move to be line 5 on turn 1 with its arguments but got %+v", first)
+	}
+
+	// Rejoining replays the log, which starts counting again
+	if lines := feedLog(t, tr, start); lines[0].Seq != 1 {
+		t.Errorf("Expected the replayed log to start from 1 but got %d", lines[0].Seq)
+	}
+}
@@ -0,0 +1,320 @@
+package battle
+
+import (
+	"strings"
+
+	"surrealchemist.com/mass-showdown-backend/dex"
+	"surrealchemist.com/mass-showdown-backend/messages"
+)
+
+type (
+	// Everything known about a battle room, built up from its protocol messages.
+	State struct {
+		RoomID   string           `json:"roomId"`
+		GameType string           `json:"gameType"`
+		Gen      int              `json:"gen"`
+		Tier     string           `json:"tier"`
+		Turn     int              `json:"turn"`
+		Weather  string           `json:"weather,omitempty"`
+		Fields   map[string]bool  `json:"fields"`
+		Sides    map[string]*Side `json:"sides"`
+		Started  bool             `json:"started"`
+		Ended    bool             `json:"ended"`
+		Winner   string           `json:"winner,omitempty"`
+		// How many lines of the battle log there have been.
+		logged uint64
+	}
+
+	// One player's half of the battle, keyed in State.Sides by player ID ("p1", "p2", ...).
+	Side struct {
+		Player   string `json:"player"`
+		Username string `json:"username"`
+		TeamSize int    `json:"teamSize"`
+		// Every Pokémon revealed so far, in the order they were revealed.
+		Pokemon []*Pokemon `json:"pokemon"`
+		// Active Pokémon by slot; "a" is slot 0, "b" is slot 1 and so on. Empty slots are nil.
+		Active []*Pokemon `json:"active"`
+		// Side conditions such as "Stealth Rock" or "Spikes", mapped to their layer count.
+		Conditions map[string]int `json:"conditions"`
+	}
+
+	Pokemon struct {
+		Name          string             `json:"name"`
+		Details       string             `json:"details"`
+		Species       string             `json:"species"`
+		Condition     messages.Condition `json:"condition"`
+		Active        bool               `json:"active"`
+		Boosts        map[string]int     `json:"boosts"`
+		Item          string             `json:"item,omitempty"`
+		Ability       string             `json:"ability,omitempty"`
+		TeraType      string             `json:"teraType,omitempty"`
+		Terastallized bool               `json:"terastallized"`
+		// Moves the Pokémon has been seen using.
+		Moves []string `json:"moves"`
+	}
+)
+
+func NewState(roomID string) *State {
+	return &State{
+		RoomID: roomID,
+		Fields: make(map[string]bool),
+		Sides:  make(map[string]*Side),
+	}
+}
+
+// Removes the effect prefix from conditions like "move: Stealth Rock".
+func effectName(s string) string {
+	if _, name, ok := strings.Cut(s, ": "); ok {
+		return name
+	}
+	return s
+}
+
+func (s *State) side(player string) *Side {
+	sd, ok := s.Sides[player]
+	if !ok {
+		sd = &Side{
+			Player:     player,
+			Conditions: make(map[string]int),
+		}
+		s.Sides[player] = sd
+	}
+	return sd
+}
+
+// Finds a revealed Pokémon by nickname, falling back to one revealed at team preview
+// with the same species that hasn't been matched to a nickname yet.
+func (sd *Side) find(name, details string) *Pokemon {
+	for _, p := range sd.Pokemon {
+		if p.Name == name {
+			return p
+		}
+	}
+	if details == "" {
+		return nil
+	}
+	species := dex.ParseDetails(details).Species
+	for _, p := range sd.Pokemon {
+		if p.Name == "" && p.Species == species {
+			p.Name = name
+			return p
+		}
+	}
+	return nil
+}
+
+func (sd *Side) findOrAdd(name, details string) *Pokemon {
+	if p := sd.find(name, details); p != nil {
+		return p
+	}
+	p := &Pokemon{
+		Name:    name,
+		Details: details,
+		Species: dex.ParseDetails(details).Species,
+		Boosts:  make(map[string]int),
+	}
+	if p.Species == "" {
+		p.Species = name
+	}
+	sd.Pokemon = append(sd.Pokemon, p)
+	return p
+}
+
+// Returns the Pokémon an ident refers to, preferring the occupant of its active slot.
+func (s *State) pokemon(id messages.PokemonIdent) *Pokemon {
+	sd := s.side(id.Side)
+	if slot := slotIndex(id.Position); slot >= 0 && slot < len(sd.Active) && sd.Active[slot] != nil {
+		if sd.Active[slot].Name == id.Name {
+			return sd.Active[slot]
+		}
+	}
+	return sd.findOrAdd(id.Name, "")
+}
+
+func slotIndex(position string) int {
+	if position == "" {
+		return -1
+	}
+	return int(position[0] - 'a')
+}
+
+// Updates the state with a single decoded protocol event. Events that don't affect
+// the battle state are ignored.
+func (s *State) Apply(ev messages.Event) {
+	switch e := ev.(type) {
+	case *messages.PlayerEvent:
+		if e.Username != "" {
+			s.side(e.Player).Username = e.Username
+		}
+	case *messages.TeamSizeEvent:
+		s.side(e.Player).TeamSize = e.Size
+	case *messages.GameTypeEvent:
+		s.GameType = e.GameType
+	case *messages.GenEvent:
+		s.Gen = e.Gen
+	case *messages.TierEvent:
+		s.Tier = e.Tier
+	case *messages.PokeEvent:
+		sd := s.side(e.Player)
+		sd.Pokemon = append(sd.Pokemon, &Pokemon{
+			Details: e.Details,
+			Species: dex.ParseDetails(e.Details).Species,
+			Boosts:  make(map[string]int),
+		})
+	case *messages.StartEvent:
+		s.Started = true
+	case *messages.TurnEvent:
+		s.Turn = e.Turn
+	case *messages.WinEvent:
+		s.Ended = true
+		s.Winner = e.Winner
+	case *messages.TieEvent:
+		s.Ended = true
+	case *messages.SwitchEvent:
+		s.switchIn(e)
+	case *messages.DetailsChangeEvent:
+		p := s.pokemon(e.Pokemon)
+		p.Details = e.Details
+		p.Species = dex.ParseDetails(e.Details).Species
+		if e.Condition != nil {
+			p.Condition = *e.Condition
+		}
+	case *messages.MoveEvent:
+		p := s.pokemon(e.Pokemon)
+		for _, m := range p.Moves {
+			if m == e.Move {
+				return
+			}
+		}
+		p.Moves = append(p.Moves, e.Move)
+	case *messages.HealthEvent:
+		s.pokemon(e.Pokemon).Condition = e.Condition
+	case *messages.FaintEvent:
+		p := s.pokemon(e.Pokemon)
+		p.Condition.HP = 0
+		p.Condition.Status = ""
+		p.Condition.Fainted = true
+	case *messages.StatusEvent:
+		p := s.pokemon(e.Pokemon)
+		if e.Cure {
+			p.Condition.Status = ""
+		} else {
+			p.Condition.Status = e.Status
+		}
+	case *messages.BoostEvent:
+		p := s.pokemon(e.Pokemon)
+		if e.Type == "-setboost" {
+			p.Boosts[e.Stat] = e.Amount
+		} else {
+			p.Boosts[e.Stat] = clampBoost(p.Boosts[e.Stat] + e.Amount)
+		}
+	case *messages.ClearBoostEvent:
+		if !e.All {
+			clear(s.pokemon(e.Pokemon).Boosts)
+			break
+		}
+		for _, sd := range s.Sides {
+			for _, p := range sd.Active {
+				if p != nil {
+					clear(p.Boosts)
+				}
+			}
+		}
+	case *messages.WeatherEvent:
+		if e.Weather == "none" {
+			s.Weather = ""
+		} else {
+			s.Weather = e.Weather
+		}
+	case *messages.FieldEvent:
+		if e.End {
+			delete(s.Fields, effectName(e.Condition))
+		} else {
+			s.Fields[effectName(e.Condition)] = true
+		}
+	case *messages.SideConditionEvent:
+		sd := s.side(e.Side)
+		if e.End {
+			delete(sd.Conditions, effectName(e.Condition))
+		} else {
+			sd.Conditions[effectName(e.Condition)]++
+		}
+	case *messages.TerastallizeEvent:
+		p := s.pokemon(e.Pokemon)
+		p.TeraType = e.TeraType
+		p.Terastallized = true
+	case *messages.ItemEvent:
+		p := s.pokemon(e.Pokemon)
+		if e.End {
+			p.Item = ""
+		} else {
+			p.Item = e.Item
+		}
+	case *messages.AbilityEvent:
+		s.pokemon(e.Pokemon).Ability = e.Ability
+	}
+}
+
+func (s *State) switchIn(e *messages.SwitchEvent) {
+	sd := s.side(e.Pokemon.Side)
+	slot := slotIndex(e.Pokemon.Position)
+	if slot < 0 {
+		return
+	}
+	for len(sd.Active) <= slot {
+		sd.Active = append(sd.Active, nil)
+	}
+	if out := sd.Active[slot]; out != nil {
+		out.Active = false
+		clear(out.Boosts)
+	}
+	p := sd.findOrAdd(e.Pokemon.Name, e.Details)
+	p.Details = e.Details
+	p.Species = dex.ParseDetails(e.Details).Species
+	p.Condition = e.Condition
+	p.Active = true
+	sd.Active[slot] = p
+}
+
+func clampBoost(n int) int {
+	return max(-6, min(6, n))
+}
+
+// Returns a deep copy of the state that's safe to hand to other goroutines.
+func (s *State) Snapshot() *State {
+	c := *s
+	c.Fields = make(map[string]bool, len(s.Fields))
+	for k, v := range s.Fields {
+		c.Fields[k] = v
+	}
+	c.Sides = make(map[string]*Side, len(s.Sides))
+	for id, sd := range s.Sides {
+		c.Sides[id] = sd.snapshot()
+	}
+	return &c
+}
+
+func (sd *Side) snapshot() *Side {
+	c := *sd
+	copies := make(map[*Pokemon]*Pokemon, len(sd.Pokemon))
+	c.Pokemon = make([]*Pokemon, len(sd.Pokemon))
+	for i, p := range sd.Pokemon {
+		pc := *p
+		pc.Boosts = make(map[string]int, len(p.Boosts))
+		for k, v := range p.Boosts {
+			pc.Boosts[k] = v
+		}
+		pc.Moves = append([]string(nil), p.Moves...)
+		c.Pokemon[i] = &pc
+		copies[p] = &pc
+	}
+	c.Active = make([]*Pokemon, len(sd.Active))
+	for i, p := range sd.Active {
+		c.Active[i] = copies[p]
+	}
+	c.Conditions = make(map[string]int, len(sd.Conditions))
+	for k, v := range sd.Conditions {
+		c.Conditions[k] = v
+	}
+	return &c
+}
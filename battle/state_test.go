@@ -0,0 +1,106 @@
+package battle_test
+
+import (
+	"testing"
+
+	"surrealchemist.com/mass-showdown-backend/battle"
+	"surrealchemist.com/mass-showdown-backend/messages"
+)
+
+func feed(t *testing.T, tr *battle.Tracker, frame string) {
+	t.Helper()
+	sm, err := messages.ParseServerMessage([]byte(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := messages.DecodeEvents(sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Apply(sm.RoomID, events)
+}
+
+func TestTrackerFollowsBattle(t *testing.T) {
+	tr := battle.NewTracker()
+	feed(t, tr, `>battle-gen9randombattle-1
+|player|p1|Anonycat|60|1200
+|player|p2|Anonybird|113|1300
+|teamsize|p1|2
+|teamsize|p2|2
+|gametype|singles
+|gen|9
+|poke|p2|Groudon, L60|
+|poke|p2|Feebas, L1, M|
+|start
+|switch|p1a: Sparky|Pikachu, L59, F|100/100
+|switch|p2a: Groudon|Groudon, L60|100/100
+|turn|1`)
+	feed(t, tr, `>battle-gen9randombattle-1
+|
+|move|p2a: Groudon|Swords Dance|p2a: Groudon
+|-boost|p2a: Groudon|atk|2
+|move|p1a: Sparky|Thunderbolt|p2a: Groudon
+|-damage|p2a: Groudon|70/100
+|-weather|SunnyDay|[from] ability: Drought|[of] p2a: Groudon
+|-sidestart|p1: Anonycat|move: Spikes
+|-sidestart|p1: Anonycat|move: Spikes
+|-fieldstart|move: Trick Room|[of] p1a: Sparky
+|turn|2`)
+
+	s := tr.Snapshot("battle-gen9randombattle-1")
+	if s == nil {
+		t.Fatal("Expected the battle to be tracked")
+	}
+	if s.Turn != 2 || s.Gen != 9 || !s.Started {
+		t.Errorf("Expected started gen 9 battle on turn 2 but got %+v", s)
+	}
+	opp := s.Sides["p2"]
+	if len(opp.Pokemon) != 2 {
+		t.Fatalf("Expected team preview and switch to share an entry but got %d pokemon", len(opp.Pokemon))
+	}
+	groudon := opp.Active[0]
+	if groudon == nil || groudon.Species != "Groudon" {
+		t.Fatalf("Expected Groudon to be active but got %+v", groudon)
+	}
+	if groudon.Condition.HP != 70 || groudon.Boosts["atk"] != 2 {
+		t.Errorf("Expected Groudon at 70 HP with +2 atk but got %+v", groudon)
+	}
+	if len(groudon.Moves) != 1 || groudon.Moves[0] != "Swords Dance" {
+		t.Errorf("Expected Groudon to have revealed Swords Dance but got %v", groudon.Moves)
+	}
+	if s.Weather != "SunnyDay" || !s.Fields["Trick Room"] {
+		t.Errorf("Expected sun and trick room but got %s and %v", s.Weather, s.Fields)
+	}
+	if s.Sides["p1"].Conditions["Spikes"] != 2 {
+		t.Errorf("Expected 2 layers of spikes but got %d", s.Sides["p1"].Conditions["Spikes"])
+	}
+
+	// Snapshots must not change when the battle moves on
+	feed(t, tr, `>battle-gen9randombattle-1
+|switch|p2a: Feebas|Feebas, L1, M|100/100`)
+	if s.Sides["p2"].Active[0].Species != "Groudon" {
+		t.Error("Expected earlier snapshot to be unaffected by later messages")
+	}
+	s = tr.Snapshot("battle-gen9randombattle-1")
+	if s.Sides["p2"].Pokemon[0].Boosts["atk"] != 0 {
+		t.Error("Expected boosts to be cleared when switching out")
+	}
+}
+
+func TestTrackerResetsOnRejoin(t *testing.T) {
+	tr := battle.NewTracker()
+	log := `>battle-gen9randombattle-2
+|init|battle
+|switch|p2a: Groudon|Groudon, L60|100/100
+|-sidestart|p1: Anonycat|move: Spikes`
+	feed(t, tr, log)
+	// Rejoining after a reconnect sends the same log again
+	feed(t, tr, log)
+	s := tr.Snapshot("battle-gen9randombattle-2")
+	if n := s.Sides["p1"].Conditions["Spikes"]; n != 1 {
+		t.Errorf("Expected 1 layer of spikes after replaying the log but got %d", n)
+	}
+	if n := len(s.Sides["p2"].Pokemon); n != 1 {
+		t.Errorf("Expected 1 revealed pokemon after replaying the log but got %d", n)
+	}
+}
@@ -0,0 +1,65 @@
+package battle
+
+import (
+	"strings"
+	"sync"
+
+	"surrealchemist.com/mass-showdown-backend/messages"
+)
+
+// Keeps a State for every battle room it's fed messages for.
+// It's safe to use from multiple goroutines.
+type Tracker struct {
+	sync.Mutex
+	rooms map[string]*State
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{
+		rooms: make(map[string]*State),
+	}
+}
+
+// Applies decoded events from a server message to their room's state.
+// Events for rooms that aren't battles are ignored.
+func (t *Tracker) Apply(roomID string, events []messages.Event) {
+	if !strings.HasPrefix(roomID, "battle-") {
+		return
+	}
+	t.Lock()
+	for _, e := range events {
+		t.apply(roomID, e)
+	}
+	t.Unlock()
+}
+
+// Applies an event to the room's state and returns the state. Must be called with the
+// tracker locked.
+func (t *Tracker) apply(roomID string, e messages.Event) *State {
+	s, ok := t.rooms[roomID]
+	// Rejoining a room replays its whole log, so start over
+	if _, init := e.(*messages.InitEvent); !ok || init {
+		s = NewState(roomID)
+		t.rooms[roomID] = s
+	}
+	s.Apply(e)
+	return s
+}
+
+// Returns a copy of the room's current state, or nil if the room isn't being tracked.
+func (t *Tracker) Snapshot(roomID string) *State {
+	t.Lock()
+	defer t.Unlock()
+	s, ok := t.rooms[roomID]
+	if !ok {
+		return nil
+	}
+	return s.Snapshot()
+}
+
+// Stops tracking a room.
+func (t *Tracker) Remove(roomID string) {
+	t.Lock()
+	delete(t.rooms, roomID)
+	t.Unlock()
+}
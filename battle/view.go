@@ -0,0 +1,166 @@
+package battle
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type (
+	// What one player can see of the battle: the field, their own side's conditions and
+	// everything revealed about their opponents. This is what voters are shown next to
+	// the poll, so they know what they're up against.
+	View struct {
+		Turn    int    `json:"turn"`
+		Weather string `json:"weather,omitempty"`
+		Terrain string `json:"terrain,omitempty"`
+		// Other effects on the whole field, like Trick Room or Gravity.
+		Field []string `json:"field,omitempty"`
+		// Hazards and screens on the player's own side, mapped to their layer count.
+		Conditions map[string]int  `json:"conditions,omitempty"`
+		Opponents  []*OpponentView `json:"opponents"`
+	}
+
+	OpponentView struct {
+		Player   string `json:"player"`
+		Username string `json:"username"`
+		TeamSize int    `json:"teamSize"`
+		// Active Pokémon by slot, with nil for empty slots.
+		Active []*PokemonView `json:"active"`
+		// Every Pokémon revealed so far, including the active ones.
+		Team []*PokemonView `json:"team"`
+		// Hazards and screens on their side, mapped to their layer count.
+		Conditions map[string]int `json:"conditions,omitempty"`
+	}
+
+	PokemonView struct {
+		Species string `json:"species"`
+		Details string `json:"details"`
+		// Remaining HP as a percentage, rounded so a Pokémon that isn't fainted never
+		// shows 0.
+		HP int `json:"hp"`
+		// Its types, or just its tera type once it's terastallized. Left for callers with
+		// dex data to fill in.
+		Types         []string       `json:"types,omitempty"`
+		Status        string         `json:"status,omitempty"`
+		Fainted       bool           `json:"fainted,omitempty"`
+		Active        bool           `json:"active,omitempty"`
+		Boosts        map[string]int `json:"boosts,omitempty"`
+		Item          string         `json:"item,omitempty"`
+		Ability       string         `json:"ability,omitempty"`
+		TeraType      string         `json:"teraType,omitempty"`
+		Terastallized bool           `json:"terastallized,omitempty"`
+		Moves         []string       `json:"moves,omitempty"`
+	}
+)
+
+// Returns the battle as the player ("p1", "p2", ...) sees it. In battles with more than
+// two players, the players on the other team are the opponents, or everyone else in free
+// for alls.
+func (s *State) View(player string) *View {
+	v := &View{Turn: s.Turn, Weather: s.Weather}
+	for name := range s.Fields {
+		if strings.HasSuffix(name, " Terrain") {
+			v.Terrain = name
+		} else {
+			v.Field = append(v.Field, name)
+		}
+	}
+	sort.Strings(v.Field)
+	if own, ok := s.Sides[player]; ok {
+		v.Conditions = copyConditions(own.Conditions)
+	}
+	for id, sd := range s.Sides {
+		if s.opposes(player, id) {
+			v.Opponents = append(v.Opponents, sd.view())
+		}
+	}
+	sort.Slice(v.Opponents, func(a, b int) bool {
+		return v.Opponents[a].Player < v.Opponents[b].Player
+	})
+	return v
+}
+
+// Whether the other player is on the opposing team. Teams in multi battles are p1 and p3
+// against p2 and p4.
+func (s *State) opposes(player, other string) bool {
+	if player == other {
+		return false
+	}
+	if s.GameType == "freeforall" {
+		return true
+	}
+	a, errA := strconv.Atoi(strings.TrimPrefix(player, "p"))
+	b, errB := strconv.Atoi(strings.TrimPrefix(other, "p"))
+	if errA != nil || errB != nil {
+		return true
+	}
+	return a%2 != b%2
+}
+
+func (sd *Side) view() *OpponentView {
+	ov := &OpponentView{
+		Player:     sd.Player,
+		Username:   sd.Username,
+		TeamSize:   sd.TeamSize,
+		Conditions: copyConditions(sd.Conditions),
+	}
+	views := make(map[*Pokemon]*PokemonView, len(sd.Pokemon))
+	for _, p := range sd.Pokemon {
+		pv := p.view()
+		views[p] = pv
+		ov.Team = append(ov.Team, pv)
+	}
+	for _, p := range sd.Active {
+		ov.Active = append(ov.Active, views[p])
+	}
+	return ov
+}
+
+func (p *Pokemon) view() *PokemonView {
+	pv := &PokemonView{
+		Species:       p.Species,
+		Details:       p.Details,
+		HP:            hpPercent(p),
+		Status:        p.Condition.Status,
+		Fainted:       p.Condition.Fainted,
+		Active:        p.Active,
+		Item:          p.Item,
+		Ability:       p.Ability,
+		TeraType:      p.TeraType,
+		Terastallized: p.Terastallized,
+		Moves:         append([]string(nil), p.Moves...),
+	}
+	for stat, n := range p.Boosts {
+		if n != 0 {
+			if pv.Boosts == nil {
+				pv.Boosts = make(map[string]int)
+			}
+			pv.Boosts[stat] = n
+		}
+	}
+	return pv
+}
+
+// Pokémon revealed at team preview haven't been seen taking damage, so they're at full HP.
+func hpPercent(p *Pokemon) int {
+	c := p.Condition
+	switch {
+	case c.Fainted:
+		return 0
+	case c.MaxHP == 0:
+		return 100
+	}
+	return max(1, (c.HP*100+c.MaxHP/2)/c.MaxHP)
+}
+
+func copyConditions(m map[string]int) map[string]int {
+	if len(m) == 0 {
+		return nil
+	}
+	c := make(map[string]int, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,79 @@
+package battle_test
+
+import (
+	"testing"
+
+	"surrealchemist.com/mass-showdown-backend/battle"
+)
+
+func TestViewShowsOpponentAndField(t *testing.T) {
+	tr := battle.NewTracker()
+	feed(t, tr, `>battle-gen9randombattle-3
+|player|p1|Anonycat|60|1200
+|player|p2|Anonybird|113|1300
+|teamsize|p2|3
+|gametype|singles
+|poke|p2|Groudon, L60|
+|poke|p2|Feebas, L1, M|
+|start
+|switch|p1a: Sparky|Pikachu, L59, F|180/180
+|switch|p2a: Groudon|Groudon, L60|100/100
+|turn|1
+|
+|move|p1a: Sparky|Thunder Wave|p2a: Groudon
+|-status|p2a: Groudon|par
+|move|p2a: Groudon|Precipice Blades|p1a: Sparky
+|-damage|p1a: Sparky|20/180
+|-boost|p2a: Groudon|atk|1
+|-weather|SunnyDay|[from] ability: Drought|[of] p2a: Groudon
+|-fieldstart|move: Electric Terrain|[from] ability: Electric Surge
+|-fieldstart|move: Trick Room|[of] p1a: Sparky
+|-sidestart|p1: Anonycat|move: Stealth Rock
+|-sidestart|p2: Anonybird|move: Spikes
+|-sidestart|p2: Anonybird|move: Spikes
+|-damage|p2a: Groudon|1/100 par
+|turn|2`)
+
+	v := tr.Snapshot("battle-gen9randombattle-3").View("p1")
+	if v.Turn != 2 || v.Weather != "SunnyDay" || v.Terrain != "Electric Terrain" {
+		t.Errorf("Expected sun and electric terrain on turn 2 but got %+v", v)
+	}
+	if len(v.Field) != 1 || v.Field[0] != "Trick Room" {
+		t.Errorf("Expected trick room to be the other field effect but got %v", v.Field)
+	}
+	if v.Conditions["Stealth Rock"] != 1 {
+		t.Errorf("Expected stealth rock on our side but got %v", v.Conditions)
+	}
+	if len(v.Opponents) != 1 {
+		t.Fatalf("Expected one opponent but got %d", len(v.Opponents))
+	}
+	opp := v.Opponents[0]
+	if opp.Username != "Anonybird" || opp.TeamSize != 3 || opp.Conditions["Spikes"] != 2 {
+		t.Errorf("Expected Anonybird's side with 2 layers of spikes but got %+v", opp)
+	}
+	if len(opp.Team) != 2 || len(opp.Active) != 1 {
+		t.Fatalf("Expected 2 revealed pokemon with 1 active but got %+v", opp)
+	}
+	groudon := opp.Active[0]
+	if groudon.Species != "Groudon" || groudon.HP != 1 || groudon.Status != "par" || groudon.Boosts["atk"] != 1 {
+		t.Errorf("Expected paralysed Groudon at 1%% with +1 atk but got %+v", groudon)
+	}
+	if len(groudon.Moves) != 1 || groudon.Moves[0] != "Precipice Blades" {
+		t.Errorf("Expected Groudon to have revealed Precipice Blades but got %v", groudon.Moves)
+	}
+	if feebas := opp.Team[1]; feebas.Species != "Feebas" || feebas.HP != 100 || feebas.Active {
+		t.Errorf("Expected Feebas to be benched at full HP but got %+v", feebas)
+	}
+
+	// The other player sees our pokemon as the opponent
+	v = tr.Snapshot("battle-gen9randombattle-3").View("p2")
+	if len(v.Opponents) != 1 || v.Opponents[0].Player != "p1" {
+		t.Fatalf("Expected p1 to be p2's opponent but got %+v", v.Opponents)
+	}
+	if sparky := v.Opponents[0].Active[0]; sparky.HP != 11 {
+		t.Errorf("Expected Pikachu at 11%% but got %d%%", sparky.HP)
+	}
+	if v.Conditions["Spikes"] != 2 {
+		t.Errorf("Expected p2 to see spikes on their side but got %v", v.Conditions)
+	}
+}
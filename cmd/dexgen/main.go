@@ -0,0 +1,192 @@
+// Command dexgen downloads Showdown's data files into dex/data, so the whole Pokédex is
+// bundled rather than the subset that's checked in, along with the gen 9 random battle
+// sets the dex tests check it against. It's run by go generate in the dex package:
+//
+//	go generate ./dex
+//
+// pokedex.json and moves.json are served as JSON, but abilities, items and the type chart
+// are only served as JavaScript object literals, which are converted to JSON.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The files to download, by the name they're saved under.
+var files = map[string]string{
+	"pokedex.json":   "pokedex.json",
+	"moves.json":     "moves.json",
+	"abilities.json": "abilities.js",
+	"items.json":     "items.js",
+	"typechart.json": "typechart.js",
+}
+
+func main() {
+	base := flag.String("url", "https://play.pokemonshowdown.com/data/", "where Showdown's data files are served from")
+	out := flag.String("out", "data", "the directory to write the files to")
+	sets := flag.String("sets-url", "https://data.pkmn.cc/randbats/gen9randombattle.json", "where the gen 9 random battle sets are served from")
+	setsOut := flag.String("sets-out", "testdata/gen9randombattle.json", "the file to write the random battle sets to")
+	flag.Parse()
+
+	client := &http.Client{Timeout: time.Minute}
+	for name, src := range files {
+		if err := fetch(client, *base+src, filepath.Join(*out, name)); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", src, err)
+			os.Exit(1)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(*setsOut), 0o755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := fetch(client, *sets, *setsOut); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *sets, err)
+		os.Exit(1)
+	}
+}
+
+func fetch(client *http.Client, url, path string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(url, ".js") {
+		if b, err = jsToJSON(b); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, b, "", " "); err != nil {
+		return fmt.Errorf("not valid JSON: %w", err)
+	}
+	buf.WriteByte('\n')
+	return os.WriteFile(path, buf.Bytes(), 0o644)
+}
+
+// Converts a file like "exports.BattleItems = {abilityshield:{name:'Ability Shield',...}};"
+// to JSON by quoting keys and strings and dropping trailing commas. The data files only
+// hold plain values, so nothing else needs converting.
+func jsToJSON(src []byte) ([]byte, error) {
+	start, end := bytes.IndexByte(src, '{'), bytes.LastIndexByte(src, '}')
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("no object literal found")
+	}
+	src = src[start : end+1]
+	var out bytes.Buffer
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '"' || c == '\'':
+			s, n, err := readString(src[i:])
+			if err != nil {
+				return nil, err
+			}
+			q, _ := json.Marshal(s)
+			out.Write(q)
+			i += n
+		case c == ',':
+			// Trailing commas aren't allowed in JSON
+			j := skipSpace(src, i+1)
+			if j < len(src) && (src[j] == '}' || src[j] == ']') {
+				i = j
+				continue
+			}
+			out.WriteByte(c)
+			i++
+		case isWordByte(c):
+			j := i
+			for j < len(src) && isWordByte(src[j]) {
+				j++
+			}
+			word := string(src[i:j])
+			if k := skipSpace(src, j); k < len(src) && src[k] == ':' {
+				q, _ := json.Marshal(word)
+				out.Write(q)
+			} else {
+				if strings.HasPrefix(word, ".") || strings.HasPrefix(word, "-.") {
+					word = strings.Replace(word, ".", "0.", 1)
+				}
+				out.WriteString(word)
+			}
+			i = j
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// Reads a quoted string from the start of src, returning it unescaped along with how many
+// bytes it took up.
+func readString(src []byte) (string, int, error) {
+	quote := src[0]
+	var sb strings.Builder
+	for i := 1; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == quote:
+			return sb.String(), i + 1, nil
+		case c != '\\':
+			sb.WriteByte(c)
+		case i+1 >= len(src):
+			return "", 0, fmt.Errorf("unterminated string")
+		default:
+			i++
+			switch e := src[i]; e {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			case 'u', 'x':
+				digits := 4
+				if e == 'x' {
+					digits = 2
+				}
+				if i+digits >= len(src) {
+					return "", 0, fmt.Errorf("bad escape in string")
+				}
+				var r rune
+				if _, err := fmt.Sscanf(string(src[i+1:i+1+digits]), "%x", &r); err != nil {
+					return "", 0, fmt.Errorf("bad escape in string: %w", err)
+				}
+				sb.WriteRune(r)
+				i += digits
+			default:
+				sb.WriteByte(e)
+			}
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+func skipSpace(src []byte, i int) int {
+	for i < len(src) && (src[i] == ' ' || src[i] == '\n' || src[i] == '\t' || src[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c == '$' || c == '.' || c == '-' || c == '+' ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,42 @@
+// Command fakeshowdown runs a fake Showdown server for rehearsing without a live account.
+// It prints the flags to start the bot with, then runs the given script against it.
+//
+//	go run ./cmd/fakeshowdown rehearsal.txt
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"surrealchemist.com/mass-showdown-backend/showdowntest"
+)
+
+func main() {
+	timeout := flag.Duration("timeout", 5*time.Minute, "how long each step of the script waits for the bot")
+	flag.Parse()
+
+	srv := showdowntest.NewServer()
+	defer srv.Close()
+	fmt.Printf("start the bot with: -sim-url %s -action-url %s\n", srv.URL, srv.ActionURL)
+
+	if path := flag.Arg(0); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		err = srv.RunScript(f, *timeout)
+		f.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("script finished, press ctrl-c to stop")
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	<-stop
+}
@@ -0,0 +1,40 @@
+// Command loadtest connects a crowd of simulated voters to a running poll server and
+// reports how their votes were handled. Start the bot first, e.g. playing back a
+// recorded battle so there's a poll to vote in:
+//
+//	go run . -playback replays/battle-gen9randombattle-1.jsonl
+//	go run ./cmd/loadtest -voters 2000 -duration 1m
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"surrealchemist.com/mass-showdown-backend/loadtest"
+)
+
+func main() {
+	var cfg loadtest.Config
+	flag.StringVar(&cfg.URL, "url", "ws://localhost:8080/ws", "the poll server's websocket URL")
+	flag.IntVar(&cfg.Voters, "voters", 500, "how many voters to connect")
+	flag.DurationVar(&cfg.Duration, "duration", 30*time.Second, "how long voters stay connected")
+	flag.DurationVar(&cfg.VoteEvery, "vote-every", 0, "how often voters change their vote, or 0 to vote once per poll")
+	flag.Int64Var(&cfg.Seed, "seed", time.Now().UnixNano(), "seeds the voters' random choices")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report, err := loadtest.Run(ctx, cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	fmt.Print(report)
+	if report.Failed > 0 || report.Evicted > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,511 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	Config struct {
+		Showdown   Showdown   `json:"showdown"`
+		Challenges Challenges `json:"challenges"`
+		Server     Server     `json:"server"`
+		Poll       Poll       `json:"poll"`
+		Replay     Replay     `json:"replay"`
+		Store      Store      `json:"store"`
+		Identity   Identity   `json:"identity"`
+	}
+
+	// Settings for the bot's connection to Pokémon Showdown.
+	Showdown struct {
+		SimURL    string `json:"simUrl"`
+		ActionURL string `json:"actionUrl"`
+		Username  string `json:"username"`
+		Password  string `json:"password"`
+		// Whether battles still being played are forfeited on shutdown. Otherwise they're
+		// left for the bot to rejoin when it starts again, if the battle timer allows.
+		ForfeitOnShutdown bool `json:"forfeitOnShutdown"`
+	}
+
+	// Rules for which challenges the bot accepts.
+	Challenges struct {
+		// If not empty, only these users may challenge the bot.
+		AllowUsers StringList `json:"allowUsers"`
+		DenyUsers  StringList `json:"denyUsers"`
+		// If not empty, only challenges in these formats are accepted.
+		Formats StringList `json:"formats"`
+		// One of RatedAny, RatedOnly or UnratedOnly.
+		Rated            string `json:"rated"`
+		AllowCustomRules bool   `json:"allowCustomRules"`
+		// How many battles the bot plays at once.
+		MaxBattles int `json:"maxBattles"`
+	}
+
+	// Settings for the web server voters connect to.
+	Server struct {
+		ListenAddr string `json:"listenAddr"`
+		// Hosts allowed to open the voting websocket.
+		AuthorizedHosts StringList `json:"authorizedHosts"`
+		StaticDir       string     `json:"staticDir"`
+		// Where voters reach the server, like "https://vote.example.com", which login
+		// providers send them back to. If empty, it's the scheme and host they connected with.
+		PublicURL string `json:"publicUrl"`
+	}
+
+	Poll struct {
+		Duration Duration `json:"duration"`
+		// How each poll's winner is picked: one of the Tally constants.
+		Strategy string `json:"strategy"`
+		// Strategies used instead of Strategy for battles in some formats, by format ID.
+		FormatStrategies StringMap `json:"formatStrategies"`
+		// Close a poll early once this many voters have voted, or 0 to never.
+		Quorum int `json:"quorum"`
+		// Close a poll early once every connected voter has voted. Off by default, since
+		// voters can't change their minds once the poll closes.
+		CloseWhenAllVoted bool `json:"closeWhenAllVoted"`
+		// How much longer a tied poll stays open, and how many times it can be extended.
+		TieExtension     Duration `json:"tieExtension"`
+		MaxTieExtensions int      `json:"maxTieExtensions"`
+		// How long before the battle timer runs out polls close, to leave time to send
+		// the choice.
+		TimerMargin Duration `json:"timerMargin"`
+		// How often the results shown to voters who have voted are updated.
+		ResultsInterval Duration `json:"resultsInterval"`
+	}
+
+	// Settings for recording battles and playing them back.
+	Replay struct {
+		// Directory each battle is recorded to, or empty to not record.
+		Dir string `json:"dir"`
+		// A recorded battle to play back instead of connecting to Showdown.
+		Playback string `json:"playback"`
+	}
+
+	// Settings for how voters are identified.
+	Identity struct {
+		// Key session tokens are signed with. If empty, a random one is used and voters
+		// get new identities whenever the server restarts. Required with a login provider,
+		// since logged in sessions say who a voter is.
+		Secret     string   `json:"secret"`
+		SessionTTL Duration `json:"sessionTtl"`
+		// Where voters can log in: ProviderNone or ProviderStandIn.
+		Provider string `json:"provider"`
+		// Only voters who logged in may vote.
+		RequireLogin bool `json:"requireLogin"`
+	}
+
+	// Settings for keeping the history of every poll and vote.
+	Store struct {
+		// File the history is kept in, or empty to not keep it.
+		Path string `json:"path"`
+		// Bearer token GET /history must be called with. History lists voters, so it isn't
+		// served at all without one.
+		HistoryToken string `json:"historyToken"`
+	}
+)
+
+// Values for Challenges.Rated.
+const (
+	RatedAny    = "any"
+	RatedOnly   = "rated"
+	UnratedOnly = "unrated"
+)
+
+// Values for Identity.Provider.
+const (
+	ProviderNone    = ""
+	ProviderStandIn = "standin"
+)
+
+// Values for Poll.Strategy.
+const (
+	TallyPlurality      = "plurality"
+	TallyInstantRunoff  = "instant-runoff"
+	TallyApproval       = "approval"
+	TallyWeightedRandom = "weighted-random"
+)
+
+// Returns the configuration used when nothing overrides it. It has no credentials,
+// so those always need to be supplied.
+func Default() *Config {
+	return &Config{
+		Showdown: Showdown{
+			SimURL:    "wss://sim3.psim.us/showdown/websocket",
+			ActionURL: "https://play.pokemonshowdown.com/~~showdown/action.php",
+		},
+		Challenges: Challenges{
+			AllowUsers: StringList{"hosergang"},
+			Formats:    StringList{"gen9randombattle"},
+			Rated:      RatedAny,
+			MaxBattles: 1,
+		},
+		Server: Server{
+			ListenAddr:      ":8080",
+			AuthorizedHosts: StringList{"localhost:8080"},
+			StaticDir:       "./service/static",
+		},
+		Poll: Poll{
+			Duration:         Duration{30 * time.Second},
+			Strategy:         TallyPlurality,
+			TieExtension:     Duration{10 * time.Second},
+			MaxTieExtensions: 1,
+			TimerMargin:      Duration{5 * time.Second},
+			ResultsInterval:  Duration{time.Second},
+		},
+		Replay: Replay{
+			Dir: "./replays",
+		},
+		Store: Store{
+			Path: "./history/polls.jsonl",
+		},
+		Identity: Identity{
+			SessionTTL: Duration{30 * 24 * time.Hour},
+		},
+	}
+}
+
+// A setting that can be given as a flag or an environment variable.
+type setting struct {
+	flag, env, usage string
+	value            flag.Value
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"sim-url", "MSB_SIM_URL", "Showdown websocket URL", (*stringValue)(&c.Showdown.SimURL)},
+		{"action-url", "MSB_ACTION_URL", "Showdown login action URL", (*stringValue)(&c.Showdown.ActionURL)},
+		{"username", "MSB_USERNAME", "Showdown account the bot logs in as", (*stringValue)(&c.Showdown.Username)},
+		{"password", "MSB_PASSWORD", "password for the Showdown account", (*stringValue)(&c.Showdown.Password)},
+		{"forfeit-on-shutdown", "MSB_FORFEIT_ON_SHUTDOWN", "forfeit battles still being played when shutting down", (*boolValue)(&c.Showdown.ForfeitOnShutdown)},
+		{"allow-users", "MSB_ALLOW_USERS", "comma separated users allowed to challenge, or empty for anyone", &c.Challenges.AllowUsers},
+		{"deny-users", "MSB_DENY_USERS", "comma separated users whose challenges are always rejected", &c.Challenges.DenyUsers},
+		{"formats", "MSB_FORMATS", "comma separated formats challenges are accepted in, or empty for any", &c.Challenges.Formats},
+		{"rated", "MSB_RATED", "which challenges to accept: any, rated or unrated", (*stringValue)(&c.Challenges.Rated)},
+		{"max-battles", "MSB_MAX_BATTLES", "how many battles to play at once", (*intValue)(&c.Challenges.MaxBattles)},
+		{"listen", "MSB_LISTEN_ADDR", "address the poll server listens on", (*stringValue)(&c.Server.ListenAddr)},
+		{"authorized-hosts", "MSB_AUTHORIZED_HOSTS", "comma separated hosts allowed to open the voting websocket", &c.Server.AuthorizedHosts},
+		{"static-dir", "MSB_STATIC_DIR", "directory the web client is served from", (*stringValue)(&c.Server.StaticDir)},
+		{"public-url", "MSB_PUBLIC_URL", "URL voters reach the server at, or empty for the one they connected with", (*stringValue)(&c.Server.PublicURL)},
+		{"poll-duration", "MSB_POLL_DURATION", "how long each poll stays open", &c.Poll.Duration},
+		{"quorum", "MSB_QUORUM", "close polls once this many voters have voted, or 0 to never", (*intValue)(&c.Poll.Quorum)},
+		{"close-when-all-voted", "MSB_CLOSE_WHEN_ALL_VOTED", "close polls once every connected voter has voted", (*boolValue)(&c.Poll.CloseWhenAllVoted)},
+		{"tie-extension", "MSB_TIE_EXTENSION", "how much longer tied polls stay open", &c.Poll.TieExtension},
+		{"max-tie-extensions", "MSB_MAX_TIE_EXTENSIONS", "how many times a tied poll can be extended", (*intValue)(&c.Poll.MaxTieExtensions)},
+		{"timer-margin", "MSB_TIMER_MARGIN", "how long before the battle timer runs out polls close", &c.Poll.TimerMargin},
+		{"results-interval", "MSB_RESULTS_INTERVAL", "how often voters who have voted get new results", &c.Poll.ResultsInterval},
+		{"tally", "MSB_TALLY", "how poll winners are picked: plurality, instant-runoff, approval or weighted-random", (*stringValue)(&c.Poll.Strategy)},
+		{"format-tally", "MSB_FORMAT_TALLY", "comma separated format=tally pairs overriding -tally in those formats", &c.Poll.FormatStrategies},
+		{"replay-dir", "MSB_REPLAY_DIR", "directory battles are recorded to, or empty to not record", (*stringValue)(&c.Replay.Dir)},
+		{"history", "MSB_HISTORY", "file poll and vote history is kept in, or empty to not keep it", (*stringValue)(&c.Store.Path)},
+		{"history-token", "MSB_HISTORY_TOKEN", "bearer token needed to read /history, or empty to not serve it", (*stringValue)(&c.Store.HistoryToken)},
+		{"session-secret", "MSB_SESSION_SECRET", "key voter sessions are signed with, or empty for a random one", (*stringValue)(&c.Identity.Secret)},
+		{"session-ttl", "MSB_SESSION_TTL", "how long voter sessions last", &c.Identity.SessionTTL},
+		{"login-provider", "MSB_LOGIN_PROVIDER", "where voters log in: empty for nowhere, or standin", (*stringValue)(&c.Identity.Provider)},
+		{"require-login", "MSB_REQUIRE_LOGIN", "only let voters who logged in vote", (*boolValue)(&c.Identity.RequireLogin)},
+		{"playback", "MSB_PLAYBACK", "recorded battle to play back instead of connecting to showdown", (*stringValue)(&c.Replay.Playback)},
+	}
+}
+
+// Builds the configuration from, in increasing order of precedence: the defaults, the JSON
+// file given by -config (or MSB_CONFIG), environment variables, and the remaining flags.
+// The result is validated before it's returned. Asking for help with -h prints the usage
+// and returns flag.ErrHelp.
+func Load(name string, args []string) (*Config, error) {
+	cfg := Default()
+	// Flags are parsed into a scratch config so they can be applied last
+	flagged := Default()
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("MSB_CONFIG"), "path to a JSON config file")
+	for _, s := range flagged.settings() {
+		fs.Var(s.value, s.flag, fmt.Sprintf("%s (env %s)", s.usage, s.env))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *path != "" {
+		if err := cfg.loadFile(*path); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range cfg.settings() {
+			if s.flag == f.Name && err == nil {
+				err = s.value.Set(f.Value.String())
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening config file: %w", err)
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("reading config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) loadEnv() error {
+	for _, s := range c.settings() {
+		v, ok := os.LookupEnv(s.env)
+		if !ok {
+			continue
+		}
+		if err := s.value.Set(v); err != nil {
+			return fmt.Errorf("%s: %w", s.env, err)
+		}
+	}
+	return nil
+}
+
+// Checks that every setting is present and well formed. All problems are reported at once.
+func (c *Config) Validate() error {
+	var errs []error
+	// Playing back a recording doesn't log in
+	if c.Showdown.Username == "" && c.Replay.Playback == "" {
+		errs = append(errs, errors.New("showdown username is required"))
+	}
+	if c.Showdown.Password == "" && c.Replay.Playback == "" {
+		errs = append(errs, errors.New("showdown password is required"))
+	}
+	if err := checkURL(c.Showdown.SimURL, "ws", "wss"); err != nil {
+		errs = append(errs, fmt.Errorf("sim url: %w", err))
+	}
+	if err := checkURL(c.Showdown.ActionURL, "http", "https"); err != nil {
+		errs = append(errs, fmt.Errorf("action url: %w", err))
+	}
+	switch c.Challenges.Rated {
+	case RatedAny, RatedOnly, UnratedOnly:
+	default:
+		errs = append(errs, fmt.Errorf("rated must be %s, %s or %s but was %q", RatedAny, RatedOnly, UnratedOnly, c.Challenges.Rated))
+	}
+	if c.Challenges.MaxBattles < 1 {
+		errs = append(errs, errors.New("max battles must be at least 1"))
+	}
+	if c.Server.ListenAddr == "" {
+		errs = append(errs, errors.New("listen address is required"))
+	}
+	if len(c.Server.AuthorizedHosts) == 0 {
+		errs = append(errs, errors.New("at least one authorized host is required"))
+	}
+	if c.Server.PublicURL != "" {
+		if err := checkURL(c.Server.PublicURL, "http", "https"); err != nil {
+			errs = append(errs, fmt.Errorf("public url: %w", err))
+		}
+	}
+	if c.Poll.Duration.Duration <= 0 {
+		errs = append(errs, errors.New("poll duration must be positive"))
+	}
+	if c.Poll.ResultsInterval.Duration <= 0 {
+		errs = append(errs, errors.New("results interval must be positive"))
+	}
+	if c.Poll.Quorum < 0 || c.Poll.MaxTieExtensions < 0 {
+		errs = append(errs, errors.New("quorum and max tie extensions can't be negative"))
+	}
+	if c.Poll.TieExtension.Duration < 0 || c.Poll.TimerMargin.Duration < 0 {
+		errs = append(errs, errors.New("tie extension and timer margin can't be negative"))
+	}
+	if c.Identity.SessionTTL.Duration <= 0 {
+		errs = append(errs, errors.New("session ttl must be positive"))
+	}
+	switch c.Identity.Provider {
+	case ProviderNone, ProviderStandIn:
+	default:
+		errs = append(errs, fmt.Errorf("login provider must be empty or %s but was %q", ProviderStandIn, c.Identity.Provider))
+	}
+	if c.Identity.RequireLogin && c.Identity.Provider == ProviderNone {
+		errs = append(errs, errors.New("requiring login needs a login provider"))
+	}
+	if c.Identity.Provider != ProviderNone {
+		if err := checkSecret(c.Identity.Secret); err != nil {
+			errs = append(errs, fmt.Errorf("session secret: %w", err))
+		}
+	}
+	if err := checkStrategy(c.Poll.Strategy); err != nil {
+		errs = append(errs, err)
+	}
+	for _, format := range sortedKeys(c.Poll.FormatStrategies) {
+		if err := checkStrategy(c.Poll.FormatStrategies[format]); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", format, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func checkStrategy(name string) error {
+	switch name {
+	case TallyPlurality, TallyInstantRunoff, TallyApproval, TallyWeightedRandom:
+		return nil
+	}
+	return fmt.Errorf("tally must be %s, %s, %s or %s but was %q",
+		TallyPlurality, TallyInstantRunoff, TallyApproval, TallyWeightedRandom, name)
+}
+
+// The shortest session secret accepted with a login provider.
+const minSecretLength = 32
+
+// Rejects session secrets that are missing, too short to be hard to guess, or still the
+// placeholder from an example config.
+func checkSecret(secret string) error {
+	switch {
+	case secret == "":
+		return errors.New("is required to log voters in; set MSB_SESSION_SECRET")
+	case strings.Contains(strings.ToUpper(secret), "MSB_SESSION_SECRET"):
+		return errors.New("is still the example's placeholder")
+	case len(secret) < minSecretLength:
+		return fmt.Errorf("must be at least %d characters", minSecretLength)
+	}
+	return nil
+}
+
+func checkURL(raw string, schemes ...string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	for _, s := range schemes {
+		if u.Scheme == s && u.Host != "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q must be an absolute %s URL", raw, strings.Join(schemes, " or "))
+}
+
+type stringValue string
+
+func (s *stringValue) String() string { return string(*s) }
+
+func (s *stringValue) Set(v string) error {
+	*s = stringValue(v)
+	return nil
+}
+
+type intValue int
+
+func (i *intValue) String() string { return strconv.Itoa(int(*i)) }
+
+func (i *intValue) Set(v string) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return err
+	}
+	*i = intValue(n)
+	return nil
+}
+
+type boolValue bool
+
+func (b *boolValue) String() string { return strconv.FormatBool(bool(*b)) }
+
+func (b *boolValue) Set(v string) error {
+	parsed, err := strconv.ParseBool(v)
+	if err != nil {
+		return err
+	}
+	*b = boolValue(parsed)
+	return nil
+}
+
+// Lets the flag be given as -require-login without a value.
+func (b *boolValue) IsBoolFlag() bool { return true }
+
+// A list of strings given as a comma separated string in flags and environment variables.
+type StringList []string
+
+func (l *StringList) String() string { return strings.Join(*l, ",") }
+
+func (l *StringList) Set(v string) error {
+	*l = nil
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
+
+// A map of strings given as comma separated key=value pairs in flags and environment
+// variables, like "gen9ou=approval,gen9randombattle=plurality".
+type StringMap map[string]string
+
+func (m *StringMap) String() string {
+	pairs := make([]string, 0, len(*m))
+	for _, k := range sortedKeys(*m) {
+		pairs = append(pairs, k+"="+(*m)[k])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *StringMap) Set(v string) error {
+	*m = make(StringMap)
+	for _, pair := range strings.Split(v, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("%q isn't a key=value pair", pair)
+		}
+		(*m)[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// A time.Duration written as a string like "30s" in JSON, flags and environment variables.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) Set(v string) error {
+	parsed, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	return d.Set(s)
+}
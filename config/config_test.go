@@ -0,0 +1,89 @@
+package config_test
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"surrealchemist.com/mass-showdown-backend/config"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(`{
+		"showdown": {"username": "filebot", "password": "filepass"},
+		"challenges": {"formats": ["gen9ou"]},
+		"poll": {"duration": "10s"}
+	}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MSB_USERNAME", "envbot")
+	t.Setenv("MSB_POLL_DURATION", "20s")
+	t.Setenv("MSB_AUTHORIZED_HOSTS", "a.example:80, b.example:80")
+	t.Setenv("MSB_FORMAT_TALLY", "gen9ou=approval, gen9doublesou=instant-runoff")
+
+	cfg, err := config.Load("test", []string{"-config", path, "-poll-duration", "45s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Showdown.Username != "envbot" {
+		t.Errorf("Expected env to override the file username but got '%s'", cfg.Showdown.Username)
+	}
+	if cfg.Showdown.Password != "filepass" || cfg.Challenges.Formats[0] != "gen9ou" {
+		t.Errorf("Expected file settings to be kept but got %+v", cfg)
+	}
+	if cfg.Poll.Duration.Duration != 45*time.Second {
+		t.Errorf("Expected flag to override the poll duration but got %s", cfg.Poll.Duration)
+	}
+	if len(cfg.Server.AuthorizedHosts) != 2 || cfg.Server.AuthorizedHosts[1] != "b.example:80" {
+		t.Errorf("Expected two authorized hosts but got %v", cfg.Server.AuthorizedHosts)
+	}
+	if s := cfg.Poll.FormatStrategies; len(s) != 2 || s["gen9doublesou"] != config.TallyInstantRunoff {
+		t.Errorf("Expected two format strategies but got %v", s)
+	}
+	if cfg.Server.ListenAddr != ":8080" {
+		t.Errorf("Expected default listen address but got '%s'", cfg.Server.ListenAddr)
+	}
+}
+
+func TestLoadNeedsSecretToLogIn(t *testing.T) {
+	t.Setenv("MSB_USERNAME", "bot")
+	t.Setenv("MSB_PASSWORD", "pass")
+	for secret, want := range map[string]string{
+		"":                       "is required",
+		"set MSB_SESSION_SECRET": "placeholder",
+		"hunter2":                "at least 32",
+	} {
+		_, err := config.Load("test", []string{"-login-provider", "standin", "-session-secret", secret})
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected secret %q to be rejected for being %s but got %v", secret, want, err)
+		}
+	}
+	_, err := config.Load("test", []string{"-login-provider", "standin", "-session-secret", strings.Repeat("k", 32)})
+	if err != nil {
+		t.Errorf("Expected a long secret to be accepted but got %v", err)
+	}
+}
+
+func TestLoadHelp(t *testing.T) {
+	if _, err := config.Load("test", []string{"-h"}); !errors.Is(err, flag.ErrHelp) {
+		t.Errorf("Expected asking for help to return flag.ErrHelp but got %v", err)
+	}
+}
+
+func TestLoadValidates(t *testing.T) {
+	_, err := config.Load("test", []string{"-sim-url", "https://not-a-websocket", "-poll-duration", "0s", "-rated", "sometimes", "-tally", "dictator", "-format-tally", "gen9ou=monarchy"})
+	if err == nil {
+		t.Fatal("Expected an invalid configuration to be rejected")
+	}
+	for _, want := range []string{"username is required", "password is required", "sim url", "poll duration", "rated must be", "tally must be", "gen9ou: tally must be"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to mention '%s' but got: %v", want, err)
+		}
+	}
+}
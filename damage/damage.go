@@ -0,0 +1,264 @@
+// Package damage estimates how much damage moves do, using the standard damage formula and
+// dex data. It's meant to give voters a rough idea, so it only covers what
+// matters most: stats, boosts, STAB, terastallization, type matchups, weather, burns and
+// spread moves. Abilities, items and most field effects are left out.
+package damage
+
+import (
+	"fmt"
+	"math"
+
+	"surrealchemist.com/mass-showdown-backend/dex"
+)
+
+// The most hits KO chances are worked out for.
+const maxHits = 4
+
+type (
+	Pokemon struct {
+		Species string
+		// Defaults to 100.
+		Level int
+		// Stats that are known, like the ones in our own request. Missing stats are
+		// estimated from base stats.
+		Stats         map[string]int
+		Boosts        map[string]int
+		Status        string
+		TeraType      string
+		Terastallized bool
+		// Percentage of HP left. 0 is treated as full, since fainted Pokémon aren't
+		// targeted.
+		HP int
+	}
+
+	Field struct {
+		// Showdown's weather ID, e.g. "SunnyDay".
+		Weather string
+		// Spread moves do less damage when there's more than one Pokémon per side.
+		Doubles bool
+	}
+
+	// The estimated damage of a move, as percentages of the defender's max HP.
+	Result struct {
+		Min float64 `json:"min"`
+		Max float64 `json:"max"`
+		// How many hits it takes to KO the defender from its current HP, and the chance
+		// that many hits will. Hits is 0 if it takes more than 4.
+		Hits     int     `json:"hits,omitempty"`
+		KOChance float64 `json:"koChance,omitempty"`
+		// E.g. "guaranteed OHKO" or "37.5% chance to 2HKO".
+		Summary string `json:"summary"`
+	}
+)
+
+// Estimates the damage of the attacker's move against the defender. Returns nil for status
+// moves, and when the move or either species isn't in the data.
+func Estimate(d *dex.Dex, move string, attacker, defender *Pokemon, field Field) *Result {
+	m := d.Move(move)
+	atkSpecies, defSpecies := d.Species(attacker.Species), d.Species(defender.Species)
+	if m == nil || m.Category == "Status" || m.BasePower == 0 || atkSpecies == nil || defSpecies == nil {
+		return nil
+	}
+	eff := d.Effectiveness(m.Type, defender.types(defSpecies)...)
+	if eff == 0 {
+		return &Result{Summary: "no effect"}
+	}
+
+	offStat, defStat := "atk", "def"
+	if m.Category == "Special" {
+		offStat, defStat = "spa", "spd"
+	}
+	if m.OverrideOffensiveStat != "" {
+		offStat = m.OverrideOffensiveStat
+	}
+	if m.OverrideDefensiveStat != "" {
+		defStat = m.OverrideDefensiveStat
+	}
+	a := boosted(attacker.stat(atkSpecies, offStat), attacker.Boosts[offStat])
+	df := boosted(defender.stat(defSpecies, defStat), defender.Boosts[defStat])
+	level := attacker.level()
+	base := (2*level/5+2)*m.BasePower*a/df/50 + 2
+
+	if field.Doubles && (m.Target == "allAdjacent" || m.Target == "allAdjacentFoes") {
+		base = pokeRound(float64(base) * 0.75)
+	}
+	switch {
+	case m.Type == "Fire" && (field.Weather == "SunnyDay" || field.Weather == "DesolateLand"),
+		m.Type == "Water" && (field.Weather == "RainDance" || field.Weather == "PrimordialSea"):
+		base = pokeRound(float64(base) * 1.5)
+	case m.Type == "Fire" && field.Weather == "RainDance",
+		m.Type == "Water" && field.Weather == "SunnyDay":
+		base = pokeRound(float64(base) * 0.5)
+	}
+	stab := attacker.stab(atkSpecies, m.Type)
+	burned := attacker.Status == "brn" && m.Category == "Physical"
+
+	// The damage of a single hit for each of the 16 random rolls
+	rolls := make([]int, 16)
+	for i := range rolls {
+		dmg := base * (85 + i) / 100
+		dmg = pokeRound(float64(dmg) * stab)
+		dmg = int(float64(dmg) * eff)
+		if burned {
+			dmg = pokeRound(float64(dmg) * 0.5)
+		}
+		rolls[i] = max(1, dmg)
+	}
+	// The damage of a whole use of the move, over every number of hits it might make
+	fewest, most, chances := hitChances(m)
+	dist := make(map[int]float64)
+	hits := map[int]float64{0: 1}
+	for n := 1; n <= most; n++ {
+		hits = addHit(hits, rolls)
+		if c := chances[n]; c > 0 {
+			for dmg, p := range hits {
+				dist[dmg] += c * p
+			}
+		}
+	}
+
+	maxHP := defender.stat(defSpecies, "hp")
+	hp := maxHP
+	if defender.HP > 0 {
+		hp = max(1, maxHP*defender.HP/100)
+	}
+	r := &Result{
+		Min: percent(rolls[0]*fewest, maxHP),
+		Max: percent(rolls[15]*most, maxHP),
+	}
+	r.Hits, r.KOChance = koChance(dist, hp)
+	r.Summary = summarize(r.Hits, r.KOChance)
+	return r
+}
+
+func (p *Pokemon) level() int {
+	if p.Level <= 0 {
+		return 100
+	}
+	return p.Level
+}
+
+// Returns the stat if it's known, or estimates it otherwise assuming perfect IVs, an even
+// spread of EVs and a neutral nature, like random battle sets.
+func (p *Pokemon) stat(s *dex.Species, stat string) int {
+	if v, ok := p.Stats[stat]; ok && v > 0 {
+		return v
+	}
+	level := p.level()
+	v := (2*s.BaseStats[stat] + 31 + 84/4) * level / 100
+	if stat == "hp" {
+		return v + level + 10
+	}
+	return v + 5
+}
+
+func (p *Pokemon) types(s *dex.Species) []string {
+	if p.Terastallized && p.TeraType != "" && p.TeraType != "Stellar" {
+		return []string{p.TeraType}
+	}
+	return s.Types
+}
+
+// The same type attack bonus, which terastallizing into a type the Pokémon already had
+// makes stronger.
+func (p *Pokemon) stab(s *dex.Species, moveType string) float64 {
+	original := false
+	for _, t := range s.Types {
+		original = original || t == moveType
+	}
+	tera := p.Terastallized && p.TeraType == moveType
+	switch {
+	case tera && original:
+		return 2
+	case tera, original:
+		return 1.5
+	}
+	return 1
+}
+
+// Returns the fewest and most times the move can hit, and the chance of each number of
+// hits. Moves that hit 2 to 5 times hit 2 or 3 times 35% of the time each and 4 or 5 times
+// 15% each, and other ranges are even.
+func hitChances(m *dex.Move) (int, int, map[int]float64) {
+	if m.MultiHit == nil || m.MultiHit.Max < 1 {
+		return 1, 1, map[int]float64{1: 1}
+	}
+	lo, hi := max(1, m.MultiHit.Min), max(1, m.MultiHit.Min, m.MultiHit.Max)
+	if lo == 2 && hi == 5 {
+		return lo, hi, map[int]float64{2: 0.35, 3: 0.35, 4: 0.15, 5: 0.15}
+	}
+	chances := make(map[int]float64, hi-lo+1)
+	for n := lo; n <= hi; n++ {
+		chances[n] = 1 / float64(hi-lo+1)
+	}
+	return lo, hi, chances
+}
+
+func boosted(stat, stage int) int {
+	stage = max(-6, min(6, stage))
+	if stage >= 0 {
+		return stat * (2 + stage) / 2
+	}
+	return stat * 2 / (2 - stage)
+}
+
+// Rounds the way the games do, with halves rounded down.
+func pokeRound(x float64) int {
+	if x-math.Floor(x) > 0.5 {
+		return int(math.Ceil(x))
+	}
+	return int(math.Floor(x))
+}
+
+// Adds another hit to the distribution of total damage, with each roll equally likely.
+func addHit(dist map[int]float64, rolls []int) map[int]float64 {
+	next := make(map[int]float64, len(dist)*len(rolls))
+	for total, p := range dist {
+		for _, r := range rolls {
+			next[total+r] += p / float64(len(rolls))
+		}
+	}
+	return next
+}
+
+// Returns the fewest hits that could KO from the HP left and how likely that many are to.
+func koChance(dist map[int]float64, hp int) (int, float64) {
+	total := map[int]float64{0: 1}
+	for n := 1; n <= maxHits; n++ {
+		next := make(map[int]float64, len(total)*len(dist))
+		for a, pa := range total {
+			for b, pb := range dist {
+				next[a+b] += pa * pb
+			}
+		}
+		total = next
+		chance := 0.0
+		for dmg, p := range total {
+			if dmg >= hp {
+				chance += p
+			}
+		}
+		if chance > 0 {
+			return n, chance
+		}
+	}
+	return 0, 0
+}
+
+func summarize(hits int, chance float64) string {
+	if hits == 0 {
+		return fmt.Sprintf("possible %dHKO or worse", maxHits+1)
+	}
+	ko := fmt.Sprintf("%dHKO", hits)
+	if hits == 1 {
+		ko = "OHKO"
+	}
+	if chance >= 1-1e-9 {
+		return "guaranteed " + ko
+	}
+	return fmt.Sprintf("%.1f%% chance to %s", chance*100, ko)
+}
+
+func percent(dmg, maxHP int) float64 {
+	return math.Round(float64(dmg)*1000/float64(maxHP)) / 10
+}
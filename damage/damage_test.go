@@ -0,0 +1,89 @@
+package damage_test
+
+import (
+	"testing"
+
+	"surrealchemist.com/mass-showdown-backend/damage"
+	"surrealchemist.com/mass-showdown-backend/dex"
+)
+
+func TestEstimate(t *testing.T) {
+	d, err := dex.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	garchomp := &damage.Pokemon{Species: "Garchomp"}
+	blissey := &damage.Pokemon{Species: "Blissey"}
+	r := damage.Estimate(d, "Earthquake", garchomp, blissey, damage.Field{})
+	if r == nil || r.Min != 65.6 || r.Max != 77.4 || r.Summary != "guaranteed 2HKO" {
+		t.Errorf("Expected Earthquake to do 65.6-77.4%% for a guaranteed 2HKO but got %+v", r)
+	}
+
+	// Worn down, Blissey might not survive the first hit
+	blissey.HP = 70
+	if r := damage.Estimate(d, "Earthquake", garchomp, blissey, damage.Field{}); r.Hits != 1 || r.KOChance <= 0 || r.KOChance >= 1 {
+		t.Errorf("Expected a possible OHKO on Blissey at 70%% but got %+v", r)
+	}
+
+	pikachu := &damage.Pokemon{Species: "Pikachu", Level: 59}
+	groudon := &damage.Pokemon{Species: "Groudon", Level: 60}
+	if r := damage.Estimate(d, "Thunderbolt", pikachu, groudon, damage.Field{}); r == nil || r.Max != 0 || r.Summary != "no effect" {
+		t.Errorf("Expected Thunderbolt not to affect Groudon but got %+v", r)
+	}
+	if r := damage.Estimate(d, "Thunder Wave", pikachu, groudon, damage.Field{}); r != nil {
+		t.Errorf("Expected no estimate for a status move but got %+v", r)
+	}
+
+	spread := damage.Estimate(d, "Precipice Blades", groudon, pikachu, damage.Field{Doubles: true})
+	single := damage.Estimate(d, "Precipice Blades", groudon, pikachu, damage.Field{})
+	if spread.Max >= single.Max {
+		t.Errorf("Expected spread moves to do less in doubles but got %g%% and %g%%", spread.Max, single.Max)
+	}
+
+	charizard := &damage.Pokemon{Species: "Charizard"}
+	neutral := damage.Estimate(d, "Flamethrower", charizard, garchomp, damage.Field{})
+	sun := damage.Estimate(d, "Flamethrower", charizard, garchomp, damage.Field{Weather: "SunnyDay"})
+	rain := damage.Estimate(d, "Flamethrower", charizard, garchomp, damage.Field{Weather: "RainDance"})
+	if !(rain.Max < neutral.Max && neutral.Max < sun.Max) {
+		t.Errorf("Expected rain to weaken and sun to strengthen fire moves but got %g%%, %g%% and %g%%", rain.Max, neutral.Max, sun.Max)
+	}
+
+	// Terastallizing into one of its own types makes STAB stronger, and the defender's
+	// tera type replaces its weaknesses
+	tera := &damage.Pokemon{Species: "Charizard", TeraType: "Fire", Terastallized: true}
+	if r := damage.Estimate(d, "Flamethrower", tera, garchomp, damage.Field{}); r.Max <= neutral.Max {
+		t.Errorf("Expected tera fire to boost Flamethrower but got %g%%", r.Max)
+	}
+	steel := &damage.Pokemon{Species: "Garchomp", TeraType: "Steel", Terastallized: true}
+	if r := damage.Estimate(d, "Flamethrower", charizard, steel, damage.Field{}); r.Max <= 2*neutral.Max {
+		t.Errorf("Expected Flamethrower to be super effective on tera steel but got %g%%", r.Max)
+	}
+
+	// Burns halve physical damage, and boosts count
+	burned := &damage.Pokemon{Species: "Garchomp", Status: "brn"}
+	boosted := &damage.Pokemon{Species: "Garchomp", Boosts: map[string]int{"atk": 2}}
+	if r := damage.Estimate(d, "Earthquake", burned, &damage.Pokemon{Species: "Blissey"}, damage.Field{}); r.Max > 39 {
+		t.Errorf("Expected a burned Garchomp to do about half but got %g%%", r.Max)
+	}
+	if r := damage.Estimate(d, "Earthquake", boosted, &damage.Pokemon{Species: "Blissey"}, damage.Field{}); r.Summary != "guaranteed OHKO" {
+		t.Errorf("Expected +2 Earthquake to OHKO Blissey but got %+v", r)
+	}
+}
+
+func TestEstimateMultiHit(t *testing.T) {
+	d, err := dex.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blissey := &damage.Pokemon{Species: "Blissey"}
+	rillaboom := &damage.Pokemon{Species: "Rillaboom"}
+	seed := damage.Estimate(d, "Bullet Seed", rillaboom, blissey, damage.Field{})
+	if seed == nil || seed.Max < 2*seed.Min {
+		t.Errorf("Expected Bullet Seed's range to cover 2 to 5 hits but got %+v", seed)
+	}
+	dragapult := &damage.Pokemon{Species: "Dragapult"}
+	darts := damage.Estimate(d, "Dragon Darts", dragapult, &damage.Pokemon{Species: "Garchomp"}, damage.Field{})
+	if darts == nil || darts.Max > 2*darts.Min {
+		t.Errorf("Expected Dragon Darts to always hit twice but got %+v", darts)
+	}
+}
@@ -0,0 +1,38 @@
+package dex
+
+import (
+	"strconv"
+	"strings"
+)
+
+// What a details string like "Pikachu, L59, F, shiny" says about a Pokémon.
+type Details struct {
+	Species string `json:"species"`
+	// Details leave the level out at 100.
+	Level int `json:"level"`
+	// "M", "F", or "" for genderless Pokémon.
+	Gender string `json:"gender,omitempty"`
+	Shiny  bool   `json:"shiny,omitempty"`
+	// Only given once the Pokémon has terastallized.
+	TeraType string `json:"teraType,omitempty"`
+}
+
+func ParseDetails(details string) Details {
+	parts := strings.Split(details, ", ")
+	d := Details{Species: parts[0], Level: 100}
+	for _, part := range parts[1:] {
+		switch {
+		case part == "M" || part == "F":
+			d.Gender = part
+		case part == "shiny":
+			d.Shiny = true
+		case strings.HasPrefix(part, "tera:"):
+			d.TeraType = strings.TrimPrefix(part, "tera:")
+		case strings.HasPrefix(part, "L"):
+			if n, err := strconv.Atoi(part[1:]); err == nil {
+				d.Level = n
+			}
+		}
+	}
+	return d
+}
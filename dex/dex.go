@@ -0,0 +1,172 @@
+// Package dex looks up Pokémon, moves, abilities, items and types from data bundled with
+// the server, in the same JSON shape as Pokémon Showdown's data files.
+package dex
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"surrealchemist.com/mass-showdown-backend/messages"
+)
+
+// Downloads the whole Pokédex from Showdown, and the random battle sets it's tested against.
+//go:generate go run ../cmd/dexgen -out data
+
+//go:embed data/*.json
+var files embed.FS
+
+type (
+	Dex struct {
+		species   map[string]*Species
+		moves     map[string]*Move
+		abilities map[string]*Effect
+		items     map[string]*Effect
+		// How much damage each defending type takes from each attacking type, using
+		// Showdown's codes: 0 normal, 1 weak, 2 resists, 3 immune.
+		types map[string]map[string]int
+	}
+
+	Species struct {
+		Num         int               `json:"num"`
+		Name        string            `json:"name"`
+		BaseSpecies string            `json:"baseSpecies,omitempty"`
+		Forme       string            `json:"forme,omitempty"`
+		Types       []string          `json:"types"`
+		BaseStats   map[string]int    `json:"baseStats"`
+		Abilities   map[string]string `json:"abilities"`
+		WeightKG    float64           `json:"weightkg"`
+	}
+
+	Move struct {
+		Num  int    `json:"num"`
+		Name string `json:"name"`
+		Type string `json:"type"`
+		// "Physical", "Special" or "Status".
+		Category  string `json:"category"`
+		BasePower int    `json:"basePower"`
+		// A number, or true for moves that never miss.
+		Accuracy json.RawMessage `json:"accuracy"`
+		PP       int             `json:"pp"`
+		Priority int             `json:"priority"`
+		Target   string          `json:"target"`
+		// How many times the move hits, if more than once.
+		MultiHit *MultiHit `json:"multihit,omitempty"`
+		// Stats used instead of the usual ones, like Body Press attacking with Defense.
+		OverrideOffensiveStat string `json:"overrideOffensiveStat,omitempty"`
+		OverrideDefensiveStat string `json:"overrideDefensiveStat,omitempty"`
+		ShortDesc             string `json:"shortDesc"`
+	}
+
+	// An ability or item.
+	Effect struct {
+		Num       int    `json:"num"`
+		Name      string `json:"name"`
+		ShortDesc string `json:"shortDesc"`
+	}
+)
+
+// How many times a multi-hit move hits. Showdown gives a number for moves that always hit
+// the same number of times, like Dragon Darts, or a range like [2, 5] for Bullet Seed.
+type MultiHit struct {
+	Min, Max int
+}
+
+func (m *MultiHit) UnmarshalJSON(b []byte) error {
+	var n int
+	if err := json.Unmarshal(b, &n); err == nil {
+		m.Min, m.Max = n, n
+		return nil
+	}
+	var r []int
+	if err := json.Unmarshal(b, &r); err != nil || len(r) != 2 {
+		return fmt.Errorf("multihit must be a number or a [min, max] pair, not %s", b)
+	}
+	m.Min, m.Max = r[0], r[1]
+	return nil
+}
+
+// Marshals back to the same shape Showdown uses.
+func (m MultiHit) MarshalJSON() ([]byte, error) {
+	if m.Min == m.Max {
+		return json.Marshal(m.Min)
+	}
+	return json.Marshal([]int{m.Min, m.Max})
+}
+
+// Loads the bundled data.
+func Load() (*Dex, error) {
+	d := &Dex{}
+	if err := decode("data/pokedex.json", &d.species); err != nil {
+		return nil, err
+	}
+	if err := decode("data/moves.json", &d.moves); err != nil {
+		return nil, err
+	}
+	if err := decode("data/abilities.json", &d.abilities); err != nil {
+		return nil, err
+	}
+	if err := decode("data/items.json", &d.items); err != nil {
+		return nil, err
+	}
+	var chart map[string]struct {
+		DamageTaken map[string]int `json:"damageTaken"`
+	}
+	if err := decode("data/typechart.json", &chart); err != nil {
+		return nil, err
+	}
+	d.types = make(map[string]map[string]int, len(chart))
+	for t, c := range chart {
+		d.types[t] = c.DamageTaken
+	}
+	return d, nil
+}
+
+func decode(name string, v any) error {
+	b, err := files.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("decoding %s: %w", name, err)
+	}
+	return nil
+}
+
+// Looks up a species by name or ID. Returns nil if it isn't in the data.
+func (d *Dex) Species(name string) *Species {
+	return d.species[messages.ToID(name)]
+}
+
+// Looks up a move by name or ID. Returns nil if it isn't in the data.
+func (d *Dex) Move(name string) *Move {
+	return d.moves[messages.ToID(name)]
+}
+
+// Looks up an ability by name or ID. Returns nil if it isn't in the data.
+func (d *Dex) Ability(name string) *Effect {
+	return d.abilities[messages.ToID(name)]
+}
+
+// Looks up an item by name or ID. Returns nil if it isn't in the data.
+func (d *Dex) Item(name string) *Effect {
+	return d.items[messages.ToID(name)]
+}
+
+// How effective an attacking type is against the defending types, e.g. 4 for Ice against
+// Garchomp or 0 for Electric against Groudon. Unknown types are hit neutrally.
+func (d *Dex) Effectiveness(attack string, defending ...string) float64 {
+	mult := 1.0
+	for _, t := range defending {
+		switch d.types[strings.ToLower(t)][attack] {
+		case 1:
+			mult *= 2
+		case 2:
+			mult /= 2
+		case 3:
+			return 0
+		}
+	}
+	return mult
+}
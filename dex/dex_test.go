@@ -0,0 +1,117 @@
+package dex_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+
+	"surrealchemist.com/mass-showdown-backend/dex"
+)
+
+func TestLookups(t *testing.T) {
+	d, err := dex.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := d.Species("Rotom-Wash"); s == nil || s.BaseSpecies != "Rotom" || s.Types[1] != "Water" {
+		t.Errorf("Expected to find Rotom-Wash by name but got %+v", s)
+	}
+	if m := d.Move("bodypress"); m == nil || m.Name != "Body Press" || m.OverrideOffensiveStat != "def" {
+		t.Errorf("Expected Body Press to attack with Defense but got %+v", m)
+	}
+	if a, i := d.Ability("Drought"), d.Item("heavydutyboots"); a == nil || i == nil || i.Name != "Heavy-Duty Boots" || a.ShortDesc == "" {
+		t.Errorf("Expected to find Drought and Heavy-Duty Boots but got %+v and %+v", a, i)
+	}
+	if m := d.Move("Bullet Seed"); m == nil || m.MultiHit == nil || *m.MultiHit != (dex.MultiHit{Min: 2, Max: 5}) {
+		t.Errorf("Expected Bullet Seed to hit 2 to 5 times but got %+v", m)
+	}
+	if m := d.Move("Dragon Darts"); m == nil || m.MultiHit == nil || *m.MultiHit != (dex.MultiHit{Min: 2, Max: 2}) {
+		t.Errorf("Expected Dragon Darts to hit twice but got %+v", m)
+	}
+	if d.Species("Missingno") != nil {
+		t.Error("Expected no data for a species that isn't bundled")
+	}
+	cases := []struct {
+		attack    string
+		defending []string
+		want      float64
+	}{
+		{"Ice", []string{"Dragon", "Ground"}, 4},
+		{"Electric", []string{"Ground"}, 0},
+		{"Fire", []string{"Water", "Dragon"}, 0.25},
+		{"Fighting", []string{"Normal", "Ghost"}, 0},
+		{"Water", []string{"Fire", "Steel"}, 2},
+		{"Normal", []string{"Normal"}, 1},
+	}
+	for _, c := range cases {
+		if got := d.Effectiveness(c.attack, c.defending...); got != c.want {
+			t.Errorf("Expected %s against %v to be %gx but got %gx", c.attack, c.defending, c.want, got)
+		}
+	}
+}
+
+// Random battle sets, as go generate downloads them.
+type randomSets map[string]struct {
+	Abilities []string `json:"abilities"`
+	Items     []string `json:"items"`
+	Roles     map[string]struct {
+		Moves []string `json:"moves"`
+	} `json:"roles"`
+}
+
+func TestCoversRandomBattles(t *testing.T) {
+	b, err := os.ReadFile("testdata/gen9randombattle.json")
+	if errors.Is(err, fs.ErrNotExist) {
+		t.Skip("no random battle sets; run go generate ./dex to download them with the full data")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sets randomSets
+	if err := json.Unmarshal(b, &sets); err != nil {
+		t.Fatal(err)
+	}
+	d, err := dex.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for species, set := range sets {
+		if d.Species(species) == nil {
+			t.Errorf("Expected %s to be in the dex", species)
+		}
+		for _, a := range set.Abilities {
+			if d.Ability(a) == nil {
+				t.Errorf("Expected %s's ability %s to be in the dex", species, a)
+			}
+		}
+		for _, i := range set.Items {
+			if d.Item(i) == nil {
+				t.Errorf("Expected %s's item %s to be in the dex", species, i)
+			}
+		}
+		for role, r := range set.Roles {
+			for _, m := range r.Moves {
+				if d.Move(m) == nil {
+					t.Errorf("Expected %s's %s move %s to be in the dex", species, role, m)
+				}
+			}
+		}
+	}
+}
+
+func TestParseDetails(t *testing.T) {
+	cases := map[string]dex.Details{
+		"Pikachu, L59, F":                {Species: "Pikachu", Level: 59, Gender: "F"},
+		"Groudon":                        {Species: "Groudon", Level: 100},
+		"Rotom-Wash, L84, shiny":         {Species: "Rotom-Wash", Level: 84, Shiny: true},
+		"Feebas, L1, M, tera:Water":      {Species: "Feebas", Level: 1, Gender: "M", TeraType: "Water"},
+		"Great Tusk, shiny, tera:Ground": {Species: "Great Tusk", Level: 100, Shiny: true, TeraType: "Ground"},
+	}
+	for details, want := range cases {
+		if got := dex.ParseDetails(details); got != want {
+			t.Errorf("Expected %q to parse as %+v but got %+v", details, want, got)
+		}
+	}
+}
@@ -3,8 +3,9 @@ module surrealchemist.com/mass-showdown-backend
 go 1.22.2
 
 require (
-	github.com/gorilla/websocket v1.5.3 // indirect
-	github.com/segmentio/ksuid v1.0.4 // indirect
-	go.uber.org/multierr v1.10.0 // indirect
-	go.uber.org/zap v1.27.0 // indirect
+	github.com/gorilla/websocket v1.5.3
+	github.com/segmentio/ksuid v1.0.4
+	go.uber.org/zap v1.27.0
 )
+
+require go.uber.org/multierr v1.10.0 // indirect
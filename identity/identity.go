@@ -0,0 +1,108 @@
+// Package identity gives voters an identity that lasts across page reloads and reconnects,
+// so each person gets one vote per poll. Identities are kept in signed session tokens,
+// either anonymous ones handed out on first visit or ones from logging in with a provider.
+package identity
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"surrealchemist.com/mass-showdown-backend/messages"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid session token")
+	ErrExpiredToken = errors.New("session token has expired")
+)
+
+// Who a voter is.
+type Session struct {
+	// Identifies the voter, like "anon:2bE5..." or "showdown:hosergang".
+	VoterID string `json:"id"`
+	// The name the voter logged in with, or empty for anonymous voters.
+	Name    string    `json:"name,omitempty"`
+	Expires time.Time `json:"exp"`
+}
+
+// Whether the voter logged in rather than being handed an anonymous identity.
+func (s *Session) LoggedIn() bool {
+	return s.Name != ""
+}
+
+// Issues and verifies session tokens, signed with HMAC-SHA256.
+type Signer struct {
+	key []byte
+	ttl time.Duration
+}
+
+// Creates a signer. Sessions it issues last for ttl. If key is empty, a random one is
+// used, so sessions only last until the process restarts.
+func NewSigner(key []byte, ttl time.Duration) *Signer {
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return &Signer{key: key, ttl: ttl}
+}
+
+// Issues a session for a voter who didn't log in.
+func (s *Signer) Anonymous() *Session {
+	return &Session{
+		VoterID: "anon:" + ksuid.New().String(),
+		Expires: time.Now().Add(s.ttl),
+	}
+}
+
+// Issues a session for a voter who logged in with a provider.
+func (s *Signer) LoggedIn(provider, name string) *Session {
+	return &Session{
+		VoterID: provider + ":" + messages.ToID(name),
+		Name:    name,
+		Expires: time.Now().Add(s.ttl),
+	}
+}
+
+// Returns the token for a session.
+func (s *Signer) Token(sess *Session) string {
+	payload, _ := json.Marshal(sess)
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(s.sign(payload))
+}
+
+// Returns the session a token is for, if it was signed by this signer and hasn't expired.
+func (s *Signer) Verify(token string) (*Session, error) {
+	enc := base64.RawURLEncoding
+	p, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	payload, err := enc.DecodeString(p)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	mac, err := enc.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, s.sign(payload)) {
+		return nil, ErrInvalidToken
+	}
+	sess := &Session{}
+	if err := json.Unmarshal(payload, sess); err != nil || sess.VoterID == "" {
+		return nil, ErrInvalidToken
+	}
+	if time.Now().After(sess.Expires) {
+		return nil, ErrExpiredToken
+	}
+	return sess, nil
+}
+
+func (s *Signer) sign(payload []byte) []byte {
+	h := hmac.New(sha256.New, s.key)
+	h.Write(payload)
+	return h.Sum(nil)
+}
@@ -0,0 +1,58 @@
+package identity_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"surrealchemist.com/mass-showdown-backend/identity"
+)
+
+func TestSessionTokens(t *testing.T) {
+	s := identity.NewSigner([]byte("secret"), time.Hour)
+	sess := s.LoggedIn("showdown", "Hoser Gang")
+	got, err := s.Verify(s.Token(sess))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.VoterID != "showdown:hosergang" || !got.LoggedIn() {
+		t.Errorf("Expected the session to survive a round trip but got %+v", got)
+	}
+
+	token := s.Token(s.Anonymous())
+	other := identity.NewSigner([]byte("other secret"), time.Hour)
+	if _, err := other.Verify(token); err != identity.ErrInvalidToken {
+		t.Errorf("Expected a token from another signer to be rejected but got %v", err)
+	}
+	if _, err := s.Verify("x" + token); err != identity.ErrInvalidToken {
+		t.Errorf("Expected a tampered token to be rejected but got %v", err)
+	}
+	expired := identity.NewSigner([]byte("secret"), -time.Second)
+	if _, err := s.Verify(expired.Token(expired.Anonymous())); err != identity.ErrExpiredToken {
+		t.Errorf("Expected an expired token to be rejected but got %v", err)
+	}
+}
+
+func TestStandInOnlyCallsBackHere(t *testing.T) {
+	var p identity.StandInProvider
+	serve := func(callback string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "http://vote.example/auth/standin?"+
+			url.Values{"callback": {callback}, "state": {"abc"}}.Encode(), nil)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w
+	}
+	for _, callback := range []string{"http://vote.example/auth/callback", "/auth/callback"} {
+		if w := serve(callback); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `action="/auth/callback"`) {
+			t.Errorf("Expected %s to be accepted but got %d: %s", callback, w.Code, w.Body)
+		}
+	}
+	for _, callback := range []string{"https://evil.example/auth/callback", "/elsewhere", "//evil.example/auth/callback"} {
+		if w := serve(callback); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be refused but got %d", callback, w.Code)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package identity
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+
+	"surrealchemist.com/mass-showdown-backend/messages"
+)
+
+// Where providers send voters back to once they've logged in.
+const CallbackPath = "/auth/callback"
+
+// Somewhere voters log in through an OAuth style redirect: voters are sent to AuthURL,
+// which sends them back to the callback with a code that Exchange turns into a username.
+type Provider interface {
+	// The name voter IDs are prefixed with, like "twitch".
+	Name() string
+	// Where to send a voter to log in. state must be passed back to the callback.
+	AuthURL(callback, state string) string
+	// Returns the username a code from the callback is for.
+	Exchange(code string) (string, error)
+}
+
+// A provider that stands in for a real one during development and tests. Voters are asked
+// for a name, and whatever they give is trusted.
+type StandInProvider struct{}
+
+func (StandInProvider) Name() string { return "standin" }
+
+func (StandInProvider) AuthURL(callback, state string) string {
+	return "/auth/standin?" + url.Values{"callback": {callback}, "state": {state}}.Encode()
+}
+
+func (StandInProvider) Exchange(code string) (string, error) {
+	if messages.ToID(code) == "" {
+		return "", errors.New("a name with letters or digits is required")
+	}
+	return code, nil
+}
+
+// The stand-in's login page, which must be served at /auth/standin. It asks for a name and
+// sends it to the callback as the code. Only this server's callback is accepted, so the
+// page can't be used to send voters anywhere else.
+func (StandInProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	callback, err := url.Parse(q.Get("callback"))
+	if err != nil || callback.Path != CallbackPath || (callback.Host != "" && callback.Host != r.Host) {
+		http.Error(w, "the callback must be this server's "+CallbackPath, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	standInPage.Execute(w, map[string]string{
+		"Callback": CallbackPath,
+		"State":    q.Get("state"),
+	})
+}
+
+var standInPage = template.Must(template.New("standin").Parse(`<!doctype html>
+<title>Log in</title>
+<form method="get" action="{{.Callback}}">
+  <input type="hidden" name="state" value="{{.State}}">
+  <label>Username <input name="code" autofocus></label>
+  <button>Log in</button>
+</form>
+`))
@@ -0,0 +1,291 @@
+// Package loadtest simulates a crowd of voters against a running poll server, to see how
+// it holds up before going live on a big stream. Each simulated voter has its own
+// websocket and anonymous identity, and votes at random in every poll it's shown.
+package loadtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The version of the poll server's protocol voters speak.
+const protocolVersion = 1
+
+type Config struct {
+	// The poll server's websocket URL, e.g. ws://localhost:8080/ws.
+	URL string
+	// How many voters to connect.
+	Voters int
+	// How long voters stay connected.
+	Duration time.Duration
+	// How often voters change their vote while a poll is open, or 0 to vote once per poll.
+	VoteEvery time.Duration
+	// Seeds the random choices, so runs can be repeated.
+	Seed int64
+}
+
+// What happened to the voters during a run.
+type Report struct {
+	Connected int
+	// Voters that couldn't connect, with the first error seen.
+	Failed   int
+	FirstErr error
+	// Voters the server disconnected for falling behind.
+	Evicted  int
+	Votes    int
+	Accepted int
+	Rejected int
+	// Polls and results received over all voters, counting results sent in full or as changes.
+	Polls   int
+	Results int
+	// How long each accepted vote took to be acknowledged.
+	Latencies []time.Duration
+}
+
+// Returns the latency that the fraction q of votes were acknowledged within.
+func (r *Report) Percentile(q float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), r.Latencies...)
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a] < sorted[b] })
+	return sorted[min(len(sorted)-1, int(q*float64(len(sorted))))]
+}
+
+func (r *Report) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "voters: %d connected, %d failed, %d evicted\n", r.Connected, r.Failed, r.Evicted)
+	if r.FirstErr != nil {
+		fmt.Fprintf(&sb, "first error: %v\n", r.FirstErr)
+	}
+	fmt.Fprintf(&sb, "votes: %d sent, %d accepted, %d rejected\n", r.Votes, r.Accepted, r.Rejected)
+	fmt.Fprintf(&sb, "received: %d polls, %d results\n", r.Polls, r.Results)
+	fmt.Fprintf(&sb, "vote latency: p50 %v, p95 %v, p99 %v\n",
+		r.Percentile(0.5), r.Percentile(0.95), r.Percentile(0.99))
+	return sb.String()
+}
+
+func (r *Report) add(o *Report) {
+	r.Connected += o.Connected
+	r.Failed += o.Failed
+	if r.FirstErr == nil {
+		r.FirstErr = o.FirstErr
+	}
+	r.Evicted += o.Evicted
+	r.Votes += o.Votes
+	r.Accepted += o.Accepted
+	r.Rejected += o.Rejected
+	r.Polls += o.Polls
+	r.Results += o.Results
+	r.Latencies = append(r.Latencies, o.Latencies...)
+}
+
+// Connects the voters and has them vote until the duration is up or ctx is done.
+func Run(ctx context.Context, cfg Config) (*Report, error) {
+	if cfg.Voters <= 0 || cfg.Duration <= 0 {
+		return nil, fmt.Errorf("need a positive number of voters and duration")
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+	total := &Report{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Voters; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := runVoter(ctx, cfg, rand.New(rand.NewSource(seed)))
+			mu.Lock()
+			total.add(r)
+			mu.Unlock()
+		}(cfg.Seed + int64(i))
+	}
+	wg.Wait()
+	return total, nil
+}
+
+// The parts of the server's messages voters look at.
+type serverMessage struct {
+	Type    string          `json:"type"`
+	Content json.RawMessage `json:"content"`
+}
+
+type update struct {
+	Results bool    `json:"results"`
+	Update  request `json:"update"`
+}
+
+type request struct {
+	ForceSwitch []bool `json:"forceSwitch"`
+	Active      []struct {
+		Moves []struct {
+			Disabled bool `json:"disabled"`
+		} `json:"moves"`
+	} `json:"active"`
+	Side struct {
+		Pokemon []struct {
+			Active    bool   `json:"active"`
+			Condition string `json:"condition"`
+		} `json:"pokemon"`
+	} `json:"side"`
+	TeamPreview bool `json:"teamPreview"`
+}
+
+type displayText struct {
+	Err bool `json:"err"`
+}
+
+// Runs a single voter until ctx is done.
+func runVoter(ctx context.Context, cfg Config, rng *rand.Rand) *Report {
+	r := &Report{}
+	dialer := &websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	ws, _, err := dialer.DialContext(ctx, cfg.URL, nil)
+	if err != nil {
+		r.Failed, r.FirstErr = 1, err
+		return r
+	}
+	defer ws.Close()
+	hello := map[string]interface{}{"type": "HELLO", "content": map[string]interface{}{"versions": []int{protocolVersion}}}
+	if err := ws.WriteJSON(hello); err != nil {
+		r.Failed, r.FirstErr = 1, err
+		return r
+	}
+	r.Connected = 1
+
+	msgs := make(chan serverMessage)
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			var m serverMessage
+			if err := ws.ReadJSON(&m); err != nil {
+				closed <- err
+				return
+			}
+			select {
+			case msgs <- m:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var revote <-chan time.Time
+	if cfg.VoteEvery > 0 {
+		ticker := time.NewTicker(cfg.VoteEvery)
+		defer ticker.Stop()
+		revote = ticker.C
+	}
+	// The poll being voted in, and when each unacknowledged vote was sent
+	var current *request
+	var sent []time.Time
+	vote := func() {
+		if current == nil {
+			return
+		}
+		content := choose(current, rng)
+		if content == nil {
+			return
+		}
+		if err := ws.WriteJSON(map[string]interface{}{"type": "VOTE", "content": content}); err != nil {
+			return
+		}
+		r.Votes++
+		sent = append(sent, time.Now())
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return r
+		case err := <-closed:
+			if websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+				r.Evicted = 1
+			}
+			return r
+		case <-revote:
+			vote()
+		case m := <-msgs:
+			switch m.Type {
+			case "UPDATE_RESP":
+				var u update
+				if json.Unmarshal(m.Content, &u) != nil {
+					break
+				}
+				if u.Results {
+					r.Results++
+					break
+				}
+				r.Polls++
+				current = &u.Update
+				vote()
+			case "RESULTS_DELTA":
+				r.Results++
+			case "VOTE_OK":
+				r.Accepted++
+				if len(sent) > 0 {
+					r.Latencies = append(r.Latencies, time.Since(sent[0]))
+					sent = sent[1:]
+				}
+			case "ERROR":
+				// The server couldn't make sense of a vote
+				r.Rejected++
+				if len(sent) > 0 {
+					sent = sent[1:]
+				}
+			case "DISPLAY_TEXT":
+				var d displayText
+				if json.Unmarshal(m.Content, &d) == nil && d.Err {
+					r.Rejected++
+					if len(sent) > 0 {
+						sent = sent[1:]
+					}
+				} else {
+					// Between polls
+					current = nil
+				}
+			}
+		}
+	}
+}
+
+// Picks a random valid vote in the request, or nil if there's nothing to choose.
+func choose(req *request, rng *rand.Rand) map[string]interface{} {
+	var switches []int
+	for i, p := range req.Side.Pokemon {
+		if !p.Active && !strings.HasSuffix(p.Condition, " fnt") {
+			switches = append(switches, i)
+		}
+	}
+	if req.TeamPreview {
+		if len(req.Side.Pokemon) == 0 {
+			return nil
+		}
+		return map[string]interface{}{"type": "team", "order": []int{rng.Intn(len(req.Side.Pokemon))}, "tera": false}
+	}
+	for slot, forced := range req.ForceSwitch {
+		if forced && len(switches) > 0 {
+			return map[string]interface{}{"type": "switch", "slot": slot, "idx": switches[rng.Intn(len(switches))], "tera": false}
+		}
+	}
+	if len(req.Active) == 0 {
+		return nil
+	}
+	var moves []int
+	for i, m := range req.Active[0].Moves {
+		if !m.Disabled {
+			moves = append(moves, i)
+		}
+	}
+	if len(moves) == 0 {
+		return nil
+	}
+	return map[string]interface{}{"type": "move", "slot": 0, "idx": moves[rng.Intn(len(moves))], "tera": rng.Intn(2) == 0}
+}
@@ -1,21 +1,68 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 
+	"surrealchemist.com/mass-showdown-backend/config"
+	"surrealchemist.com/mass-showdown-backend/dex"
+	"surrealchemist.com/mass-showdown-backend/replay"
 	"surrealchemist.com/mass-showdown-backend/service"
+	"surrealchemist.com/mass-showdown-backend/store"
 )
 
 func main() {
 	// log := zap.NewExample().Sugar().Named("main")
+	cfg, err := config.Load(os.Args[0], os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		// The usage was already printed
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid configuration:", err)
+		os.Exit(2)
+	}
 	wg := &sync.WaitGroup{}
-	psc := service.NewPSClient(wg)
-	ps := service.NewPollServer(wg)
+	psc := service.NewPSClient(wg, cfg)
+	ps := service.NewPollServer(wg, cfg)
 	psc.SetSendChan(ps.GetRecvChan())
 	ps.SetSendChan(psc.GetRecvChan())
+	ps.SetBattleTracker(psc.Battles())
+	d, err := dex.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "loading dex data:", err)
+		os.Exit(1)
+	}
+	ps.SetDex(d)
+	if cfg.Replay.Playback != "" {
+		psc.SetTransport(&service.PlaybackTransport{Path: cfg.Replay.Playback})
+	} else if cfg.Replay.Dir != "" {
+		rec := replay.NewRecorder(cfg.Replay.Dir)
+		defer rec.CloseAll()
+		psc.SetRecorder(rec)
+		ps.SetRecorder(rec)
+	}
+	if cfg.Store.Path != "" {
+		st, err := store.OpenFile(cfg.Store.Path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer st.Close()
+		ps.SetStore(st)
+	}
+	// Stopping finishes polls that have votes, sends their results and disconnects
+	// everyone before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	wg.Add(2)
-	go psc.LoginAndStart()
-	go ps.StartServer()
+	go psc.LoginAndStart(ctx)
+	go ps.StartServer(ctx)
 	wg.Wait()
 }
-
@@ -0,0 +1,758 @@
+package messages
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returned (wrapped) by DecodeEvent when a known message type is missing fields
+// or has fields that can't be parsed.
+var ErrMalformedEvent = errors.New("malformed protocol message")
+
+// An Event is a single Showdown protocol line decoded into a concrete type.
+// Use a type switch on the pointer types in this file to handle specific events.
+type Event interface {
+	// The protocol message type, e.g. "move" or "-damage".
+	Kind() string
+}
+
+// Identifies a Pokémon as it appears in the protocol, e.g. "p1a: Pikachu".
+// Position is empty when the Pokémon isn't referenced by its active slot.
+type PokemonIdent struct {
+	Side     string
+	Position string
+	Name     string
+}
+
+// Parses a Pokémon ident such as "p2a: Groudon" or "p1: Pikachu".
+func ParsePokemonIdent(s string) (PokemonIdent, error) {
+	prefix, name, ok := strings.Cut(s, ": ")
+	if !ok || len(prefix) < 2 || prefix[0] != 'p' {
+		return PokemonIdent{}, fmt.Errorf("%w: bad pokemon ident %q", ErrMalformedEvent, s)
+	}
+	id := PokemonIdent{Side: prefix, Name: name}
+	if len(prefix) > 2 {
+		id.Side = prefix[:2]
+		id.Position = prefix[2:]
+	}
+	return id, nil
+}
+
+func (id PokemonIdent) String() string {
+	if id.Side == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s%s: %s", id.Side, id.Position, id.Name)
+}
+
+// The HP and status of a Pokémon, parsed from strings like "52/100 par" or "0 fnt".
+// For opposing Pokémon MaxHP is usually 100 (or 48 with exact HP disabled).
+type Condition struct {
+	HP, MaxHP int
+	Status    string
+	Fainted   bool
+}
+
+// Parses a condition string such as "100/100", "35/212 brn" or "0 fnt".
+func ParseCondition(s string) (Condition, error) {
+	c := Condition{}
+	hp, status, _ := strings.Cut(strings.TrimSpace(s), " ")
+	if status == "fnt" {
+		c.Fainted = true
+	} else {
+		c.Status = status
+	}
+	cur, max, hasMax := strings.Cut(hp, "/")
+	var err error
+	if c.HP, err = strconv.Atoi(cur); err != nil {
+		return Condition{}, fmt.Errorf("%w: bad condition %q", ErrMalformedEvent, s)
+	}
+	if hasMax {
+		if c.MaxHP, err = strconv.Atoi(max); err != nil {
+			return Condition{}, fmt.Errorf("%w: bad condition %q", ErrMalformedEvent, s)
+		}
+	}
+	return c, nil
+}
+
+// The HP as a fraction of max HP, or 0 if the max isn't known.
+func (c Condition) Fraction() float32 {
+	if c.MaxHP == 0 {
+		return 0
+	}
+	return float32(c.HP) / float32(c.MaxHP)
+}
+
+// Optional trailing arguments on battle messages, such as "[from] item: Leftovers"
+// or "[miss]", keyed by the bracketed name. Flags without a value map to "".
+type Tags map[string]string
+
+// Splits trailing "[tag] value" arguments off of a message's data.
+func splitTags(data []string) ([]string, Tags) {
+	var tags Tags
+	i := len(data)
+	for i > 0 && strings.HasPrefix(data[i-1], "[") {
+		i--
+	}
+	for _, d := range data[i:] {
+		name, value, _ := strings.Cut(d[1:], "]")
+		if tags == nil {
+			tags = make(Tags)
+		}
+		tags[name] = strings.TrimSpace(value)
+	}
+	return data[:i], tags
+}
+
+// Reports whether the tag is present at all.
+func (t Tags) Has(name string) bool {
+	_, ok := t[name]
+	return ok
+}
+
+type (
+	// Any message that doesn't have a more specific type.
+	GenericEvent struct {
+		Type string
+		Data []string
+	}
+
+	// |challstr|CHALLSTR
+	ChallstrEvent struct {
+		Challstr string
+	}
+
+	// |pm|SENDER|RECEIVER|MESSAGE
+	// Names keep their leading rank character, which is usually a space.
+	PMEvent struct {
+		From, To, Message string
+	}
+
+	// |request|REQUEST
+	RequestEvent struct {
+		JSON string
+	}
+
+	// |updateuser|USER|NAMED|AVATAR|SETTINGS
+	// User keeps its leading rank character. Named is false for guest names.
+	UpdateUserEvent struct {
+		User  string
+		Named bool
+	}
+
+	// |noinit|REASON|MESSAGE, sent when the client can't join a room
+	NoInitEvent struct {
+		Reason, Message string
+	}
+
+	// |init|ROOMTYPE, sent when the client joins a room
+	InitEvent struct {
+		RoomType string
+	}
+
+	// |deinit, sent when the client leaves a room
+	DeinitEvent struct{}
+
+	// |error|MESSAGE
+	ErrorEvent struct {
+		Message string
+	}
+
+	// |player|PLAYER|USERNAME|AVATAR|RATING
+	PlayerEvent struct {
+		Player, Username, Avatar, Rating string
+	}
+
+	// |teamsize|PLAYER|NUMBER
+	TeamSizeEvent struct {
+		Player string
+		Size   int
+	}
+
+	// |gametype|GAMETYPE
+	GameTypeEvent struct {
+		GameType string
+	}
+
+	// |gen|GENNUM
+	GenEvent struct {
+		Gen int
+	}
+
+	// |tier|FORMATNAME
+	TierEvent struct {
+		Tier string
+	}
+
+	// |poke|PLAYER|DETAILS|ITEM
+	PokeEvent struct {
+		Player, Details, Item string
+	}
+
+	// |teampreview
+	TeamPreviewEvent struct{}
+
+	// |start
+	StartEvent struct{}
+
+	// |turn|NUMBER
+	TurnEvent struct {
+		Turn int
+	}
+
+	// |win|USER
+	WinEvent struct {
+		Winner string
+	}
+
+	// |tie
+	TieEvent struct{}
+
+	// |inactive|MESSAGE or |inactiveoff|MESSAGE
+	InactiveEvent struct {
+		Off     bool
+		Message string
+	}
+
+	// |move|POKEMON|MOVE|TARGET
+	MoveEvent struct {
+		Pokemon PokemonIdent
+		Move    string
+		// Zero if the move has no target, e.g. because it failed.
+		Target PokemonIdent
+		Tags   Tags
+	}
+
+	// |switch|POKEMON|DETAILS|HP STATUS, also used for drag and replace
+	SwitchEvent struct {
+		Type      string
+		Pokemon   PokemonIdent
+		Details   string
+		Condition Condition
+		Tags      Tags
+	}
+
+	// |detailschange|POKEMON|DETAILS|HP STATUS, also used for -formechange
+	DetailsChangeEvent struct {
+		Type      string
+		Pokemon   PokemonIdent
+		Details   string
+		Condition *Condition
+		Tags      Tags
+	}
+
+	// |-damage|POKEMON|HP STATUS, also used for -heal and -sethp
+	HealthEvent struct {
+		Type      string
+		Pokemon   PokemonIdent
+		Condition Condition
+		Tags      Tags
+	}
+
+	// |faint|POKEMON
+	FaintEvent struct {
+		Pokemon PokemonIdent
+	}
+
+	// |-status|POKEMON|STATUS or |-curestatus|POKEMON|STATUS
+	StatusEvent struct {
+		Cure    bool
+		Pokemon PokemonIdent
+		Status  string
+		Tags    Tags
+	}
+
+	// |-boost|POKEMON|STAT|AMOUNT, also used for -unboost (with a negative amount) and -setboost
+	BoostEvent struct {
+		Type    string
+		Pokemon PokemonIdent
+		Stat    string
+		Amount  int
+		Tags    Tags
+	}
+
+	// |-clearboost|POKEMON, or |-clearallboost with no Pokémon
+	ClearBoostEvent struct {
+		Pokemon PokemonIdent
+		All     bool
+		Tags    Tags
+	}
+
+	// |-weather|WEATHER
+	WeatherEvent struct {
+		// "none" when the weather ends.
+		Weather string
+		Upkeep  bool
+		Tags    Tags
+	}
+
+	// |-fieldstart|CONDITION or |-fieldend|CONDITION
+	FieldEvent struct {
+		End       bool
+		Condition string
+		Tags      Tags
+	}
+
+	// |-sidestart|SIDE|CONDITION or |-sideend|SIDE|CONDITION
+	SideConditionEvent struct {
+		End bool
+		// The side's player ID, e.g. "p1".
+		Side      string
+		Condition string
+		Tags      Tags
+	}
+
+	// |-terastallize|POKEMON|TYPE
+	TerastallizeEvent struct {
+		Pokemon  PokemonIdent
+		TeraType string
+	}
+
+	// |-item|POKEMON|ITEM or |-enditem|POKEMON|ITEM
+	ItemEvent struct {
+		End     bool
+		Pokemon PokemonIdent
+		Item    string
+		Tags    Tags
+	}
+
+	// |-ability|POKEMON|ABILITY
+	AbilityEvent struct {
+		Pokemon PokemonIdent
+		Ability string
+		Tags    Tags
+	}
+)
+
+func (e *GenericEvent) Kind() string       { return e.Type }
+func (e *ChallstrEvent) Kind() string      { return "challstr" }
+func (e *PMEvent) Kind() string            { return "pm" }
+func (e *RequestEvent) Kind() string       { return "request" }
+func (e *UpdateUserEvent) Kind() string    { return "updateuser" }
+func (e *NoInitEvent) Kind() string        { return "noinit" }
+func (e *InitEvent) Kind() string          { return "init" }
+func (e *DeinitEvent) Kind() string        { return "deinit" }
+func (e *ErrorEvent) Kind() string         { return "error" }
+func (e *PlayerEvent) Kind() string        { return "player" }
+func (e *TeamSizeEvent) Kind() string      { return "teamsize" }
+func (e *GameTypeEvent) Kind() string      { return "gametype" }
+func (e *GenEvent) Kind() string           { return "gen" }
+func (e *TierEvent) Kind() string          { return "tier" }
+func (e *PokeEvent) Kind() string          { return "poke" }
+func (e *TeamPreviewEvent) Kind() string   { return "teampreview" }
+func (e *StartEvent) Kind() string         { return "start" }
+func (e *TurnEvent) Kind() string          { return "turn" }
+func (e *WinEvent) Kind() string           { return "win" }
+func (e *TieEvent) Kind() string           { return "tie" }
+func (e *MoveEvent) Kind() string          { return "move" }
+func (e *SwitchEvent) Kind() string        { return e.Type }
+func (e *DetailsChangeEvent) Kind() string { return e.Type }
+func (e *HealthEvent) Kind() string        { return e.Type }
+func (e *FaintEvent) Kind() string         { return "faint" }
+func (e *BoostEvent) Kind() string         { return e.Type }
+func (e *TerastallizeEvent) Kind() string  { return "-terastallize" }
+func (e *AbilityEvent) Kind() string       { return "-ability" }
+
+func (e *InactiveEvent) Kind() string {
+	if e.Off {
+		return "inactiveoff"
+	}
+	return "inactive"
+}
+
+var (
+	// Sent only to the player whose timer it is: "Time left: 150 sec this turn | 690 sec total"
+	ownTimeLeft = regexp.MustCompile(`^Time left: (\d+) sec`)
+	// Sent to the whole room: "hosergang has 60 seconds left."
+	playerTimeLeft = regexp.MustCompile(`^(.+) has (\d+) seconds? left`)
+)
+
+// Returns how long the given player has left to choose, if the message says.
+func (e *InactiveEvent) TimeLeft(username string) (time.Duration, bool) {
+	if e.Off {
+		return 0, false
+	}
+	var secs string
+	if m := ownTimeLeft.FindStringSubmatch(e.Message); m != nil {
+		secs = m[1]
+	} else if m := playerTimeLeft.FindStringSubmatch(e.Message); m != nil && ToID(m[1]) == ToID(username) {
+		secs = m[2]
+	} else {
+		return 0, false
+	}
+	n, err := strconv.Atoi(secs)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// Converts a name to the ID Showdown uses for it by lowercasing it and dropping everything
+// but letters and digits, e.g. "Rotom-Wash" to "rotomwash". Usernames, formats, species,
+// moves and items are all compared by ID.
+func ToID(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return -1
+	}, strings.ToLower(name))
+}
+
+func (e *StatusEvent) Kind() string {
+	if e.Cure {
+		return "-curestatus"
+	}
+	return "-status"
+}
+
+func (e *ClearBoostEvent) Kind() string {
+	if e.All {
+		return "-clearallboost"
+	}
+	return "-clearboost"
+}
+
+func (e *WeatherEvent) Kind() string { return "-weather" }
+
+func (e *FieldEvent) Kind() string {
+	if e.End {
+		return "-fieldend"
+	}
+	return "-fieldstart"
+}
+
+func (e *SideConditionEvent) Kind() string {
+	if e.End {
+		return "-sideend"
+	}
+	return "-sidestart"
+}
+
+func (e *ItemEvent) Kind() string {
+	if e.End {
+		return "-enditem"
+	}
+	return "-item"
+}
+
+// Decodes a single protocol line into its typed event.
+// Unknown message types become a *GenericEvent. If a known type is malformed, the error
+// wraps ErrMalformedEvent and the returned event is a *GenericEvent holding the original data.
+func DecodeEvent(m Message) (Event, error) {
+	e, err := decodeEvent(m)
+	if err != nil {
+		return &GenericEvent{Type: m.Type, Data: m.Data}, fmt.Errorf("decoding %q: %w", m.Type, err)
+	}
+	return e, nil
+}
+
+// Decodes every line in the server message. Malformed lines are kept as generic events
+// and their errors are joined together.
+func DecodeEvents(sm *ServerMessage) ([]Event, error) {
+	events := make([]Event, 0, len(sm.Messages))
+	var errs []error
+	for _, m := range sm.Messages {
+		e, err := DecodeEvent(m)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		events = append(events, e)
+	}
+	return events, errors.Join(errs...)
+}
+
+func needArgs(data []string, n int) error {
+	if len(data) < n {
+		return fmt.Errorf("%w: expected at least %d arguments but got %d", ErrMalformedEvent, n, len(data))
+	}
+	return nil
+}
+
+func parseInt(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrMalformedEvent, err)
+	}
+	return n, nil
+}
+
+func decodeEvent(m Message) (Event, error) {
+	data := m.Data
+	switch m.Type {
+	case "challstr":
+		if err := needArgs(data, 1); err != nil {
+			return nil, err
+		}
+		return &ChallstrEvent{Challstr: strings.Join(data, "|")}, nil
+	case "pm":
+		if err := needArgs(data, 3); err != nil {
+			return nil, err
+		}
+		return &PMEvent{From: data[0], To: data[1], Message: strings.Join(data[2:], "|")}, nil
+	case "request":
+		if err := needArgs(data, 1); err != nil {
+			return nil, err
+		}
+		return &RequestEvent{JSON: strings.Join(data, "|")}, nil
+	case "updateuser":
+		if err := needArgs(data, 2); err != nil {
+			return nil, err
+		}
+		return &UpdateUserEvent{User: data[0], Named: data[1] == "1"}, nil
+	case "noinit":
+		e := &NoInitEvent{}
+		if len(data) > 0 {
+			e.Reason = data[0]
+		}
+		if len(data) > 1 {
+			e.Message = strings.Join(data[1:], "|")
+		}
+		return e, nil
+	case "init":
+		if err := needArgs(data, 1); err != nil {
+			return nil, err
+		}
+		return &InitEvent{RoomType: data[0]}, nil
+	case "deinit":
+		return &DeinitEvent{}, nil
+	case "error":
+		return &ErrorEvent{Message: strings.Join(data, "|")}, nil
+	case "player":
+		if err := needArgs(data, 1); err != nil {
+			return nil, err
+		}
+		e := &PlayerEvent{Player: data[0]}
+		if len(data) > 1 {
+			e.Username = data[1]
+		}
+		if len(data) > 2 {
+			e.Avatar = data[2]
+		}
+		if len(data) > 3 {
+			e.Rating = data[3]
+		}
+		return e, nil
+	case "teamsize":
+		if err := needArgs(data, 2); err != nil {
+			return nil, err
+		}
+		n, err := parseInt(data[1])
+		if err != nil {
+			return nil, err
+		}
+		return &TeamSizeEvent{Player: data[0], Size: n}, nil
+	case "gametype":
+		if err := needArgs(data, 1); err != nil {
+			return nil, err
+		}
+		return &GameTypeEvent{GameType: data[0]}, nil
+	case "gen":
+		if err := needArgs(data, 1); err != nil {
+			return nil, err
+		}
+		n, err := parseInt(data[0])
+		if err != nil {
+			return nil, err
+		}
+		return &GenEvent{Gen: n}, nil
+	case "tier":
+		if err := needArgs(data, 1); err != nil {
+			return nil, err
+		}
+		return &TierEvent{Tier: data[0]}, nil
+	case "poke":
+		if err := needArgs(data, 2); err != nil {
+			return nil, err
+		}
+		e := &PokeEvent{Player: data[0], Details: data[1]}
+		if len(data) > 2 {
+			e.Item = data[2]
+		}
+		return e, nil
+	case "teampreview":
+		return &TeamPreviewEvent{}, nil
+	case "start":
+		return &StartEvent{}, nil
+	case "turn":
+		if err := needArgs(data, 1); err != nil {
+			return nil, err
+		}
+		n, err := parseInt(data[0])
+		if err != nil {
+			return nil, err
+		}
+		return &TurnEvent{Turn: n}, nil
+	case "win":
+		if err := needArgs(data, 1); err != nil {
+			return nil, err
+		}
+		return &WinEvent{Winner: data[0]}, nil
+	case "tie":
+		return &TieEvent{}, nil
+	case "inactive", "inactiveoff":
+		return &InactiveEvent{Off: m.Type == "inactiveoff", Message: strings.Join(data, "|")}, nil
+	}
+	return decodeBattleEvent(m)
+}
+
+// Decodes the battle progress messages, which reference Pokémon and can carry tags.
+func decodeBattleEvent(m Message) (Event, error) {
+	data, tags := splitTags(m.Data)
+	switch m.Type {
+	case "move":
+		if err := needArgs(data, 2); err != nil {
+			return nil, err
+		}
+		src, err := ParsePokemonIdent(data[0])
+		if err != nil {
+			return nil, err
+		}
+		e := &MoveEvent{Pokemon: src, Move: data[1], Tags: tags}
+		if len(data) > 2 && data[2] != "" {
+			// Targets are occasionally blank or not an ident (e.g. "[still]" moves with no target)
+			if t, err := ParsePokemonIdent(data[2]); err == nil {
+				e.Target = t
+			}
+		}
+		return e, nil
+	case "switch", "drag", "replace":
+		if err := needArgs(data, 2); err != nil {
+			return nil, err
+		}
+		id, err := ParsePokemonIdent(data[0])
+		if err != nil {
+			return nil, err
+		}
+		e := &SwitchEvent{Type: m.Type, Pokemon: id, Details: data[1], Tags: tags}
+		if len(data) > 2 {
+			if e.Condition, err = ParseCondition(data[2]); err != nil {
+				return nil, err
+			}
+		}
+		return e, nil
+	case "detailschange", "-formechange":
+		if err := needArgs(data, 2); err != nil {
+			return nil, err
+		}
+		id, err := ParsePokemonIdent(data[0])
+		if err != nil {
+			return nil, err
+		}
+		e := &DetailsChangeEvent{Type: m.Type, Pokemon: id, Details: data[1], Tags: tags}
+		if len(data) > 2 && data[2] != "" {
+			c, err := ParseCondition(data[2])
+			if err != nil {
+				return nil, err
+			}
+			e.Condition = &c
+		}
+		return e, nil
+	case "-damage", "-heal", "-sethp":
+		if err := needArgs(data, 2); err != nil {
+			return nil, err
+		}
+		id, err := ParsePokemonIdent(data[0])
+		if err != nil {
+			return nil, err
+		}
+		c, err := ParseCondition(data[1])
+		if err != nil {
+			return nil, err
+		}
+		return &HealthEvent{Type: m.Type, Pokemon: id, Condition: c, Tags: tags}, nil
+	case "faint":
+		if err := needArgs(data, 1); err != nil {
+			return nil, err
+		}
+		id, err := ParsePokemonIdent(data[0])
+		if err != nil {
+			return nil, err
+		}
+		return &FaintEvent{Pokemon: id}, nil
+	case "-status", "-curestatus":
+		if err := needArgs(data, 2); err != nil {
+			return nil, err
+		}
+		id, err := ParsePokemonIdent(data[0])
+		if err != nil {
+			return nil, err
+		}
+		return &StatusEvent{Cure: m.Type == "-curestatus", Pokemon: id, Status: data[1], Tags: tags}, nil
+	case "-boost", "-unboost", "-setboost":
+		if err := needArgs(data, 3); err != nil {
+			return nil, err
+		}
+		id, err := ParsePokemonIdent(data[0])
+		if err != nil {
+			return nil, err
+		}
+		n, err := parseInt(data[2])
+		if err != nil {
+			return nil, err
+		}
+		if m.Type == "-unboost" {
+			n = -n
+		}
+		return &BoostEvent{Type: m.Type, Pokemon: id, Stat: data[1], Amount: n, Tags: tags}, nil
+	case "-clearboost":
+		if err := needArgs(data, 1); err != nil {
+			return nil, err
+		}
+		id, err := ParsePokemonIdent(data[0])
+		if err != nil {
+			return nil, err
+		}
+		return &ClearBoostEvent{Pokemon: id, Tags: tags}, nil
+	case "-clearallboost":
+		return &ClearBoostEvent{All: true, Tags: tags}, nil
+	case "-weather":
+		if err := needArgs(data, 1); err != nil {
+			return nil, err
+		}
+		return &WeatherEvent{Weather: data[0], Upkeep: tags.Has("upkeep"), Tags: tags}, nil
+	case "-fieldstart", "-fieldend":
+		if err := needArgs(data, 1); err != nil {
+			return nil, err
+		}
+		return &FieldEvent{End: m.Type == "-fieldend", Condition: data[0], Tags: tags}, nil
+	case "-sidestart", "-sideend":
+		if err := needArgs(data, 2); err != nil {
+			return nil, err
+		}
+		side, _, _ := strings.Cut(data[0], ":")
+		return &SideConditionEvent{End: m.Type == "-sideend", Side: side, Condition: data[1], Tags: tags}, nil
+	case "-terastallize":
+		if err := needArgs(data, 2); err != nil {
+			return nil, err
+		}
+		id, err := ParsePokemonIdent(data[0])
+		if err != nil {
+			return nil, err
+		}
+		return &TerastallizeEvent{Pokemon: id, TeraType: data[1]}, nil
+	case "-item", "-enditem":
+		if err := needArgs(data, 2); err != nil {
+			return nil, err
+		}
+		id, err := ParsePokemonIdent(data[0])
+		if err != nil {
+			return nil, err
+		}
+		return &ItemEvent{End: m.Type == "-enditem", Pokemon: id, Item: data[1], Tags: tags}, nil
+	case "-ability":
+		if err := needArgs(data, 2); err != nil {
+			return nil, err
+		}
+		id, err := ParsePokemonIdent(data[0])
+		if err != nil {
+			return nil, err
+		}
+		return &AbilityEvent{Pokemon: id, Ability: data[1], Tags: tags}, nil
+	}
+	return &GenericEvent{Type: m.Type, Data: m.Data}, nil
+}
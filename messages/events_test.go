@@ -0,0 +1,137 @@
+package messages_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"surrealchemist.com/mass-showdown-backend/messages"
+)
+
+func TestDecodeBattleEvents(t *testing.T) {
+	testMsg := []byte(`>battle-gen9randombattle-1
+|
+|switch|p1a: Pikachu|Pikachu, L59, F|100/100
+|move|p2a: Groudon|Earthquake|p1a: Pikachu|[spread] p1a
+|-damage|p1a: Pikachu|0 fnt
+|-damage|p2a: Groudon|52/100 brn|[from] item: Life Orb
+|-unboost|p2a: Groudon|spe|2
+|-sidestart|p1: Anonycat|move: Stealth Rock
+|faint|p1a: Pikachu
+|turn|4
+|somethingnew|a|b`)
+	sm, err := messages.ParseServerMessage(testMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := messages.DecodeEvents(sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 10 {
+		t.Fatalf("Expected 10 events but got %d", len(events))
+	}
+	sw, ok := events[1].(*messages.SwitchEvent)
+	if !ok {
+		t.Fatalf("Expected event 1 to be a switch but got %T", events[1])
+	}
+	if sw.Pokemon.Side != "p1" || sw.Pokemon.Position != "a" || sw.Pokemon.Name != "Pikachu" {
+		t.Errorf("Expected ident p1a: Pikachu but got %+v", sw.Pokemon)
+	}
+	mv, ok := events[2].(*messages.MoveEvent)
+	if !ok {
+		t.Fatalf("Expected event 2 to be a move but got %T", events[2])
+	}
+	if mv.Move != "Earthquake" || mv.Target.Name != "Pikachu" {
+		t.Errorf("Expected Earthquake targeting Pikachu but got %+v", mv)
+	}
+	if mv.Tags["spread"] != "p1a" {
+		t.Errorf("Expected spread tag to be 'p1a' but got '%s'", mv.Tags["spread"])
+	}
+	faint := events[3].(*messages.HealthEvent)
+	if !faint.Condition.Fainted || faint.Condition.HP != 0 {
+		t.Errorf("Expected fainted condition but got %+v", faint.Condition)
+	}
+	dmg := events[4].(*messages.HealthEvent)
+	if dmg.Condition.HP != 52 || dmg.Condition.MaxHP != 100 || dmg.Condition.Status != "brn" {
+		t.Errorf("Expected 52/100 brn but got %+v", dmg.Condition)
+	}
+	if dmg.Tags["from"] != "item: Life Orb" {
+		t.Errorf("Expected from tag to be 'item: Life Orb' but got '%s'", dmg.Tags["from"])
+	}
+	boost := events[5].(*messages.BoostEvent)
+	if boost.Amount != -2 {
+		t.Errorf("Expected unboost amount of -2 but got %d", boost.Amount)
+	}
+	side := events[6].(*messages.SideConditionEvent)
+	if side.Side != "p1" || side.Condition != "move: Stealth Rock" {
+		t.Errorf("Expected Stealth Rock on p1 but got %+v", side)
+	}
+	if turn := events[8].(*messages.TurnEvent); turn.Turn != 4 {
+		t.Errorf("Expected turn 4 but got %d", turn.Turn)
+	}
+	generic, ok := events[9].(*messages.GenericEvent)
+	if !ok || generic.Type != "somethingnew" || len(generic.Data) != 2 {
+		t.Errorf("Expected unknown message to decode as generic but got %+v", events[9])
+	}
+}
+
+func TestDecodeMalformedEvent(t *testing.T) {
+	ev, err := messages.DecodeEvent(messages.Message{Type: "pm", Data: []string{" someone"}})
+	if !errors.Is(err, messages.ErrMalformedEvent) {
+		t.Fatalf("Expected ErrMalformedEvent but got %v", err)
+	}
+	generic, ok := ev.(*messages.GenericEvent)
+	if !ok || generic.Type != "pm" {
+		t.Errorf("Expected malformed message to be kept as a generic event but got %+v", ev)
+	}
+}
+
+func TestDecodePMAndChallstr(t *testing.T) {
+	sm, _ := messages.ParseServerMessage([]byte("|challstr|4|abcdef\n|pm| hosergang| cruisergang|/challenge gen9randombattle|gen9randombattle|||"))
+	events, err := messages.DecodeEvents(sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs := events[0].(*messages.ChallstrEvent); cs.Challstr != "4|abcdef" {
+		t.Errorf("Expected challstr '4|abcdef' but got '%s'", cs.Challstr)
+	}
+	pm := events[1].(*messages.PMEvent)
+	if pm.From != " hosergang" {
+		t.Errorf("Expected sender ' hosergang' but got '%s'", pm.From)
+	}
+	if pm.Message != "/challenge gen9randombattle|gen9randombattle|||" {
+		t.Errorf("Expected the message to keep its pipes but got '%s'", pm.Message)
+	}
+}
+
+func TestInactiveTimeLeft(t *testing.T) {
+	cases := map[string]time.Duration{
+		"Time left: 150 sec this turn | 690 sec total":                                 150 * time.Second,
+		"Massbot has 60 seconds left.":                                                 60 * time.Second,
+		"hosergang has 60 seconds left.":                                               0,
+		"Battle timer is ON: inactive players will automatically lose when time's up.": 0,
+	}
+	for msg, want := range cases {
+		ev := &messages.InactiveEvent{Message: msg}
+		left, ok := ev.TimeLeft("massbot")
+		if ok != (want != 0) || left != want {
+			t.Errorf("Expected '%s' to leave %v but got %v (%t)", msg, want, left, ok)
+		}
+	}
+}
+
+func TestToID(t *testing.T) {
+	cases := map[string]string{
+		" Hosergang": "hosergang",
+		"Rotom-Wash": "rotomwash",
+		"Farfetch’d": "farfetchd",
+		"Porygon2":   "porygon2",
+		"Mr. Mime":   "mrmime",
+	}
+	for name, want := range cases {
+		if got := messages.ToID(name); got != want {
+			t.Errorf("Expected '%s' to become '%s' but got '%s'", name, want, got)
+		}
+	}
+}
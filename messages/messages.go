@@ -2,7 +2,7 @@ package messages
 
 import (
 	"fmt"
-	"unicode/utf8"
+	"strings"
 )
 
 type (
@@ -25,55 +25,31 @@ func (cm *ClientMessage) Marshal() []byte {
 	return []byte(fmt.Sprintf("%s|%s%s|%d", cm.RoomID, cm.Type, cm.Text, cm.ResponseID))
 }
 
+// Splits a frame from the Showdown server into its room ID and individual protocol lines.
+// Lines that don't start with a pipe are kept as messages of type "raw".
 func ParseServerMessage(msg []byte) (*ServerMessage, error) {
 	sm := new(ServerMessage)
-	r, size := utf8.DecodeRune(msg)
-	pos := size
-	curMsg := new(Message)
-	lastBreak := -1
-	switch r {
-	case '>':
-		for r != '\n' {
-			r, size = utf8.DecodeRune(msg[pos:])
-			pos += size
-		}
-		sm.RoomID = string(msg[1 : pos-size])
-		fallthrough
-	case '|':
-		lastBreak = pos
-		pos++
-		for pos < len(msg) {
-			r, size = utf8.DecodeRune(msg[pos:])
-			if r == '|' {
-				if curMsg.Type == "" {
-					curMsg.Type = string(msg[lastBreak:pos])
-				} else {
-					curMsg.Data = append(curMsg.Data, string(msg[lastBreak:pos]))
-				}
-				lastBreak = pos + 1
-			} else if r == '\n' {
-				if curMsg.Type == "" {
-					curMsg.Type = string(msg[lastBreak:pos])
-				} else {
-					curMsg.Data = append(curMsg.Data, string(msg[lastBreak:pos]))
-				}
-				lastBreak = pos + 1
-				sm.Messages = append(sm.Messages, *curMsg)
-				curMsg = new(Message)
+	body := string(msg)
+	if strings.HasPrefix(body, ">") {
+		roomID, rest, _ := strings.Cut(body[1:], "\n")
+		sm.RoomID = roomID
+		body = rest
+	}
+	// A trailing newline terminates the last line rather than starting a new one
+	body = strings.TrimSuffix(body, "\n")
+	for _, line := range strings.Split(body, "\n") {
+		if !strings.HasPrefix(line, "|") {
+			if line != "" {
+				sm.Messages = append(sm.Messages, Message{Type: "raw", Data: []string{line}})
 			}
-			pos += size
+			continue
 		}
-	default:
-		sm.Messages = append(sm.Messages, Message{Type: "raw", Data: []string{string(msg)}})
-	}
-	// If the message didn't end in a newline, we have to make sure to account for the rest of it
-	if r != '\n' {
-		if curMsg.Type == "" {
-			curMsg.Type = string(msg[lastBreak:])
-		} else {
-			curMsg.Data = append(curMsg.Data, string(msg[lastBreak:]))
+		parts := strings.Split(line[1:], "|")
+		m := Message{Type: parts[0]}
+		if len(parts) > 1 {
+			m.Data = parts[1:]
 		}
-		sm.Messages = append(sm.Messages, *curMsg)
+		sm.Messages = append(sm.Messages, m)
 	}
 	return sm, nil
 }
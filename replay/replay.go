@@ -0,0 +1,194 @@
+// Package replay records battles to files and reads them back, for post-mortems of the
+// crowd's decisions and for playing a battle back without a live server.
+package replay
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// One line of a recording. Exactly one of Frame and Poll is set.
+type Entry struct {
+	At time.Time `json:"at"`
+	// A raw frame received from the server, including its >ROOM header.
+	Frame string      `json:"frame,omitempty"`
+	Poll  *PollRecord `json:"poll,omitempty"`
+}
+
+// How a poll ended.
+type PollRecord struct {
+	RQID  int `json:"rqid"`
+	Votes int `json:"votes"`
+	// The poll's vote counts, as the poll server keeps them.
+	Tallies json.RawMessage `json:"tallies"`
+	// The command sent to the server.
+	Command string `json:"command"`
+}
+
+// How many finished rooms are remembered, so writes to them are dropped. Late writes come
+// within moments of a battle ending, so only the latest rooms need remembering.
+const maxClosed = 100
+
+// Writes each battle room to its own file of JSON lines in a directory. A nil Recorder
+// records nothing, so callers don't have to check whether recording is on.
+type Recorder struct {
+	dir   string
+	mu    sync.Mutex
+	files map[string]*os.File
+	// Rooms whose recordings are finished. Anything else written for them, like a poll
+	// that ends after its battle, is dropped rather than reopening the file.
+	closed map[string]bool
+	// The rooms in closed from oldest to newest, so the oldest can be forgotten.
+	closedOrder []string
+	log         *zap.SugaredLogger
+}
+
+func NewRecorder(dir string) *Recorder {
+	return &Recorder{
+		dir:    dir,
+		files:  make(map[string]*os.File),
+		closed: make(map[string]bool),
+		log:    zap.NewExample().Sugar().Named("recorder"),
+	}
+}
+
+// Returns the file a room is recorded to.
+func (r *Recorder) Path(roomID string) string {
+	return filepath.Join(r.dir, fileName(roomID))
+}
+
+// Records a frame received for the room.
+func (r *Recorder) Frame(roomID string, frame []byte) {
+	r.write(roomID, Entry{At: time.Now(), Frame: string(frame)})
+}
+
+// Records the end of a poll in the room.
+func (r *Recorder) Poll(roomID string, p PollRecord) {
+	r.write(roomID, Entry{At: time.Now(), Poll: &p})
+}
+
+func (r *Recorder) write(roomID string, e Entry) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed[roomID] {
+		r.log.Debugw("dropped write to finished recording", zap.String("room", roomID))
+		return
+	}
+	f, ok := r.files[roomID]
+	if !ok {
+		if err := os.MkdirAll(r.dir, 0o755); err != nil {
+			r.log.Errorw("couldn't create recording directory", zap.Error(err))
+			return
+		}
+		// Rejoined battles keep appending to the same recording
+		var err error
+		f, err = os.OpenFile(r.Path(roomID), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			r.log.Errorw("couldn't open recording", zap.String("room", roomID), zap.Error(err))
+			return
+		}
+		r.files[roomID] = f
+	}
+	if err := json.NewEncoder(f).Encode(e); err != nil {
+		r.log.Errorw("couldn't write recording", zap.String("room", roomID), zap.Error(err))
+	}
+}
+
+// Finishes the room's recording. Nothing more is recorded for the room.
+func (r *Recorder) Close(roomID string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.files[roomID]; ok {
+		f.Close()
+		delete(r.files, roomID)
+	}
+	r.finish(roomID)
+}
+
+// Resumes a finished room's recording, for when its battle is joined again.
+func (r *Recorder) Open(roomID string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed[roomID] {
+		delete(r.closed, roomID)
+		r.closedOrder = slices.DeleteFunc(r.closedOrder, func(id string) bool { return id == roomID })
+	}
+}
+
+// Remembers that the room is finished, forgetting the oldest finished room if there are
+// too many.
+func (r *Recorder) finish(roomID string) {
+	if r.closed[roomID] {
+		return
+	}
+	r.closed[roomID] = true
+	r.closedOrder = append(r.closedOrder, roomID)
+	if len(r.closedOrder) > maxClosed {
+		delete(r.closed, r.closedOrder[0])
+		r.closedOrder = r.closedOrder[1:]
+	}
+}
+
+// Finishes every recording still open, e.g. when shutting down. Battles that are rejoined
+// after the bot restarts carry on in the same files.
+func (r *Recorder) CloseAll() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for roomID, f := range r.files {
+		f.Close()
+		delete(r.files, roomID)
+		r.finish(roomID)
+	}
+}
+
+// Room IDs come from the server, so anything that could escape the directory is replaced.
+func fileName(roomID string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return '_'
+	}, roomID) + ".jsonl"
+}
+
+// Reads every entry of a recording.
+func ReadFile(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []Entry
+	sc := bufio.NewScanner(f)
+	// Frames with a whole battle log in them can be long
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		var e Entry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, sc.Err()
+}
@@ -0,0 +1,73 @@
+package replay_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"surrealchemist.com/mass-showdown-backend/replay"
+)
+
+func TestRecordAndRead(t *testing.T) {
+	rec := replay.NewRecorder(t.TempDir())
+	room := "battle-gen9randombattle-1"
+	rec.Frame(room, []byte(">"+room+"\n|init|battle"))
+	rec.Poll(room, replay.PollRecord{RQID: 3, Votes: 2, Tallies: json.RawMessage(`[1,1]`), Command: "/choose move 1"})
+	rec.Frame(room, []byte(">"+room+"\n|win|hosergang"))
+	rec.Close(room)
+
+	entries, err := replay.ReadFile(rec.Path(room))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries but got %d", len(entries))
+	}
+	if entries[0].Frame != ">"+room+"\n|init|battle" {
+		t.Errorf("Expected first frame to be recorded as received but got %q", entries[0].Frame)
+	}
+	if p := entries[1].Poll; p == nil || p.Command != "/choose move 1" || string(p.Tallies) != "[1,1]" {
+		t.Errorf("Expected poll to be recorded but got %+v", p)
+	}
+	if entries[2].At.Before(entries[0].At) {
+		t.Error("Expected entries to be recorded in order")
+	}
+
+	// A poll that ends after its battle doesn't reopen the recording
+	rec.Poll(room, replay.PollRecord{RQID: 4, Command: "/choose move 2"})
+	if entries, _ := replay.ReadFile(rec.Path(room)); len(entries) != 3 {
+		t.Errorf("Expected nothing recorded after closing but got %d entries", len(entries))
+	}
+	rec.CloseAll()
+}
+
+func TestFinishedRoomsForgotten(t *testing.T) {
+	rec := replay.NewRecorder(t.TempDir())
+	defer rec.CloseAll()
+	room := "battle-gen9randombattle-1"
+	rec.Frame(room, []byte(">"+room+"\n|init|battle"))
+	rec.Close(room)
+
+	// Rejoining the battle carries on with its recording
+	rec.Open(room)
+	rec.Frame(room, []byte(">"+room+"\n|init|battle"))
+	rec.Close(room)
+	if entries, _ := replay.ReadFile(rec.Path(room)); len(entries) != 2 {
+		t.Errorf("Expected the rejoined battle to be recorded again but got %d entries", len(entries))
+	}
+
+	// Only the latest finished rooms are remembered
+	for i := 0; i < 200; i++ {
+		rec.Close(fmt.Sprintf("battle-gen9randombattle-%d", i+2))
+	}
+	rec.Frame(room, []byte(">"+room+"\n|turn|2"))
+	if entries, _ := replay.ReadFile(rec.Path(room)); len(entries) != 3 {
+		t.Errorf("Expected the long finished room to be forgotten but got %d entries", len(entries))
+	}
+}
+
+func TestNilRecorder(t *testing.T) {
+	var rec *replay.Recorder
+	rec.Frame("battle-1", []byte("|init|battle"))
+	rec.Close("battle-1")
+}
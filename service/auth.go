@@ -0,0 +1,101 @@
+package service
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"go.uber.org/zap"
+	"surrealchemist.com/mass-showdown-backend/identity"
+)
+
+const (
+	sessionCookie = "msb_session"
+	// Holds the state of a login in progress, to check the callback is for it.
+	stateCookie = "msb_login_state"
+)
+
+// Returns the voter's session from their cookie, or from ?token= for clients that can't
+// keep cookies. Returns nil if there's no valid session.
+func (p *PollServer) session(r *http.Request) *identity.Session {
+	token := r.URL.Query().Get("token")
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		token = c.Value
+	}
+	if token == "" {
+		return nil
+	}
+	sess, err := p.signer.Verify(token)
+	if err != nil {
+		p.log.Infow("ignoring session", zap.Error(err))
+		return nil
+	}
+	return sess
+}
+
+func (p *PollServer) sessionCookie(sess *identity.Session) *http.Cookie {
+	return &http.Cookie{
+		Name:     sessionCookie,
+		Value:    p.signer.Token(sess),
+		Path:     "/",
+		Expires:  sess.Expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// Starts logging in with the provider.
+func (p *PollServer) loginHandler(w http.ResponseWriter, r *http.Request) {
+	if p.provider == nil {
+		http.Error(w, "logging in isn't enabled", http.StatusNotFound)
+		return
+	}
+	state := ksuid.New().String()
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Value:    state,
+		Path:     "/auth/",
+		Expires:  time.Now().Add(10 * time.Minute),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, p.provider.AuthURL(p.callbackURL(r), state), http.StatusFound)
+}
+
+// Returns where the provider sends voters back to: the configured public URL's callback,
+// or else the callback on the scheme and host the voter connected with.
+func (p *PollServer) callbackURL(r *http.Request) string {
+	if p.cfg.PublicURL != "" {
+		return strings.TrimSuffix(p.cfg.PublicURL, "/") + identity.CallbackPath
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + identity.CallbackPath
+}
+
+// Finishes logging in, replacing the voter's anonymous session with one for their account.
+func (p *PollServer) callbackHandler(w http.ResponseWriter, r *http.Request) {
+	if p.provider == nil {
+		http.Error(w, "logging in isn't enabled", http.StatusNotFound)
+		return
+	}
+	c, err := r.Cookie(stateCookie)
+	if err != nil || c.Value != r.URL.Query().Get("state") {
+		http.Error(w, "login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	name, err := p.provider.Exchange(r.URL.Query().Get("code"))
+	if err != nil {
+		p.log.Warnw("couldn't log voter in", zap.Error(err))
+		http.Error(w, "couldn't log in: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	sess := p.signer.LoggedIn(p.provider.Name(), name)
+	p.log.Infow("voter logged in", zap.String("voter", sess.VoterID))
+	http.SetCookie(w, p.sessionCookie(sess))
+	http.SetCookie(w, &http.Cookie{Name: stateCookie, Path: "/auth/", MaxAge: -1})
+	http.Redirect(w, r, "/", http.StatusFound)
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"surrealchemist.com/mass-showdown-backend/config"
+)
+
+func TestVotersKeepIdentityAcrossConnections(t *testing.T) {
+	p := NewPollServer(&sync.WaitGroup{}, config.Default())
+	srv := httptest.NewServer(http.HandlerFunc(p.wsServerHandler))
+	defer srv.Close()
+	p.cfg.AuthorizedHosts = config.StringList{strings.TrimPrefix(srv.URL, "http://")}
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	first, resp := dialVoter(t, url, nil)
+	defer first.Close()
+	cookies := resp.Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookie {
+		t.Fatalf("Expected a new voter to be given a session cookie but got %v", cookies)
+	}
+	header := http.Header{"Cookie": {cookies[0].String()}}
+	second, resp := dialVoter(t, url, header)
+	defer second.Close()
+	if len(resp.Cookies()) != 0 {
+		t.Error("Expected a returning voter to keep their session")
+	}
+
+	// Workers are added once the client has said hello, so give the handler a moment
+	var workers int
+	voters := make(map[string]bool)
+	for i := 0; i < 100 && workers < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		p.pool.Lock()
+		workers = len(p.pool.workers)
+		for _, w := range p.pool.workers {
+			voters[w.voter] = true
+		}
+		p.pool.Unlock()
+	}
+	if workers != 2 || len(voters) != 1 {
+		t.Errorf("Expected both connections to share one voter but got %d workers for %v", workers, voters)
+	}
+}
+
+func TestPollCountsOneVotePerVoter(t *testing.T) {
+	po := newTestPoll(t, doublesRequest)
+	if err := po.addVote(&Vote{Voter: "anon:a", Slot: 0, Type: "move", Idx: 0}); err != nil {
+		t.Fatal(err)
+	}
+	// A second tab or a reconnect has a new worker but the same voter, so its vote
+	// replaces the first instead of adding to it
+	if err := po.addVote(&Vote{From: "other tab", Voter: "anon:a", Slot: 0, Type: "move", Idx: 1, Target: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := po.addVote(&Vote{Voter: "anon:a", Slot: 1, Type: "switch", Idx: 3}); err != nil {
+		t.Errorf("Expected a vote for another slot to count but got %v", err)
+	}
+	tally := po.tally()
+	st := tally.Slots[0]
+	if st.Total != 1 || st.Attack[0] != 0 || st.Attack[1] != 1 || st.Targets[1][1] != 1 {
+		t.Errorf("Expected only the latest vote for the slot to count but got %+v", st)
+	}
+	if tally.Total != 2 || tally.Voters != 1 {
+		t.Errorf("Expected 2 votes from 1 voter in the poll but got %d from %d", tally.Total, tally.Voters)
+	}
+}
+
+func TestLoginCallsBackToThisServer(t *testing.T) {
+	cfg := config.Default()
+	cfg.Identity.Provider = config.ProviderStandIn
+	p := NewPollServer(&sync.WaitGroup{}, cfg)
+	login := func() *url.URL {
+		w := httptest.NewRecorder()
+		p.loginHandler(w, httptest.NewRequest(http.MethodGet, "https://vote.example/auth/login", nil))
+		loc, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return loc
+	}
+	if cb := login().Query().Get("callback"); cb != "https://vote.example/auth/callback" {
+		t.Errorf("Expected the callback on the scheme and host used but got %s", cb)
+	}
+	p.cfg.PublicURL = "https://public.example/"
+	if cb := login().Query().Get("callback"); cb != "https://public.example/auth/callback" {
+		t.Errorf("Expected the callback on the public URL but got %s", cb)
+	}
+}
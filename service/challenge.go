@@ -0,0 +1,114 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"surrealchemist.com/mass-showdown-backend/config"
+	"surrealchemist.com/mass-showdown-backend/messages"
+)
+
+// A challenge sent to the bot by another user.
+type Challenge struct {
+	// The challenger's user ID, e.g. "hosergang".
+	From string
+	// The format ID without custom rules, e.g. "gen9randombattle".
+	Format string
+	// Custom rules added to the format with "@@@".
+	Rules []string
+	// The message shown with the challenge. Showdown sets it to ratedMessage for rated ones.
+	Message string
+	Rated   bool
+}
+
+// The challenge message Showdown sends with rated challenges.
+const ratedMessage = "Rated battle"
+
+// Decides which challenges the bot accepts.
+type ChallengePolicy interface {
+	// Returns whether to accept the challenge. When it's rejected, the reason is
+	// sent back to the challenger.
+	Evaluate(c *Challenge) (accept bool, reason string)
+}
+
+// Parses the "/challenge FORMAT|FORMATNAME|MESSAGE|..." PM Showdown sends for a new challenge.
+// Returns nil for anything else, including the bare "/challenge" sent when one is cancelled.
+func parseChallenge(from, msg string) *Challenge {
+	args, ok := strings.CutPrefix(msg, "/challenge ")
+	if !ok {
+		return nil
+	}
+	fields := strings.Split(args, "|")
+	format, rules, _ := strings.Cut(fields[0], "@@@")
+	if format == "" {
+		return nil
+	}
+	c := &Challenge{
+		From:   messages.ToID(from),
+		Format: messages.ToID(format),
+	}
+	if rules != "" {
+		c.Rules = strings.Split(rules, ",")
+	}
+	if len(fields) > 2 {
+		c.Message = fields[2]
+	}
+	// Formats like gen9unratedrandombattle are never rated
+	c.Rated = c.Message == ratedMessage && !strings.Contains(c.Format, "unrated")
+	return c
+}
+
+// Accepts challenges based on lists of users and formats.
+type AllowlistPolicy struct {
+	// If not empty, only these users may challenge.
+	AllowUsers map[string]bool
+	DenyUsers  map[string]bool
+	// If not empty, only these formats are accepted.
+	Formats map[string]bool
+	// One of config.RatedAny, config.RatedOnly or config.UnratedOnly.
+	Rated string
+	// Whether formats with custom rules are accepted.
+	AllowCustomRules bool
+}
+
+func NewAllowlistPolicy(cfg config.Challenges) *AllowlistPolicy {
+	set := func(names []string) map[string]bool {
+		m := make(map[string]bool, len(names))
+		for _, n := range names {
+			m[messages.ToID(n)] = true
+		}
+		return m
+	}
+	return &AllowlistPolicy{
+		AllowUsers:       set(cfg.AllowUsers),
+		DenyUsers:        set(cfg.DenyUsers),
+		Formats:          set(cfg.Formats),
+		Rated:            cfg.Rated,
+		AllowCustomRules: cfg.AllowCustomRules,
+	}
+}
+
+func (a *AllowlistPolicy) Evaluate(c *Challenge) (bool, string) {
+	if a.DenyUsers[c.From] || (len(a.AllowUsers) > 0 && !a.AllowUsers[c.From]) {
+		return false, "Sorry, I'm not taking challenges from you right now."
+	}
+	if len(a.Formats) > 0 && !a.Formats[c.Format] {
+		formats := make([]string, 0, len(a.Formats))
+		for f := range a.Formats {
+			formats = append(formats, f)
+		}
+		sort.Strings(formats)
+		return false, fmt.Sprintf("Sorry, I only accept challenges in: %s", strings.Join(formats, ", "))
+	}
+	if len(c.Rules) > 0 && !a.AllowCustomRules {
+		return false, "Sorry, I don't accept challenges with custom rules."
+	}
+	switch {
+	case a.Rated == config.RatedOnly && !c.Rated:
+		return false, "Sorry, I only accept rated battles."
+	case a.Rated == config.UnratedOnly && c.Rated:
+		return false, "Sorry, I only accept unrated battles."
+	}
+	return true, ""
+}
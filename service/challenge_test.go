@@ -0,0 +1,64 @@
+package service
+
+import (
+	"testing"
+
+	"surrealchemist.com/mass-showdown-backend/config"
+)
+
+func TestParseChallenge(t *testing.T) {
+	c := parseChallenge(" Hoser Gang", "/challenge gen9ou@@@!Species Clause,Inverse Mod|[Gen 9] OU|Rated battle||")
+	if c == nil {
+		t.Fatal("Expected challenge to be parsed")
+	}
+	if c.From != "hosergang" || c.Format != "gen9ou" {
+		t.Errorf("Expected hosergang challenging in gen9ou but got %+v", c)
+	}
+	if len(c.Rules) != 2 || !c.Rated {
+		t.Errorf("Expected 2 custom rules in a rated challenge but got %+v", c)
+	}
+	for _, msg := range []string{
+		"/challenge gen9unratedrandombattle|[Gen 9] Unrated Random Battle|Rated battle||",
+		"/challenge gen9ratedcustom|[Gen 9] Rated Custom|||",
+		"/challenge gen9randombattle|[Gen 9] Random Battle|not rated, just for fun||",
+	} {
+		if c := parseChallenge(" hosergang", msg); c == nil || c.Rated {
+			t.Errorf("Expected %q to be an unrated challenge but got %+v", msg, c)
+		}
+	}
+	if parseChallenge(" hosergang", "/challenge") != nil {
+		t.Error("Expected a cancelled challenge to be ignored")
+	}
+	if parseChallenge(" hosergang", "hello") != nil {
+		t.Error("Expected a regular PM to be ignored")
+	}
+}
+
+func TestAllowlistPolicy(t *testing.T) {
+	policy := NewAllowlistPolicy(config.Challenges{
+		AllowUsers: config.StringList{"Hoser Gang", "streamer"},
+		DenyUsers:  config.StringList{"streamer"},
+		Formats:    config.StringList{"gen9randombattle", "gen9randomdoublesbattle"},
+		Rated:      config.UnratedOnly,
+	})
+	cases := []struct {
+		challenge *Challenge
+		accept    bool
+	}{
+		{&Challenge{From: "hosergang", Format: "gen9randomdoublesbattle"}, true},
+		{&Challenge{From: "someoneelse", Format: "gen9randombattle"}, false},
+		{&Challenge{From: "streamer", Format: "gen9randombattle"}, false},
+		{&Challenge{From: "hosergang", Format: "gen9ou"}, false},
+		{&Challenge{From: "hosergang", Format: "gen9randombattle", Rated: true}, false},
+		{&Challenge{From: "hosergang", Format: "gen9randombattle", Rules: []string{"Inverse Mod"}}, false},
+	}
+	for _, c := range cases {
+		accept, reason := policy.Evaluate(c.challenge)
+		if accept != c.accept {
+			t.Errorf("Expected accept to be %t for %+v but got %t", c.accept, c.challenge, accept)
+		}
+		if !accept && reason == "" {
+			t.Errorf("Expected a reason for rejecting %+v", c.challenge)
+		}
+	}
+}
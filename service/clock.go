@@ -0,0 +1,34 @@
+package service
+
+import "time"
+
+// Tells the time and sets timers for the poll manager, so tests can control time.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// A timer made by a Clock.
+type Timer interface {
+	// Receives the time once the timer fires.
+	C() <-chan time.Time
+	// Stops the timer. Returns false if it already fired or was stopped.
+	Stop() bool
+}
+
+// The real time.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.t.C }
+
+func (t realTimer) Stop() bool { return t.t.Stop() }
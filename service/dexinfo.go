@@ -0,0 +1,71 @@
+package service
+
+import (
+	"surrealchemist.com/mass-showdown-backend/battle"
+	"surrealchemist.com/mass-showdown-backend/dex"
+)
+
+// What the dex says about one of our Pokémon, sent along with it so voters don't have to
+// look it up.
+type PokemonInfo struct {
+	dex.Details
+	// Its types, or just its tera type once it's terastallized.
+	Types     []string       `json:"types,omitempty"`
+	BaseStats map[string]int `json:"baseStats,omitempty"`
+	Ability   *dex.Effect    `json:"ability,omitempty"`
+	Item      *dex.Effect    `json:"item,omitempty"`
+	// Matches the Pokémon's moves, with nil for moves that aren't in the data.
+	Moves []*dex.Move `json:"moves,omitempty"`
+}
+
+// Fills in what the dex knows about the request's moves and Pokémon. Must be called before
+// the poll is opened, since voters read the request.
+func (p *PollServer) addDexInfo(req *PSBattleRequest) {
+	d := p.dex
+	if d == nil {
+		return
+	}
+	for _, a := range req.Active {
+		for _, m := range a.Moves {
+			m.Dex = d.Move(m.ID)
+		}
+	}
+	for _, sp := range req.Side.Pokemon {
+		info := &PokemonInfo{
+			Details: dex.ParseDetails(sp.Details),
+			Ability: d.Ability(sp.Ability),
+			Item:    d.Item(sp.Item),
+		}
+		if info.Ability == nil {
+			info.Ability = d.Ability(sp.BaseAbility)
+		}
+		if s := d.Species(info.Species); s != nil {
+			info.Types = s.Types
+			info.BaseStats = s.BaseStats
+		}
+		if t := sp.Terastallized; t != "" && t != "Stellar" {
+			info.Types = []string{t}
+		}
+		for _, id := range sp.Moves {
+			info.Moves = append(info.Moves, d.Move(id))
+		}
+		sp.Dex = info
+	}
+}
+
+// Fills in the types of the opponents' Pokémon.
+func (p *PollServer) addTypes(v *battle.View) {
+	if p.dex == nil {
+		return
+	}
+	for _, opp := range v.Opponents {
+		for _, pv := range opp.Team {
+			if s := p.dex.Species(pv.Species); s != nil {
+				pv.Types = s.Types
+			}
+			if pv.Terastallized && pv.TeraType != "" && pv.TeraType != "Stellar" {
+				pv.Types = []string{pv.TeraType}
+			}
+		}
+	}
+}
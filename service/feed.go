@@ -0,0 +1,91 @@
+package service
+
+import (
+	"sync"
+
+	"surrealchemist.com/mass-showdown-backend/battle"
+)
+
+// How many of each room's latest log lines voters who join late are sent.
+const logBacklog = 200
+
+// The latest lines of each battle's log, so voters who join partway through can catch up.
+// The manager adds lines as they arrive and voters' connections read the backlog.
+type battleLogs struct {
+	sync.Mutex
+	rooms map[string][]battle.LogLine
+}
+
+// Adds the lines to the room's backlog and returns the ones that are new. Lines that were
+// already seen, e.g. because the bot rejoined the room and the log was replayed, are left
+// out.
+func (bl *battleLogs) add(room string, lines []battle.LogLine) []battle.LogLine {
+	bl.Lock()
+	defer bl.Unlock()
+	if bl.rooms == nil {
+		bl.rooms = make(map[string][]battle.LogLine)
+	}
+	backlog := bl.rooms[room]
+	var last uint64
+	if len(backlog) > 0 {
+		last = backlog[len(backlog)-1].Seq
+	}
+	var added []battle.LogLine
+	for _, l := range lines {
+		if l.Seq > last {
+			added = append(added, l)
+		}
+	}
+	backlog = append(backlog, added...)
+	if len(backlog) > logBacklog {
+		backlog = append([]battle.LogLine(nil), backlog[len(backlog)-logBacklog:]...)
+	}
+	bl.rooms[room] = backlog
+	return added
+}
+
+// Returns a copy of the room's backlog.
+func (bl *battleLogs) backlog(room string) []battle.LogLine {
+	bl.Lock()
+	defer bl.Unlock()
+	return append([]battle.LogLine(nil), bl.rooms[room]...)
+}
+
+func (bl *battleLogs) remove(room string) {
+	bl.Lock()
+	delete(bl.rooms, room)
+	bl.Unlock()
+}
+
+// The log lines a voter's connection was last sent.
+type shownLog struct {
+	room string
+	seq  uint64
+}
+
+// Returns the lines the voter hasn't been sent yet, and what they'll have been sent after
+// them. A voter who moves to another room starts over with that room's lines.
+func (s shownLog) unseen(m battleLogMessage) ([]battle.LogLine, shownLog) {
+	if s.room != m.Room {
+		s = shownLog{room: m.Room}
+	}
+	var lines []battle.LogLine
+	for _, l := range m.Lines {
+		if l.Seq > s.seq {
+			lines = append(lines, l)
+			s.seq = l.Seq
+		}
+	}
+	return lines, s
+}
+
+// Sends the voter the backlog of their room's battle log.
+func (p *PollServer) sendBacklog(w *pollWorker) {
+	room := p.pool.RoomOf(w.id)
+	if lines := p.logs.backlog(room); len(lines) > 0 {
+		p.pool.SendToWorker(w.id, &message{
+			Type:    battleLog,
+			Content: battleLogMessage{Room: room, Lines: lines},
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+	"surrealchemist.com/mass-showdown-backend/battle"
+	"surrealchemist.com/mass-showdown-backend/config"
+)
+
+func logLines(from, to uint64) []battle.LogLine {
+	var lines []battle.LogLine
+	for seq := from; seq <= to; seq++ {
+		lines = append(lines, battle.LogLine{Seq: seq, Text: "line"})
+	}
+	return lines
+}
+
+func TestBattleLogBacklog(t *testing.T) {
+	var bl battleLogs
+	if added := bl.add("battle-1", logLines(1, 150)); len(added) != 150 {
+		t.Errorf("Expected all 150 lines to be new but got %d", len(added))
+	}
+	// Rejoining replays the log from the start, with some lines missed while away
+	if added := bl.add("battle-1", logLines(1, 160)); len(added) != 10 || added[0].Seq != 151 {
+		t.Errorf("Expected only lines 151 to 160 to be new but got %+v", added)
+	}
+	bl.add("battle-1", logLines(161, 300))
+	backlog := bl.backlog("battle-1")
+	if len(backlog) != logBacklog || backlog[0].Seq != 101 || backlog[len(backlog)-1].Seq != 300 {
+		t.Errorf("Expected the latest %d lines but got %d from %d", logBacklog, len(backlog), backlog[0].Seq)
+	}
+	bl.remove("battle-1")
+	if len(bl.backlog("battle-1")) != 0 {
+		t.Error("Expected the backlog to be forgotten once the battle ended")
+	}
+}
+
+func TestLateVotersCatchUpOnBattleLog(t *testing.T) {
+	p := NewPollServer(&sync.WaitGroup{}, config.Default())
+	p.log = zap.NewNop().Sugar()
+	srv := httptest.NewServer(http.HandlerFunc(p.wsServerHandler))
+	defer srv.Close()
+	p.cfg.AuthorizedHosts = config.StringList{strings.TrimPrefix(srv.URL, "http://")}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.manage(ctx)
+	req := &PSBattleRequest{}
+	if err := json.Unmarshal([]byte(doublesRequest), req); err != nil {
+		t.Fatal(err)
+	}
+	p.serverInbox <- &message{
+		Type:    showdownRequest,
+		Content: showdownRequestMessage{RoomID: "battle-1", Req: req},
+	}
+	p.serverInbox <- &message{
+		Type:    battleLog,
+		Content: battleLogMessage{Room: "battle-1", Lines: logLines(1, 3)},
+	}
+
+	ws, _ := dialVoter(t, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	defer ws.Close()
+	var backlog battleLogMessage
+	json.Unmarshal(readUntil(t, ws, battleLog), &backlog)
+	if backlog.Room != "battle-1" || len(backlog.Lines) != 3 {
+		t.Fatalf("Expected the 3 lines so far but got %+v", backlog)
+	}
+
+	p.serverInbox <- &message{
+		Type:    battleLog,
+		Content: battleLogMessage{Room: "battle-1", Lines: logLines(1, 4)},
+	}
+	var next battleLogMessage
+	json.Unmarshal(readUntil(t, ws, battleLog), &next)
+	if len(next.Lines) != 1 || next.Lines[0].Seq != 4 {
+		t.Errorf("Expected just the new line 4 but got %+v", next.Lines)
+	}
+}
+
+func TestVotersWaitingForABattleJoinIt(t *testing.T) {
+	p := NewPollServer(&sync.WaitGroup{}, config.Default())
+	p.log = zap.NewNop().Sugar()
+	srv := httptest.NewServer(http.HandlerFunc(p.wsServerHandler))
+	defer srv.Close()
+	p.cfg.AuthorizedHosts = config.StringList{strings.TrimPrefix(srv.URL, "http://")}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.manage(ctx)
+
+	// No battle is open yet, so the voter waits
+	ws, _ := dialVoter(t, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	defer ws.Close()
+	readUntil(t, ws, displayText)
+
+	for room := range 2 {
+		name := fmt.Sprintf("battle-%d", room+1)
+		req := &PSBattleRequest{}
+		if err := json.Unmarshal([]byte(doublesRequest), req); err != nil {
+			t.Fatal(err)
+		}
+		p.serverInbox <- &message{
+			Type:    battleLog,
+			Content: battleLogMessage{Room: name, Lines: logLines(1, 2)},
+		}
+		p.serverInbox <- &message{
+			Type:    showdownRequest,
+			Content: showdownRequestMessage{RoomID: name, Req: req},
+		}
+		var backlog battleLogMessage
+		json.Unmarshal(readUntil(t, ws, battleLog), &backlog)
+		if backlog.Room != name || len(backlog.Lines) != 2 {
+			t.Fatalf("Expected the log so far of %s but got %+v", name, backlog)
+		}
+		var u updateResponseMessage
+		json.Unmarshal(readUntil(t, ws, updateResponse), &u)
+		if u.Room != name || u.Results {
+			t.Fatalf("Expected the poll in %s but got %+v", name, u)
+		}
+		// Once the battle's over the voter waits for the next one
+		p.serverInbox <- &message{Type: battleEnded, Content: name}
+		var over displayTextMessage
+		json.Unmarshal(readUntil(t, ws, displayText), &over)
+		if !strings.Contains(over.Message, "over") {
+			t.Fatalf("Expected to be told the battle is over but got %+v", over)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"go.uber.org/zap"
+	"surrealchemist.com/mass-showdown-backend/battle"
+	"surrealchemist.com/mass-showdown-backend/damage"
+	"surrealchemist.com/mass-showdown-backend/dex"
+	"surrealchemist.com/mass-showdown-backend/messages"
+)
+
+// How much damage a move is estimated to do to one of the opponent's active Pokémon.
+type MoveHint struct {
+	Target string `json:"target"`
+	// The target to vote for to hit it, in doubles.
+	Location int `json:"location,omitempty"`
+	*damage.Result
+}
+
+// Estimates the damage of each of our active Pokémon's moves against each of the
+// opponents' active Pokémon, using what the battle tracker knows about them. Must be
+// called before the poll is opened, since voters read the request.
+func (p *PollServer) addHints(po *Poll) {
+	s := p.battleSnapshot(po.RoomID)
+	if s == nil || p.dex == nil || po.Req.TeamPreview {
+		return
+	}
+	v := s.View(po.Req.Side.ID)
+	field := damage.Field{Weather: s.Weather, Doubles: len(po.Req.Active) > 1}
+	var own []*battle.Pokemon
+	if sd, ok := s.Sides[po.Req.Side.ID]; ok {
+		own = sd.Active
+	}
+	for i, a := range po.Req.Active {
+		if i >= len(po.Req.Side.Pokemon) {
+			break
+		}
+		attacker := ownPokemon(po.Req.Side.Pokemon[i])
+		if i < len(own) && own[i] != nil {
+			attacker.Boosts = own[i].Boosts
+		}
+		if p.dex.Species(attacker.Species) == nil {
+			p.log.Debugw("no dex data for our pokemon, so its moves get no hints", zap.String("species", attacker.Species))
+			continue
+		}
+		for _, m := range a.Moves {
+			if p.dex.Move(m.ID) == nil {
+				p.log.Debugw("no dex data for move, so it gets no hints", zap.String("move", m.ID))
+				continue
+			}
+			for _, opp := range v.Opponents {
+				for slot, pv := range opp.Active {
+					if pv == nil || pv.Fainted {
+						continue
+					}
+					if p.dex.Species(pv.Species) == nil {
+						p.log.Debugw("no dex data for opponent, so moves get no hints against it", zap.String("species", pv.Species))
+						continue
+					}
+					r := damage.Estimate(p.dex, m.ID, attacker, opponentPokemon(pv), field)
+					if r == nil {
+						continue
+					}
+					h := &MoveHint{Target: pv.Species, Result: r}
+					if field.Doubles {
+						h.Location = slot + 1
+					}
+					m.Hints = append(m.Hints, h)
+				}
+			}
+		}
+	}
+}
+
+// Our Pokémon's real stats are in the request, apart from HP, which the calc doesn't need
+// for the attacker.
+func ownPokemon(sp *PSSidePokemon) *damage.Pokemon {
+	details := dex.ParseDetails(sp.Details)
+	dp := &damage.Pokemon{
+		Species:       details.Species,
+		Level:         details.Level,
+		Stats:         make(map[string]int, len(sp.Stats)),
+		TeraType:      sp.TeraType,
+		Terastallized: sp.Terastallized != "",
+	}
+	if dp.Terastallized {
+		dp.TeraType = sp.Terastallized
+	}
+	for stat, v := range sp.Stats {
+		dp.Stats[stat] = int(v)
+	}
+	if c, err := messages.ParseCondition(sp.Condition); err == nil {
+		dp.Status = c.Status
+	}
+	return dp
+}
+
+func opponentPokemon(pv *battle.PokemonView) *damage.Pokemon {
+	return &damage.Pokemon{
+		Species:       pv.Species,
+		Level:         dex.ParseDetails(pv.Details).Level,
+		Boosts:        pv.Boosts,
+		Status:        pv.Status,
+		TeraType:      pv.TeraType,
+		Terastallized: pv.Terastallized,
+		HP:            pv.HP,
+	}
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"surrealchemist.com/mass-showdown-backend/config"
+	"surrealchemist.com/mass-showdown-backend/loadtest"
+)
+
+func TestManyVotersAtOnce(t *testing.T) {
+	if testing.Short() {
+		t.Skip("connects hundreds of voters")
+	}
+	cfg := config.Default()
+	cfg.Poll.Duration = config.Duration{Duration: time.Minute}
+	cfg.Poll.CloseWhenAllVoted = false
+	cfg.Poll.ResultsInterval = config.Duration{Duration: 100 * time.Millisecond}
+	p := NewPollServer(&sync.WaitGroup{}, cfg)
+	p.log = zap.NewNop().Sugar()
+	srv := httptest.NewServer(http.HandlerFunc(p.wsServerHandler))
+	defer srv.Close()
+	p.cfg.AuthorizedHosts = config.StringList{strings.TrimPrefix(srv.URL, "http://")}
+	p.SetSendChan(make(chan *message, 10))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.manage(ctx)
+
+	req := &PSBattleRequest{}
+	if err := json.Unmarshal([]byte(doublesRequest), req); err != nil {
+		t.Fatal(err)
+	}
+	p.serverInbox <- &message{
+		Type:    showdownRequest,
+		Content: showdownRequestMessage{RoomID: "battle-1", Req: req},
+	}
+
+	const voters = 200
+	report, err := loadtest.Run(ctx, loadtest.Config{
+		URL:      "ws" + strings.TrimPrefix(srv.URL, "http"),
+		Voters:   voters,
+		Duration: 3 * time.Second,
+		Seed:     1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(report)
+	if report.Connected != voters || report.Evicted != 0 {
+		t.Errorf("Expected every voter to stay connected but got %d connected and %d evicted",
+			report.Connected, report.Evicted)
+	}
+	if report.Accepted != voters || report.Results < voters {
+		t.Errorf("Expected every vote to be accepted and results to be pushed but got %d accepted and %d results",
+			report.Accepted, report.Results)
+	}
+	po := p.open.get("battle-1")
+	if po == nil {
+		t.Fatal("Expected the poll to still be open")
+	}
+	if tally := po.tally(); tally.Voters != voters || tally.Total != voters {
+		t.Errorf("Expected %d votes from %d voters but got %d from %d", voters, voters, tally.Total, tally.Voters)
+	}
+}
@@ -0,0 +1,174 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"surrealchemist.com/mass-showdown-backend/config"
+	"surrealchemist.com/mass-showdown-backend/identity"
+)
+
+// A clock that only moves when told to.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	at      time.Time
+	c       chan time.Time
+	stopped bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	stopped := t.stopped
+	t.stopped = true
+	return !stopped
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Moves the clock forward, firing the timers that come due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.timers {
+		if !t.stopped && !t.at.After(c.now) {
+			t.stopped = true
+			t.c <- c.now
+		}
+	}
+}
+
+// Waits until a timer is set for at or after the given time.
+func (c *fakeClock) waitForTimer(t *testing.T, at time.Time) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		c.mu.Lock()
+		for _, timer := range c.timers {
+			if !timer.stopped && !timer.at.Before(at) {
+				c.mu.Unlock()
+				return
+			}
+		}
+		c.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for a timer at %v", at)
+}
+
+func TestManagerClosesPollWhenDue(t *testing.T) {
+	cfg := config.Default()
+	cfg.Poll.CloseWhenAllVoted = false
+	p := NewPollServer(&sync.WaitGroup{}, cfg)
+	clock := &fakeClock{now: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	p.clock = clock
+	out := make(chan *message, 10)
+	p.SetSendChan(out)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		p.manage(ctx)
+		close(done)
+	}()
+
+	req := &PSBattleRequest{}
+	if err := json.Unmarshal([]byte(doublesRequest), req); err != nil {
+		t.Fatal(err)
+	}
+	start := clock.Now()
+	p.serverInbox <- &message{
+		Type:    showdownRequest,
+		Content: showdownRequestMessage{RoomID: "battle-1", Req: req},
+	}
+	clock.waitForTimer(t, start.Add(30*time.Second))
+	clock.Advance(29 * time.Second)
+	select {
+	case msg := <-out:
+		t.Fatalf("Expected the poll to stay open but got %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	select {
+	case msg := <-out:
+		if res, ok := msg.Content.(pollResults); !ok || res.RoomID != "battle-1" {
+			t.Errorf("Expected results for battle-1 but got %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the poll to close once it was due")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the manager to stop when its context was cancelled")
+	}
+}
+
+func TestManagerFinishesPollsOnShutdown(t *testing.T) {
+	p := NewPollServer(&sync.WaitGroup{}, config.Default())
+	p.clock = &fakeClock{now: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	out := make(chan *message, 10)
+	p.SetSendChan(out)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.manage(ctx)
+		close(done)
+	}()
+
+	for _, room := range []string{"battle-1", "battle-2"} {
+		req := &PSBattleRequest{}
+		if err := json.Unmarshal([]byte(doublesRequest), req); err != nil {
+			t.Fatal(err)
+		}
+		p.serverInbox <- &message{
+			Type:    showdownRequest,
+			Content: showdownRequestMessage{RoomID: room, Req: req},
+		}
+	}
+	w := p.pool.NewWorker("battle-1", &identity.Session{VoterID: "anon:a"})
+	p.castVote(&Vote{From: w.id, Voter: w.voter, Slot: 0, Type: "move", Idx: 1, Target: 1})
+	if msgs, _ := w.take(); len(msgs) != 1 || msgs[0].Type != voteOk {
+		t.Fatalf("Expected the vote to be acknowledged but got %v", msgs)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the manager to stop when its context was cancelled")
+	}
+	// Only the poll with votes is decided
+	if len(out) != 1 {
+		t.Fatalf("Expected 1 result but got %d", len(out))
+	}
+	res, ok := (<-out).Content.(pollResults)
+	if !ok || res.RoomID != "battle-1" || res.Command != "/choose move 2 1, move 1" {
+		t.Errorf("Expected battle-1's poll to be decided but got %+v", res)
+	}
+}
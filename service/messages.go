@@ -1,5 +1,12 @@
 package service
 
+import (
+	"time"
+
+	"surrealchemist.com/mass-showdown-backend/battle"
+	"surrealchemist.com/mass-showdown-backend/dex"
+)
+
 type message struct {
 	Type    messageType `json:"type"`
 	Content interface{} `json:"content"`
@@ -18,23 +25,90 @@ const (
 	clearVote                   = "CLEAR_VOTE"
 	wait                        = "WAIT"
 	voteOk                      = "VOTE_OK"
+	battleEnded                 = "BATTLE_END"
+	retractVote                 = "RETRACT"
+	battleTimer                 = "BATTLE_TIMER"
+	workerLeft                  = "WORKER_LEFT"
+	votesChanged                = "VOTES_CHANGED"
+	resultsDelta                = "RESULTS_DELTA"
+	hello                       = "HELLO"
+	welcome                     = "WELCOME"
+	protocolError               = "ERROR"
+	battleLog                   = "BATTLE_LOG"
 )
 
 type Vote struct {
+	// The worker the vote came through.
 	From string `json:"from,omitempty"`
+	// The identity the vote counts against, so each voter gets one vote per slot.
+	Voter string `json:"voter,omitempty"`
+	// The active slot the vote is for, starting from 0.
+	Slot int    `json:"slot"`
 	Type string `json:"type"`
 	Idx  int    `json:"idx"`
-	Tera bool   `json:"tera"`
+	// The target location for moves in doubles and triples, as used by /choose.
+	Target int  `json:"target,omitempty"`
+	Tera   bool `json:"tera"`
+	// For team preview, indexes into the side's pokemon from first to last choice.
+	// Voters who only pick a lead can leave it out and use Idx instead.
+	Order []int `json:"order,omitempty"`
+	// Further choices for the slot in order of preference after Type and Idx, for
+	// instant runoff and approval polls.
+	Also []Choice `json:"also,omitempty"`
 }
 
-type updateRequestMessage struct {
+// When the bot's battle timer in a room runs out, or zero if the timer is off.
+type battleTimerMessage struct {
+	RoomID   string
+	Deadline time.Time
+}
+
+// Takes back a voter's vote for a slot.
+type retraction struct {
 	From  string `json:"from"`
-	Voted bool   `json:"voted"`
+	Voter string `json:"voter"`
+	Slot  int    `json:"slot"`
 }
 
 type updateResponseMessage struct {
+	Room    string      `json:"room"`
 	Results bool        `json:"results"`
 	Update  interface{} `json:"update"`
+	// The opponents and the field as our side sees them.
+	Field *battle.View `json:"field,omitempty"`
+	// The name of the strategy the poll is decided by.
+	Strategy string `json:"strategy,omitempty"`
+	// For results, the poll and version they're for, so later deltas can be applied to
+	// them, and how many votes they're from.
+	Poll    string `json:"poll,omitempty"`
+	Version uint64 `json:"version,omitempty"`
+	Total   int    `json:"total,omitempty"`
+}
+
+// The vote shares that changed between two versions of a poll's results. Voters who were
+// shown the From version apply the changes to get the To version.
+type resultsDeltaMessage struct {
+	Poll    string        `json:"poll"`
+	From    uint64        `json:"from"`
+	To      uint64        `json:"to"`
+	Total   int           `json:"total"`
+	Changes []shareChange `json:"changes"`
+}
+
+// A vote share that changed.
+type shareChange struct {
+	// Where the share is in the request, like "active.0.moves.1", "active.0" or
+	// "side.pokemon.3".
+	Path string `json:"path"`
+	// The field holding the share: "votes", or "teraVotes" for active pokemon.
+	Field string  `json:"field"`
+	Share float32 `json:"share"`
+}
+
+// New lines of a battle's log, or the backlog for voters who just joined.
+type battleLogMessage struct {
+	Room  string           `json:"room"`
+	Lines []battle.LogLine `json:"lines"`
 }
 
 type displayTextMessage struct {
@@ -57,15 +131,19 @@ type pollResults struct {
 type (
 	PSBattleRequest struct {
 		Wait        bool               `json:"wait"`
-		ForceSwitch []bool             `json:"force_switch"`
+		ForceSwitch []bool             `json:"forceSwitch"`
 		Active      []*PSActivePokemon `json:"active"`
 		Side        PSSideInfo         `json:"side"`
 		RQID        uint8              `json:"rqid"`
+		TeamPreview bool               `json:"teamPreview"`
+		// How many pokemon get brought to the battle from team preview, e.g. 4 in VGC.
+		MaxChosenTeamSize int `json:"maxChosenTeamSize,omitempty"`
 	}
 
 	PSActivePokemon struct {
 		Moves           []*PSMoveInfo `json:"moves"`
 		CanTerastallize string        `json:"canTerastallize"`
+		Trapped         bool          `json:"trapped,omitempty"`
 		TeraVotes       float32       `json:"teraVotes,omitempty"`
 	}
 
@@ -77,6 +155,10 @@ type (
 		Target   string  `json:"target"`
 		Disabled bool    `json:"disabled"`
 		Votes    float32 `json:"votes,omitempty"`
+		// Estimated damage against each of the opponents' active Pokémon.
+		Hints []*MoveHint `json:"hints,omitempty"`
+		// The move's type, power, category and description.
+		Dex *dex.Move `json:"dex,omitempty"`
 	}
 
 	PSSideInfo struct {
@@ -92,7 +174,7 @@ type (
 		Active        bool              `json:"active"`
 		Stats         map[string]uint16 `json:"stats"`
 		Moves         []string          `json:"moves"`
-		BaseAbility   string            `json:"base_ability"`
+		BaseAbility   string            `json:"baseAbility"`
 		Item          string            `json:"item"`
 		Pokeball      string            `json:"pokeball"`
 		Ability       string            `json:"ability"`
@@ -101,5 +183,7 @@ type (
 		TeraType      string            `json:"teraType"`
 		Terastallized string            `json:"terastallized"`
 		Votes         float32           `json:"votes,omitempty"`
+		// Its species, level, types, ability, item and moves as the dex describes them.
+		Dex *PokemonInfo `json:"dex,omitempty"`
 	}
 )
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"surrealchemist.com/mass-showdown-backend/replay"
+)
+
+// Plays a recorded battle back instead of connecting to a server. Frames arrive with the
+// same timing they were recorded with, and requests in them start polls like live ones.
+// Commands sent back are dropped, since nothing is listening.
+type PlaybackTransport struct {
+	Path string
+}
+
+func (t *PlaybackTransport) Dial(string) (Conn, error) {
+	entries, err := replay.ReadFile(t.Path)
+	if err != nil {
+		return nil, err
+	}
+	c := &playbackConn{closed: make(chan struct{})}
+	// Pretend to be logged in so results are sent to the connection instead of held
+	c.frames = append(c.frames, playbackFrame{data: "|updateuser| Playback|1|1|{}"})
+	var last time.Time
+	for _, e := range entries {
+		if e.Frame == "" {
+			continue
+		}
+		f := playbackFrame{data: e.Frame}
+		if !last.IsZero() {
+			f.delay = e.At.Sub(last)
+		}
+		last = e.At
+		c.frames = append(c.frames, f)
+	}
+	return c, nil
+}
+
+type playbackFrame struct {
+	// How long after the previous frame this one arrives.
+	delay time.Duration
+	data  string
+}
+
+type playbackConn struct {
+	frames    []playbackFrame
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Returns the next recorded frame once it's due. After the last one, it blocks until the
+// connection is closed, so the battle stays on screen instead of being played again.
+func (c *playbackConn) ReadMessage() (int, []byte, error) {
+	if len(c.frames) == 0 {
+		<-c.closed
+		return 0, nil, io.EOF
+	}
+	f := c.frames[0]
+	c.frames = c.frames[1:]
+	select {
+	case <-time.After(f.delay):
+		return websocket.TextMessage, []byte(f.data), nil
+	case <-c.closed:
+		return 0, nil, io.EOF
+	}
+}
+
+func (c *playbackConn) WriteMessage(int, []byte) error {
+	return c.err()
+}
+
+func (c *playbackConn) WriteJSON(interface{}) error {
+	return c.err()
+}
+
+func (c *playbackConn) err() error {
+	select {
+	case <-c.closed:
+		return errors.New("playback connection closed")
+	default:
+		return nil
+	}
+}
+
+func (c *playbackConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
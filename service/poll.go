@@ -0,0 +1,491 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/ksuid"
+)
+
+// A poll over the choices for every active slot in a battle request. Votes can be counted,
+// taken back and tallied from any goroutine. The other fields belong to the manager, and
+// Req is never changed once the poll is made.
+type Poll struct {
+	// Identifies the poll in the history store.
+	ID        string
+	Req       *PSBattleRequest
+	RoomID    string
+	StartedAt time.Time
+	EndsAt    time.Time
+	// Picks each slot's choice from its ballots. Plurality if nil.
+	Strategy TallyStrategy
+	// When the poll has to close by, because the battle timer runs out. Zero if there's
+	// no timer.
+	Deadline time.Time
+	// How many times the poll was extended because it was tied.
+	Extensions int
+
+	// Votes are split over shards by voter, so voters rarely wait on each other.
+	shards [voteShards]voteShard
+	// How many votes without a voter there have been, to tell them apart.
+	anonymous atomic.Int64
+	// Set once the poll closes. Votes are rejected afterwards.
+	closed atomic.Bool
+	// Goes up whenever a vote is counted or taken back.
+	version atomic.Uint64
+	// The latest results shown to voters.
+	results atomic.Pointer[Results]
+}
+
+// The votes cast for a single active slot.
+type SlotTally struct {
+	Attack []int `json:"attack"`
+	// Votes for each target location, per move.
+	Targets []map[int]int `json:"targets"`
+	Switch  []int         `json:"switch"`
+	Tera    int           `json:"tera"`
+	Total   int           `json:"total"`
+}
+
+var (
+	errSlotOutOfBounds  = errors.New("vote for slot out of bounds")
+	errSlotHasNoChoice  = errors.New("vote for a slot that has no choice to make")
+	errIdxOutOfBounds   = errors.New("vote with index out of bounds")
+	errMoveOnSwitch     = errors.New("vote to move when poll should force switch")
+	errDisabledMove     = errors.New("vote for disabled move")
+	errInvalidTarget    = errors.New("vote with invalid target")
+	errFaintedPokemon   = errors.New("vote for fainted pokemon")
+	errActivePokemon    = errors.New("vote to switch to a pokemon that is already active")
+	errTrapped          = errors.New("vote to switch while trapped")
+	errUnknownVoteType  = errors.New("vote with unknown type")
+	errNoPokemonForSlot = errors.New("vote for a slot with no active pokemon")
+	errNotTeamPreview   = errors.New("vote for team order outside of team preview")
+	errTeamPreview      = errors.New("vote for a move or switch during team preview")
+	errInvalidOrder     = errors.New("vote with invalid team order")
+	errDuplicateChoice  = errors.New("vote that lists a choice more than once")
+	errNoVote           = errors.New("retraction from a voter who hasn't voted")
+	errPollClosed       = errors.New("vote for a poll that already closed")
+)
+
+func newPoll(roomID string, req *PSBattleRequest, now time.Time, length time.Duration) *Poll {
+	po := &Poll{
+		ID:        ksuid.New().String(),
+		Req:       req,
+		RoomID:    roomID,
+		StartedAt: now,
+		EndsAt:    now.Add(length),
+	}
+	for i := range po.shards {
+		po.shards[i].votes = make(map[string]map[int]*Vote)
+		po.shards[i].tally = newTally(req)
+	}
+	return po
+}
+
+// The number of active slots the request has choices for.
+func (po *Poll) slotCount() int {
+	if po.Req.TeamPreview {
+		return 0
+	}
+	return max(len(po.Req.Active), len(po.Req.ForceSwitch))
+}
+
+func fainted(condition string) bool {
+	return strings.HasSuffix(condition, " fnt")
+}
+
+func (po *Poll) mustSwitch(slot int) bool {
+	return slot < len(po.Req.ForceSwitch) && po.Req.ForceSwitch[slot]
+}
+
+// Reports whether the slot has nothing to choose this turn and should pass.
+func (po *Poll) passes(slot int) bool {
+	if len(po.Req.ForceSwitch) > 0 {
+		return !po.mustSwitch(slot)
+	}
+	if slot < len(po.Req.Side.Pokemon) {
+		sp := po.Req.Side.Pokemon[slot]
+		if sp.Commanding || fainted(sp.Condition) {
+			return true
+		}
+	}
+	return slot >= len(po.Req.Active)
+}
+
+// Reports whether a move's target type lets the user pick a target.
+func targetIsChosen(target string) bool {
+	switch target {
+	case "normal", "any", "adjacentAlly", "adjacentFoe", "adjacentAllyOrSelf":
+		return true
+	}
+	return false
+}
+
+// Checks a target location for a move used from slot (0-based). Foes are 1..n and allies
+// are -1..-n, following the numbering Showdown uses in /choose. A target of 0 leaves it up
+// to the poll, which falls back to the first foe.
+func (po *Poll) validTarget(slot int, moveTarget string, target int) bool {
+	n := po.slotCount()
+	if target == 0 {
+		return true
+	}
+	if n < 2 || !targetIsChosen(moveTarget) || target > n || target < -n {
+		return false
+	}
+	if target > 0 {
+		if moveTarget == "adjacentAlly" || moveTarget == "adjacentAllyOrSelf" {
+			return false
+		}
+		// Foe slots are mirrored, so our slot 0 faces their last slot
+		return moveTarget == "any" || abs(n-1-slot-(target-1)) <= 1
+	}
+	ally := -target - 1
+	switch moveTarget {
+	case "adjacentFoe":
+		return false
+	case "adjacentAllyOrSelf":
+		return abs(ally-slot) <= 1
+	case "any":
+		return ally != slot
+	}
+	return ally != slot && abs(ally-slot) <= 1
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// Checks that the slot can make the choice.
+func (po *Poll) checkChoice(slot int, c Choice) error {
+	switch c.Type {
+	case "move":
+		if po.mustSwitch(slot) {
+			return errMoveOnSwitch
+		}
+		if slot >= len(po.Req.Active) {
+			return errNoPokemonForSlot
+		}
+		moves := po.Req.Active[slot].Moves
+		if c.Idx < 0 || c.Idx >= len(moves) {
+			return errIdxOutOfBounds
+		}
+		if moves[c.Idx].Disabled {
+			return errDisabledMove
+		}
+	case "switch":
+		if c.Idx < 0 || c.Idx >= len(po.Req.Side.Pokemon) {
+			return errIdxOutOfBounds
+		}
+		sp := po.Req.Side.Pokemon[c.Idx]
+		if fainted(sp.Condition) {
+			return errFaintedPokemon
+		}
+		if sp.Active {
+			return errActivePokemon
+		}
+		if slot < len(po.Req.Active) && po.Req.Active[slot].Trapped {
+			return errTrapped
+		}
+	default:
+		return errUnknownVoteType
+	}
+	return nil
+}
+
+// Whether the voter has a vote in for any slot.
+func (po *Poll) hasVoted(voter string) bool {
+	sh := po.shard(voter)
+	sh.Lock()
+	defer sh.Unlock()
+	return len(sh.votes[voter]) > 0
+}
+
+// Whether the voter has a vote in for the slot.
+func (po *Poll) hasVotedFor(voter string, slot int) bool {
+	sh := po.shard(voter)
+	sh.Lock()
+	defer sh.Unlock()
+	return sh.votes[voter][slot] != nil
+}
+
+// The slot a vote is for. Team preview votes are all for slot 0.
+func (po *Poll) voteSlot(v *Vote) int {
+	if po.Req.TeamPreview {
+		return 0
+	}
+	return v.Slot
+}
+
+// Validates a vote against the request and counts it. A voter has one vote per slot, so a
+// later vote for the same slot replaces the earlier one. Votes without a voter are each
+// counted separately.
+func (po *Poll) addVote(v *Vote) error {
+	var err error
+	if po.Req.TeamPreview {
+		err = po.checkTeamVote(v)
+	} else {
+		err = po.checkSlotVote(v)
+	}
+	if err != nil {
+		return err
+	}
+	voter := v.Voter
+	if voter == "" {
+		voter = fmt.Sprintf("#%d", po.anonymous.Add(1))
+	}
+	slot := po.voteSlot(v)
+	sh := po.shard(voter)
+	sh.Lock()
+	defer sh.Unlock()
+	if po.closed.Load() {
+		return errPollClosed
+	}
+	votes := sh.votes[voter]
+	if votes == nil {
+		votes = make(map[int]*Vote)
+		sh.votes[voter] = votes
+		sh.tally.Voters++
+	}
+	if old := votes[slot]; old != nil {
+		sh.tally.count(old, -1)
+	}
+	votes[slot] = v
+	sh.tally.count(v, 1)
+	po.version.Add(1)
+	return nil
+}
+
+// Takes back the voter's vote for the slot.
+func (po *Poll) retractVote(voter string, slot int) error {
+	sh := po.shard(voter)
+	sh.Lock()
+	defer sh.Unlock()
+	if po.closed.Load() {
+		return errPollClosed
+	}
+	old := sh.votes[voter][slot]
+	if old == nil {
+		return errNoVote
+	}
+	sh.tally.count(old, -1)
+	delete(sh.votes[voter], slot)
+	if len(sh.votes[voter]) == 0 {
+		delete(sh.votes, voter)
+		sh.tally.Voters--
+	}
+	po.version.Add(1)
+	return nil
+}
+
+// Stops the poll from taking votes. Votes that are being counted as it closes are
+// finished first, so the tallies never change afterwards.
+func (po *Poll) close() {
+	po.closed.Store(true)
+	for i := range po.shards {
+		po.shards[i].Lock()
+		po.shards[i].Unlock()
+	}
+}
+
+// Checks a vote for a move or switch.
+func (po *Poll) checkSlotVote(v *Vote) error {
+	if v.Type == "team" {
+		return errNotTeamPreview
+	}
+	if v.Slot < 0 || v.Slot >= po.slotCount() {
+		return errSlotOutOfBounds
+	}
+	if po.passes(v.Slot) {
+		return errSlotHasNoChoice
+	}
+	first := Choice{Type: v.Type, Idx: v.Idx}
+	for _, c := range append([]Choice{first}, v.Also...) {
+		if err := po.checkChoice(v.Slot, c); err != nil {
+			return err
+		}
+	}
+	for i, c := range v.Also {
+		if c == first || slices.Contains(v.Also[:i], c) {
+			return errDuplicateChoice
+		}
+	}
+	if v.Type == "move" {
+		moves := po.Req.Active[v.Slot].Moves
+		if !po.validTarget(v.Slot, moves[v.Idx].Target, v.Target) {
+			return errInvalidTarget
+		}
+	}
+	return nil
+}
+
+// Checks a team preview ballot. A ballot that only names a lead is turned into an order
+// with just the lead.
+func (po *Poll) checkTeamVote(v *Vote) error {
+	if v.Type != "team" {
+		return errTeamPreview
+	}
+	if len(v.Order) == 0 {
+		v.Order = []int{v.Idx}
+	}
+	n := len(po.Req.Side.Pokemon)
+	if len(v.Order) > n {
+		return errInvalidOrder
+	}
+	seen := make(map[int]bool, len(v.Order))
+	for _, idx := range v.Order {
+		if idx < 0 || idx >= n || seen[idx] {
+			return errInvalidOrder
+		}
+		seen[idx] = true
+	}
+	return nil
+}
+
+// Returns the current ballots for a slot, in order of voter so picks are repeatable.
+func (po *Poll) ballots(slot int) []Ballot {
+	byVoter := make(map[string]Ballot)
+	for i := range po.shards {
+		sh := &po.shards[i]
+		sh.Lock()
+		for voter, votes := range sh.votes {
+			if v := votes[slot]; v != nil {
+				byVoter[voter] = append(Ballot{{Type: v.Type, Idx: v.Idx}}, v.Also...)
+			}
+		}
+		sh.Unlock()
+	}
+	ballots := make([]Ballot, 0, len(byVoter))
+	for _, voter := range sortedKeys(byVoter) {
+		ballots = append(ballots, byVoter[voter])
+	}
+	return ballots
+}
+
+// Builds the /choose command from the winning choice of every slot, as picked by the
+// poll's strategy. Candidates are the slot's moves then its switches, so with plurality
+// voting ties go to moves, then to the lowest index.
+func (po *Poll) command() string {
+	t := po.tally()
+	if po.Req.TeamPreview {
+		return teamCommand(t.Team, po.Req.MaxChosenTeamSize)
+	}
+	strategy := po.tallyStrategy()
+	choices := make([]string, len(t.Slots))
+	switchedIn := make(map[int]bool)
+	teraUsed := false
+	for i, st := range t.Slots {
+		if po.passes(i) {
+			choices[i] = "pass"
+			continue
+		}
+		candidates := po.candidates(i, switchedIn)
+		if len(candidates) == 0 {
+			choices[i] = "pass"
+			continue
+		}
+		winner := strategy.Winner(candidates, po.ballots(i))
+		switch winner.Type {
+		case "switch":
+			switchedIn[winner.Idx] = true
+			choices[i] = fmt.Sprintf("switch %d", winner.Idx+1)
+		case "move":
+			choices[i] = fmt.Sprintf("move %d", winner.Idx+1)
+			a := po.Req.Active[i]
+			if len(t.Slots) > 1 && targetIsChosen(a.Moves[winner.Idx].Target) {
+				choices[i] += fmt.Sprintf(" %d", po.winningTarget(st, i, winner.Idx))
+			}
+			if !teraUsed && a.CanTerastallize != "" && st.Tera*2 > st.Total {
+				choices[i] += " terastallize"
+				teraUsed = true
+			}
+		}
+	}
+	return "/choose " + strings.Join(choices, ", ")
+}
+
+// Returns the poll's strategy, which is plurality unless one was set.
+func (po *Poll) tallyStrategy() TallyStrategy {
+	if po.Strategy == nil {
+		return Plurality{}
+	}
+	return po.Strategy
+}
+
+// Lists the choices the slot can make: its moves, then its switches. Pokemon in
+// switchedIn are already being switched in by another slot.
+func (po *Poll) candidates(slot int, switchedIn map[int]bool) []Choice {
+	var candidates []Choice
+	if !po.mustSwitch(slot) && slot < len(po.Req.Active) {
+		for j, m := range po.Req.Active[slot].Moves {
+			if !m.Disabled {
+				candidates = append(candidates, Choice{Type: "move", Idx: j})
+			}
+		}
+	}
+	trapped := slot < len(po.Req.Active) && po.Req.Active[slot].Trapped
+	for j, sp := range po.Req.Side.Pokemon {
+		if trapped || sp.Active || fainted(sp.Condition) || switchedIn[j] {
+			continue
+		}
+		candidates = append(candidates, Choice{Type: "switch", Idx: j})
+	}
+	return candidates
+}
+
+// Returns the most voted target for the slot's move, or the first valid target if nobody
+// picked one. Foes are checked before allies, so ties go to the foe.
+func (po *Poll) winningTarget(st *SlotTally, slot, move int) int {
+	n := po.slotCount()
+	moveTarget := po.Req.Active[slot].Moves[move].Target
+	votes := st.Targets[move]
+	winner := 0
+	winnerCt := -1
+	for _, target := range targetOrder(n) {
+		if ct := votes[target]; ct > winnerCt && po.validTarget(slot, moveTarget, target) {
+			winner = target
+			winnerCt = ct
+		}
+	}
+	return winner
+}
+
+// Lists target locations with foes first: 1..n, then -1..-n.
+func targetOrder(n int) []int {
+	order := make([]int, 0, 2*n)
+	for t := 1; t <= n; t++ {
+		order = append(order, t)
+	}
+	for t := 1; t <= n; t++ {
+		order = append(order, -t)
+	}
+	return order
+}
+
+// Builds the /team command from the Borda totals, highest first, bringing size pokemon
+// or the whole team if size is 0. Ties keep team order.
+func teamCommand(team []int, size int) string {
+	order := make([]int, len(team))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return team[order[a]] > team[order[b]]
+	})
+	if size > 0 && size < len(order) {
+		order = order[:size]
+	}
+	var sb strings.Builder
+	for _, idx := range order {
+		sb.WriteString(strconv.Itoa(idx + 1))
+	}
+	return "/team " + sb.String()
+}
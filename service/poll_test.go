@@ -0,0 +1,398 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"surrealchemist.com/mass-showdown-backend/battle"
+	"surrealchemist.com/mass-showdown-backend/config"
+	"surrealchemist.com/mass-showdown-backend/dex"
+	"surrealchemist.com/mass-showdown-backend/messages"
+	"surrealchemist.com/mass-showdown-backend/store"
+)
+
+const doublesRequest = `{
+	"active": [
+		{"moves": [
+			{"move": "Protect", "id": "protect", "pp": 16, "maxpp": 16, "target": "self", "disabled": false},
+			{"move": "Thunderbolt", "id": "thunderbolt", "pp": 24, "maxpp": 24, "target": "normal", "disabled": false}
+		], "canTerastallize": "Electric"},
+		{"moves": [
+			{"move": "Earthquake", "id": "earthquake", "pp": 16, "maxpp": 16, "target": "allAdjacent", "disabled": false},
+			{"move": "Helping Hand", "id": "helpinghand", "pp": 32, "maxpp": 32, "target": "adjacentAlly", "disabled": false}
+		], "canTerastallize": "Ground"}
+	],
+	"side": {"name": "cruisergang", "id": "p1", "pokemon": [
+		{"ident": "p1: Pikachu", "details": "Pikachu, L59, F", "condition": "100/100", "active": true},
+		{"ident": "p1: Groudon", "details": "Groudon, L60", "condition": "100/100", "active": true},
+		{"ident": "p1: Feebas", "details": "Feebas, L1, M", "condition": "0 fnt", "active": false},
+		{"ident": "p1: Jynx", "details": "Jynx, F", "condition": "80/100", "active": false}
+	]},
+	"rqid": 3
+}`
+
+func testDex(t *testing.T) *dex.Dex {
+	t.Helper()
+	d, err := dex.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func newTestPoll(t *testing.T, raw string) *Poll {
+	t.Helper()
+	req := &PSBattleRequest{}
+	if err := json.Unmarshal([]byte(raw), req); err != nil {
+		t.Fatal(err)
+	}
+	return newPoll("battle-gen9randomdoublesbattle-1", req, time.Now(), 30*time.Second)
+}
+
+func TestDoublesCommand(t *testing.T) {
+	po := newTestPoll(t, doublesRequest)
+	votes := []*Vote{
+		{From: "a", Slot: 0, Type: "move", Idx: 1, Target: 2, Tera: true},
+		{From: "b", Slot: 0, Type: "move", Idx: 1, Target: 2},
+		{From: "c", Slot: 0, Type: "move", Idx: 1, Target: 1, Tera: true},
+		{From: "a", Slot: 1, Type: "switch", Idx: 3},
+		{From: "b", Slot: 1, Type: "switch", Idx: 3},
+		{From: "c", Slot: 1, Type: "move", Idx: 1},
+	}
+	for _, v := range votes {
+		if err := po.addVote(v); err != nil {
+			t.Fatalf("Expected vote %+v to be valid but got %v", v, err)
+		}
+	}
+	cmd := po.command()
+	if cmd != "/choose move 2 2 terastallize, switch 4" {
+		t.Errorf("Expected '/choose move 2 2 terastallize, switch 4' but got '%s'", cmd)
+	}
+}
+
+func TestDoublesRejectsInvalidVotes(t *testing.T) {
+	po := newTestPoll(t, doublesRequest)
+	cases := map[*Vote]error{
+		{Slot: 2, Type: "move", Idx: 0}:                errSlotOutOfBounds,
+		{Slot: 0, Type: "move", Idx: 2}:                errIdxOutOfBounds,
+		{Slot: 1, Type: "move", Idx: 1, Target: 1}:     errInvalidTarget,
+		{Slot: 0, Type: "move", Idx: 1, Target: -1}:    errInvalidTarget,
+		{Slot: 0, Type: "switch", Idx: 2}:              errFaintedPokemon,
+		{Slot: 0, Type: "switch", Idx: 1}:              errActivePokemon,
+		{Slot: 0, Type: "dance", Idx: 0}:               errUnknownVoteType,
+		{Slot: 1, Type: "move", Idx: 0, Target: 1}:     errInvalidTarget,
+		{Slot: 1, Type: "move", Idx: 1, Target: -2}:    errInvalidTarget,
+		{Slot: 0, Type: "move", Idx: 0, Target: 0}:     nil,
+		{Slot: 1, Type: "move", Idx: 1, Target: -1}:    nil,
+		{Slot: 0, Type: "move", Idx: 1, Target: 1}:     nil,
+		{Slot: 1, Type: "switch", Idx: 3, Target: 0}:   nil,
+		{Slot: 0, Type: "move", Idx: 1, Tera: true}:    nil,
+		{Slot: 1, Type: "move", Idx: 0, Tera: true}:    nil,
+		{Slot: 0, Type: "switch", Idx: 3, Tera: false}: nil,
+	}
+	for v, want := range cases {
+		if err := po.addVote(v); err != want {
+			t.Errorf("Expected vote %+v to give %v but got %v", v, want, err)
+		}
+	}
+}
+
+func TestForceSwitchPassesOtherSlots(t *testing.T) {
+	po := newTestPoll(t, `{
+		"forceSwitch": [false, true],
+		"side": {"pokemon": [
+			{"ident": "p1: Pikachu", "condition": "100/100", "active": true},
+			{"ident": "p1: Groudon", "condition": "0 fnt", "active": true},
+			{"ident": "p1: Jynx", "condition": "80/100", "active": false}
+		]},
+		"rqid": 4
+	}`)
+	if err := po.addVote(&Vote{Slot: 0, Type: "switch", Idx: 2}); err != errSlotHasNoChoice {
+		t.Errorf("Expected vote for passing slot to be rejected but got %v", err)
+	}
+	if cmd := po.command(); cmd != "/choose pass, switch 3" {
+		t.Errorf("Expected '/choose pass, switch 3' but got '%s'", cmd)
+	}
+}
+
+const teamPreviewRequest = `{
+	"teamPreview": true,
+	"maxChosenTeamSize": 4,
+	"side": {"pokemon": [
+		{"ident": "p1: Pikachu"}, {"ident": "p1: Groudon"}, {"ident": "p1: Feebas"},
+		{"ident": "p1: Jynx"}, {"ident": "p1: Mewtwo"}, {"ident": "p1: Kecleon"}
+	]},
+	"rqid": 1
+}`
+
+func TestTeamPreviewCommand(t *testing.T) {
+	po := newTestPoll(t, teamPreviewRequest)
+	votes := []*Vote{
+		{Type: "team", Order: []int{4, 1, 0, 3}},
+		{Type: "team", Order: []int{1, 4, 3}},
+		{Type: "team", Idx: 4},
+	}
+	for _, v := range votes {
+		if err := po.addVote(v); err != nil {
+			t.Fatalf("Expected vote %+v to be valid but got %v", v, err)
+		}
+	}
+	if err := po.addVote(&Vote{Type: "team", Order: []int{1, 1}}); err != errInvalidOrder {
+		t.Errorf("Expected duplicate order to be rejected but got %v", err)
+	}
+	if err := po.addVote(&Vote{Type: "move", Idx: 0}); err != errTeamPreview {
+		t.Errorf("Expected move vote to be rejected during team preview but got %v", err)
+	}
+	if cmd := po.command(); cmd != "/team 5241" {
+		t.Errorf("Expected '/team 5241' but got '%s'", cmd)
+	}
+}
+
+func TestChangeAndRetractVotes(t *testing.T) {
+	po := newTestPoll(t, doublesRequest)
+	votes := []*Vote{
+		{Voter: "a", Slot: 0, Type: "move", Idx: 1, Target: 2, Tera: true},
+		{Voter: "b", Slot: 0, Type: "move", Idx: 1, Target: 2},
+		{Voter: "c", Slot: 0, Type: "switch", Idx: 3},
+		// a misclicked and meant to switch
+		{Voter: "a", Slot: 0, Type: "switch", Idx: 3},
+	}
+	for _, v := range votes {
+		if err := po.addVote(v); err != nil {
+			t.Fatalf("Expected vote %+v to be valid but got %v", v, err)
+		}
+	}
+	st := po.tally().Slots[0]
+	if st.Attack[1] != 1 || st.Targets[1][2] != 1 || st.Tera != 0 || st.Switch[3] != 2 || st.Total != 3 {
+		t.Errorf("Expected a's first vote to be replaced but got %+v", st)
+	}
+	// A rejected change leaves the earlier vote alone
+	if err := po.addVote(&Vote{Voter: "b", Slot: 0, Type: "switch", Idx: 2}); err != errFaintedPokemon {
+		t.Errorf("Expected vote for a fainted pokemon to be rejected but got %v", err)
+	}
+	if st = po.tally().Slots[0]; st.Attack[1] != 1 {
+		t.Errorf("Expected b's vote to still count but got %+v", st)
+	}
+
+	if err := po.retractVote("a", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := po.retractVote("c", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := po.retractVote("c", 0); err != errNoVote {
+		t.Errorf("Expected retracting twice to fail but got %v", err)
+	}
+	tally := po.tally()
+	if st = tally.Slots[0]; st.Switch[3] != 0 || st.Total != 1 || tally.Total != 1 || po.hasVoted("a") {
+		t.Errorf("Expected only b's vote to be left but got %+v", st)
+	}
+	if cmd := po.command(); cmd != "/choose move 2 2, move 1" {
+		t.Errorf("Expected '/choose move 2 2, move 1' but got '%s'", cmd)
+	}
+}
+
+func TestChangeTeamPreviewVote(t *testing.T) {
+	po := newTestPoll(t, teamPreviewRequest)
+	po.addVote(&Vote{Voter: "a", Type: "team", Order: []int{0, 1}})
+	po.addVote(&Vote{Voter: "a", Type: "team", Order: []int{3}})
+	team := po.tally().Team
+	for i, pts := range team {
+		want := 0
+		if i == 3 {
+			want = len(team)
+		}
+		if pts != want {
+			t.Errorf("Expected only the changed ballot to count but got %v", team)
+			break
+		}
+	}
+}
+
+func TestPollShowsOpponents(t *testing.T) {
+	sm, err := messages.ParseServerMessage([]byte(`>battle-gen9randomdoublesbattle-1
+|player|p1|cruisergang|1|
+|player|p2|Anonybird|2|
+|gametype|doubles
+|switch|p1a: Pikachu|Pikachu, L59, F|100/100
+|switch|p2a: Feebas|Feebas, L1, M|12/20 brn
+|-weather|RainDance`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := messages.DecodeEvents(sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := battle.NewTracker()
+	tr.Apply(sm.RoomID, events)
+	p := NewPollServer(&sync.WaitGroup{}, config.Default())
+	p.SetBattleTracker(tr)
+	p.SetDex(testDex(t))
+
+	po := newTestPoll(t, doublesRequest)
+	po.Strategy = p.strategy
+	u := p.pollMessage(po).Content.(updateResponseMessage)
+	if u.Field == nil || u.Field.Weather != "RainDance" || len(u.Field.Opponents) != 1 {
+		t.Fatalf("Expected rain and one opponent but got %+v", u.Field)
+	}
+	if feebas := u.Field.Opponents[0].Active[0]; feebas.Species != "Feebas" || feebas.HP != 60 || feebas.Status != "brn" {
+		t.Errorf("Expected the opponent's burned Feebas at 60%% but got %+v", feebas)
+	}
+	if types := u.Field.Opponents[0].Active[0].Types; len(types) != 1 || types[0] != "Water" {
+		t.Errorf("Expected Feebas to be water type but got %v", types)
+	}
+}
+
+func TestPollHintsDamage(t *testing.T) {
+	sm, err := messages.ParseServerMessage([]byte(`>battle-gen9randomdoublesbattle-1
+|player|p1|cruisergang|1|
+|player|p2|Anonybird|2|
+|gametype|doubles
+|switch|p1a: Pikachu|Pikachu, L59, F|100/100
+|switch|p1b: Groudon|Groudon, L60|100/100
+|switch|p2a: Feebas|Feebas, L1, M|12/20 brn
+|switch|p2b: Garchomp|Garchomp, L80|100/100
+|-boost|p1b: Groudon|atk|1`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := messages.DecodeEvents(sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := battle.NewTracker()
+	tr.Apply(sm.RoomID, events)
+	p := NewPollServer(&sync.WaitGroup{}, config.Default())
+	p.SetBattleTracker(tr)
+	p.SetDex(testDex(t))
+
+	po := newTestPoll(t, doublesRequest)
+	po.Strategy = p.strategy
+	p.addHints(po)
+	pikachu, groudon := po.Req.Active[0], po.Req.Active[1]
+	if hints := pikachu.Moves[0].Hints; len(hints) != 0 {
+		t.Errorf("Expected no hints for Protect but got %+v", hints)
+	}
+	tbolt := pikachu.Moves[1].Hints
+	if len(tbolt) != 2 {
+		t.Fatalf("Expected Thunderbolt hints against both opponents but got %+v", tbolt)
+	}
+	if tbolt[0].Target != "Feebas" || tbolt[0].Location != 1 || tbolt[0].Summary != "guaranteed OHKO" {
+		t.Errorf("Expected Thunderbolt to OHKO Feebas in the first slot but got %+v", tbolt[0])
+	}
+	if tbolt[1].Target != "Garchomp" || tbolt[1].Location != 2 || tbolt[1].Summary != "no effect" {
+		t.Errorf("Expected Thunderbolt not to affect Garchomp but got %+v", tbolt[1])
+	}
+	quake := groudon.Moves[0].Hints
+	if len(quake) != 2 || quake[1].Max == 0 {
+		t.Fatalf("Expected Earthquake to hit both opponents but got %+v", quake)
+	}
+
+	// The hints stay with the request when results are made from it
+	res, _ := po.refreshResults()
+	if h := res.Req.Active[1].Moves[0].Hints; len(h) != 2 || h[1].Max != quake[1].Max {
+		t.Errorf("Expected the results to keep the hints but got %+v", h)
+	}
+
+	// Moves missing from the dex are logged, so gaps in the data can be spotted
+	core, logs := observer.New(zap.DebugLevel)
+	p.log = zap.New(core).Sugar()
+	po = newTestPoll(t, doublesRequest)
+	po.Req.Active[0].Moves[1].ID = "notarealmove"
+	p.addHints(po)
+	if logs.FilterField(zap.String("move", "notarealmove")).Len() != 1 {
+		t.Errorf("Expected the missing move to be logged but got %v", logs.All())
+	}
+}
+
+func TestPollDescribesChoices(t *testing.T) {
+	po := newTestPoll(t, `{
+		"active": [{"moves": [
+			{"move": "Thunderbolt", "id": "thunderbolt", "pp": 24, "maxpp": 24, "target": "normal"},
+			{"move": "Hidden Power Ice 60", "id": "hiddenpowerice60", "pp": 24, "maxpp": 24, "target": "normal"}
+		]}],
+		"side": {"name": "cruisergang", "id": "p1", "pokemon": [
+			{"ident": "p1: Sparky", "details": "Pikachu, L59, F, shiny", "condition": "100/100", "active": true,
+				"moves": ["thunderbolt", "hiddenpowerice60"], "baseAbility": "lightningrod", "ability": "lightningrod", "item": "lightball"},
+			{"ident": "p1: Groudon", "details": "Groudon, L60", "condition": "100/100", "active": false,
+				"moves": ["precipiceblades"], "baseAbility": "drought", "item": "leftovers", "terastallized": "Fire"}
+		]},
+		"rqid": 2
+	}`)
+	p := NewPollServer(&sync.WaitGroup{}, config.Default())
+	p.SetDex(testDex(t))
+	p.addDexInfo(po.Req)
+	tbolt := po.Req.Active[0].Moves[0].Dex
+	if tbolt == nil || tbolt.Type != "Electric" || tbolt.BasePower != 90 || tbolt.Category != "Special" || tbolt.ShortDesc == "" {
+		t.Errorf("Expected Thunderbolt's type, power, category and description but got %+v", tbolt)
+	}
+	if hp := po.Req.Active[0].Moves[1].Dex; hp != nil {
+		t.Errorf("Expected nothing for a move that isn't in the data but got %+v", hp)
+	}
+	sparky := po.Req.Side.Pokemon[0].Dex
+	if sparky.Species != "Pikachu" || sparky.Level != 59 || sparky.Gender != "F" || !sparky.Shiny {
+		t.Errorf("Expected a level 59 shiny female Pikachu but got %+v", sparky.Details)
+	}
+	if sparky.Types[0] != "Electric" || sparky.Ability.Name != "Lightning Rod" || sparky.Item != nil {
+		t.Errorf("Expected an electric type with Lightning Rod and an unknown item but got %+v", sparky)
+	}
+	if len(sparky.Moves) != 2 || sparky.Moves[0].Name != "Thunderbolt" || sparky.Moves[1] != nil {
+		t.Errorf("Expected the known move to be described but got %+v", sparky.Moves)
+	}
+	groudon := po.Req.Side.Pokemon[1].Dex
+	if len(groudon.Types) != 1 || groudon.Types[0] != "Fire" || groudon.Ability.Name != "Drought" || groudon.Item.Name != "Leftovers" {
+		t.Errorf("Expected tera fire Groudon with Drought and Leftovers but got %+v", groudon)
+	}
+}
+
+func TestHistoryNeedsToken(t *testing.T) {
+	st, err := store.OpenFile(filepath.Join(t.TempDir(), "polls.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	for i := 0; i < 3; i++ {
+		st.StartPoll(&store.Poll{ID: fmt.Sprint(i), RoomID: "battle-1"})
+	}
+	cfg := config.Default()
+	p := NewPollServer(&sync.WaitGroup{}, cfg)
+	p.SetStore(st)
+	get := func(token, query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/history"+query, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		p.historyHandler(w, r)
+		return w
+	}
+
+	// History isn't served without a token configured
+	if w := get("", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected history to be off without a token but got %d", w.Code)
+	}
+	cfg.Store.HistoryToken = "s3cret"
+	p = NewPollServer(&sync.WaitGroup{}, cfg)
+	p.SetStore(st)
+	if w := get("wrong", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong token to be refused but got %d", w.Code)
+	}
+	w := get("s3cret", "?room=battle-1&offset=1&limit=1")
+	var polls []*store.Poll
+	json.Unmarshal(w.Body.Bytes(), &polls)
+	if w.Code != http.StatusOK || len(polls) != 1 || polls[0].ID != "1" {
+		t.Errorf("Expected the second poll but got %d: %s", w.Code, w.Body)
+	}
+	if w := get("s3cret", "?limit=lots"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a bad limit to be refused but got %d", w.Code)
+	}
+}
@@ -1,67 +1,93 @@
 package service
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/segmentio/ksuid"
 	"go.uber.org/zap"
+	"surrealchemist.com/mass-showdown-backend/battle"
+	"surrealchemist.com/mass-showdown-backend/config"
+	"surrealchemist.com/mass-showdown-backend/dex"
+	"surrealchemist.com/mass-showdown-backend/identity"
+	"surrealchemist.com/mass-showdown-backend/messages"
+	"surrealchemist.com/mass-showdown-backend/replay"
+	"surrealchemist.com/mass-showdown-backend/store"
 )
 
-var AUTHORIZED_HOSTS = [...]string{"localhost:8080"}
-
 type PollServer struct {
+	cfg          config.Server
+	pollCfg      config.Poll
 	upgrader     *websocket.Upgrader
 	serverInbox  chan *message
 	serverOutbox chan *message
 	wg           *sync.WaitGroup
 	pool         *pollWorkerPool
-	log          *zap.SugaredLogger
-}
-
-type Poll struct {
-	Req            *PSBattleRequest
-	RoomID         string
-	StartedAt      time.Time
-	EndsAt         time.Time
-	Attack, Switch []int16
-	Tera           uint16
-	Total          uint16
-}
-
-type pollWorker struct {
-	id    string
-	voted bool
-	inbox chan *message
-}
-
-type pollWorkerPool struct {
-	sync.Mutex
-	managerInbox chan *message
-	workers      map[string]*pollWorker
+	battles      *battle.Tracker
+	dex          *dex.Dex
+	recorder     *replay.Recorder
+	store        store.Store
+	// Token needed to read the history, or empty if it isn't served
+	historyToken string
+	signer       *identity.Signer
+	// Where voters log in, or nil if they can't
+	provider     identity.Provider
+	requireLogin bool
+	// Picks the winners of new polls, unless there's one for the battle's format
+	strategy         TallyStrategy
+	formatStrategies map[string]TallyStrategy
+	// The polls voters can vote in
+	open openPolls
+	// The latest lines of each battle's log
+	logs  battleLogs
+	clock Clock
+	log   *zap.SugaredLogger
 }
 
-func NewPollServer(wg *sync.WaitGroup) *PollServer {
+func NewPollServer(wg *sync.WaitGroup, cfg *config.Config) *PollServer {
 	u := &websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
 	}
-	u.CheckOrigin = checkOrigin
-	return &PollServer{
-		upgrader:    u,
-		serverInbox: make(chan *message),
-		pool:        initPollWorkerPool(),
-		wg:          wg,
-		log:         zap.NewExample().Sugar().Named("pollserver"),
+	p := &PollServer{
+		cfg:          cfg.Server,
+		pollCfg:      cfg.Poll,
+		upgrader:     u,
+		serverInbox:  make(chan *message),
+		pool:         initPollWorkerPool(),
+		historyToken: cfg.Store.HistoryToken,
+		clock:        realClock{},
+		wg:           wg,
+		log:          zap.NewExample().Sugar().Named("pollserver"),
 	}
+	u.CheckOrigin = p.checkOrigin
+	// The config is validated, so the name is always known
+	p.strategy, _ = TallyStrategyByName(cfg.Poll.Strategy)
+	p.formatStrategies = make(map[string]TallyStrategy, len(cfg.Poll.FormatStrategies))
+	for format, name := range cfg.Poll.FormatStrategies {
+		p.formatStrategies[messages.ToID(format)], _ = TallyStrategyByName(name)
+	}
+	if cfg.Identity.Secret == "" {
+		p.log.Warn("no session secret is set, so voters will get new identities when the server restarts")
+	}
+	p.signer = identity.NewSigner([]byte(cfg.Identity.Secret), cfg.Identity.SessionTTL.Duration)
+	if cfg.Identity.Provider == config.ProviderStandIn {
+		p.provider = identity.StandInProvider{}
+	}
+	p.requireLogin = cfg.Identity.RequireLogin
+	return p
 }
 
-func checkOrigin(r *http.Request) bool {
-	for _, host := range AUTHORIZED_HOSTS {
+func (p *PollServer) checkOrigin(r *http.Request) bool {
+	for _, host := range p.cfg.AuthorizedHosts {
 		if r.Host == host {
 			return true
 		}
@@ -69,16 +95,94 @@ func checkOrigin(r *http.Request) bool {
 	return false
 }
 
-// Starts the server, then listens for messages as the manager.
-// Essentially, this is the manager loop.
-func (p *PollServer) StartServer() {
+// How long shutting down waits for voters' connections to close.
+const shutdownTimeout = 5 * time.Second
+
+// How long writing to a voter's websocket can take before they're disconnected.
+const voterWriteWait = 10 * time.Second
+
+// Starts the server, then runs the manager until ctx is done. Then polls with votes are
+// finished so their results can still be sent, voters are told the server is going away
+// and their websockets are closed.
+func (p *PollServer) StartServer(ctx context.Context) {
 	defer p.wg.Done()
-	http.HandleFunc("/ws", p.wsServerHandler)
-	http.Handle("/", http.StripPrefix("/", http.FileServer(http.Dir("./service/static"))))
-	go http.ListenAndServe(":8080", nil)
-	var po *Poll
+	defer p.log.Sync()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", p.wsServerHandler)
+	mux.HandleFunc("/rooms", p.roomsHandler)
+	mux.HandleFunc("/history", p.historyHandler)
+	mux.HandleFunc("/metrics", p.metricsHandler)
+	mux.HandleFunc("/auth/login", p.loginHandler)
+	mux.HandleFunc(identity.CallbackPath, p.callbackHandler)
+	if standIn, ok := p.provider.(identity.StandInProvider); ok {
+		mux.Handle("/auth/standin", standIn)
+	}
+	mux.Handle("/", http.StripPrefix("/", http.FileServer(http.Dir(p.cfg.StaticDir))))
+	srv := &http.Server{Addr: p.cfg.ListenAddr, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			p.log.Errorw("poll server stopped", zap.Error(err))
+		}
+	}()
+	p.manage(ctx)
+
+	p.log.Info("shutting down poll server")
+	// The showdown client sends the last results and stops once its inbox is closed
+	close(p.serverOutbox)
+	p.pool.Shutdown(&message{
+		Type: displayText,
+		Content: displayTextMessage{
+			Clear:   true,
+			Err:     false,
+			Message: "The server is shutting down. Please come back soon!",
+		},
+	})
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		p.log.Warnw("couldn't shut down http server cleanly", zap.Error(err))
+	}
+}
+
+// Handles messages from the showdown client and the workers until ctx is done.
+// Essentially, this is the manager loop. It sleeps until there's a message or a poll is
+// due to close, and after either checks whether any poll should close.
+func (p *PollServer) manage(ctx context.Context) {
+	// The open poll for each battle room
+	polls := make(map[string]*Poll)
+	// The latest battle timer reported for each room, and when it was reported
+	type timer struct{ deadline, at time.Time }
+	timers := make(map[string]timer)
+	// Fires when it's time to send voters new results
+	var refresh Timer
 	for {
+		var wake Timer
+		var due <-chan time.Time
+		if next, ok := nextDue(polls); ok {
+			wake = p.clock.NewTimer(next.Sub(p.clock.Now()))
+			due = wake.C()
+		}
+		if refresh == nil && len(polls) > 0 {
+			refresh = p.clock.NewTimer(p.pollCfg.ResultsInterval.Duration)
+		}
+		var refreshed <-chan time.Time
+		if refresh != nil {
+			refreshed = refresh.C()
+		}
 		select {
+		case <-ctx.Done():
+			if wake != nil {
+				wake.Stop()
+			}
+			if refresh != nil {
+				refresh.Stop()
+			}
+			p.drainPolls(polls)
+			return
+		case <-due:
+		case <-refreshed:
+			refresh = nil
+			p.pushResults(polls)
 		case msg := <-p.serverInbox:
 			switch msg.Type {
 			case showdownRequest:
@@ -89,6 +193,9 @@ func (p *PollServer) StartServer() {
 						zap.Any("content", msg.Content))
 					break
 				}
+				for _, w := range p.pool.OpenRoom(req.RoomID) {
+					p.sendBacklog(w)
+				}
 				if req.Req.Wait {
 					p.serverOutbox <- &message{
 						Type:    wait,
@@ -96,213 +203,348 @@ func (p *PollServer) StartServer() {
 					}
 					break
 				}
-				po = &Poll{
-					Req:       req.Req,
-					RoomID:    req.RoomID,
-					StartedAt: time.Now(),
-					EndsAt:    time.Now().Add(30 * time.Second),
-					Attack:    make([]int16, 4),
-					Switch:    make([]int16, 6),
+				po, ok := polls[req.RoomID]
+				if ok && po.Req.RQID == req.Req.RQID {
+					// The showdown client rejoined the room and got the same request again,
+					// so keep the votes that were already cast
+					p.log.Infow("resuming poll", zap.String("room", po.RoomID))
+				} else {
+					if ok {
+						// A new request replaced the old one before it finished
+						p.open.close(po)
+						p.storeEnd(po, "")
+					}
+					po = newPoll(req.RoomID, req.Req, p.clock.Now(), p.pollCfg.Duration.Duration)
+					po.Strategy = p.strategyFor(req.RoomID)
+					p.addDexInfo(po.Req)
+					p.addHints(po)
+					if t, ok := timers[req.RoomID]; ok && p.clock.Now().Sub(t.at) < timerGrace {
+						po.capAt(t.deadline.Add(-p.pollCfg.TimerMargin.Duration))
+					}
+					polls[req.RoomID] = po
+					p.open.set(po)
+					p.storeStart(po)
 				}
-				p.pool.Broadcast(&message{
-					Type: updateResponse,
-					Content: updateResponseMessage{
-						Results: false,
-						Update:  req,
-					},
-				})
+				p.pool.BroadcastRoom(po.RoomID, p.pollMessage(po))
 				p.log.Infow("started poll", zap.Any("poll", po))
-			}
-		case msg := <-p.pool.managerInbox:
-			switch msg.Type {
-			case vote:
-				if po == nil {
-					p.log.Warnw("received SendVote message but no poll was active")
+			case battleTimer:
+				t, ok := msg.Content.(battleTimerMessage)
+				if !ok {
+					p.log.Errorw("received request with unexpected payload",
+						zap.String("type", string(msg.Type)),
+						zap.Any("content", msg.Content))
 					break
 				}
-				v, ok := msg.Content.(*Vote)
-				if !ok {
-					p.log.Warnw("received SendVote message but data was not a vote", zap.Any("data", msg.Content))
+				if t.Deadline.IsZero() {
+					delete(timers, t.RoomID)
 					break
 				}
-				if v.Type == "move" {
-					if len(po.Req.ForceSwitch) > 0 && po.Req.ForceSwitch[0] {
-						p.log.Warnw("received vote to move when poll should force switch",
-							zap.String("id", v.From))
-						p.pool.SendToWorker(v.From, &message{
-							Type: clearVote,
-						})
-						break
-					}
-					if v.Idx > len(po.Attack) || v.Idx < 0 {
-						p.log.Warnw("received vote with index out of bounds",
-							zap.String("id", v.From))
-						p.pool.SendToWorker(v.From, &message{
-							Type: clearVote,
-						})
-						p.pool.SendToWorker(v.From, &message{
-							Type: displayText,
-							Content: displayTextMessage{
-								Clear:   false,
-								Err:     true,
-								Message: "Invalid selection",
-							},
-						})
-						break
-					}
-					if po.Req.Active[0].Moves[v.Idx].Disabled {
-						p.log.Warnw("received vote for disabled move",
-							zap.String("id", v.From))
-						p.pool.SendToWorker(v.From, &message{
-							Type: clearVote,
-						})
-						p.pool.SendToWorker(v.From, &message{
-							Type: displayText,
-							Content: displayTextMessage{
-								Clear:   false,
-								Err:     true,
-								Message: "Invalid selection",
-							},
-						})
-						break
-					}
-					po.Attack[v.Idx]++
-				} else {
-					if v.Idx > len(po.Switch) || v.Idx < 0 {
-						p.log.Warnw("received vote with index out of bounds",
-							zap.String("id", v.From))
-						p.pool.SendToWorker(v.From, &message{
-							Type: clearVote,
-						})
-						p.pool.SendToWorker(v.From, &message{
-							Type: displayText,
-							Content: displayTextMessage{
-								Clear:   false,
-								Err:     true,
-								Message: "Invalid selection",
-							},
-						})
-						break
-					}
-					if po.Req.Side.Pokemon[v.Idx].Condition == "0 fnt" {
-						p.log.Warnw("received vote for fainted pokemon",
-							zap.String("id", v.From))
-						p.pool.SendToWorker(v.From, &message{
-							Type: clearVote,
-						})
-						p.pool.SendToWorker(v.From, &message{
-							Type: displayText,
-							Content: displayTextMessage{
-								Clear:   false,
-								Err:     true,
-								Message: "Invalid selection",
-							},
-						})
-						break
-					}
-					po.Switch[v.Idx]++
+				timers[t.RoomID] = timer{deadline: t.Deadline, at: p.clock.Now()}
+				if po, ok := polls[t.RoomID]; ok {
+					po.capAt(t.Deadline.Add(-p.pollCfg.TimerMargin.Duration))
 				}
-				if v.Tera {
-					po.Tera++
+			case battleLog:
+				l, ok := msg.Content.(battleLogMessage)
+				if !ok {
+					p.log.Errorw("received request with unexpected payload",
+						zap.String("type", string(msg.Type)),
+						zap.Any("content", msg.Content))
+					break
 				}
-				po.Total++
-				p.pool.SendToWorker(v.From, &message{
-					Type: voteOk,
-				})
-			case updateRequest:
-				c, ok := msg.Content.(updateRequestMessage)
+				if l.Lines = p.logs.add(l.Room, l.Lines); len(l.Lines) > 0 {
+					p.pool.BroadcastRoom(l.Room, &message{Type: battleLog, Content: l})
+				}
+			case battleEnded:
+				room, ok := msg.Content.(string)
 				if !ok {
 					p.log.Errorw("received request with unexpected payload",
 						zap.String("type", string(msg.Type)),
 						zap.Any("content", msg.Content))
 					break
 				}
-				if po == nil {
-					p.pool.SendToWorker(c.From, &message{
-						Type: displayText,
-						Content: displayTextMessage{
-							Clear:   true,
-							Err:     false,
-							Message: "Please wait...",
-						},
-					})
-				} else if !c.Voted {
-					p.pool.SendToWorker(c.From, &message{
-						Type: updateResponse,
-						Content: updateResponseMessage{
-							Results: false,
-							Update:  po.Req,
-						},
-					})
-				} else {
-					if len(po.Req.Active) > 0 {
-						for i, a := range po.Req.Active[0].Moves {
-							a.Votes = float32(po.Attack[i]) / float32(po.Total)
-						}
-						po.Req.Active[0].TeraVotes = float32(po.Tera) / float32(po.Total)
-					}
-					for i, a := range po.Req.Side.Pokemon {
-						a.Votes = float32(po.Switch[i]) / float32(po.Total)
-					}
-					p.pool.SendToWorker(c.From, &message{
-						Type: updateResponse,
-						Content: updateResponseMessage{
-							Results: true,
-							Update:  po.Req,
-						},
-					})
+				p.logs.remove(room)
+				if po, ok := polls[room]; ok {
+					p.open.close(po)
+					p.storeEnd(po, "")
+					delete(polls, room)
 				}
+				delete(timers, room)
+				p.pool.BroadcastRoom(room, &message{
+					Type:    clearVote,
+					Content: "",
+				})
+				p.pool.BroadcastRoom(room, &message{
+					Type: displayText,
+					Content: displayTextMessage{
+						Clear:   true,
+						Err:     false,
+						Message: "The battle is over. Please wait...",
+					},
+				})
+				for _, w := range p.pool.CloseRoom(room) {
+					p.answerUpdate(w, false)
+					p.sendBacklog(w)
+				}
+				p.log.Infow("closed battle room", zap.String("room", room))
 			}
-		default:
-			if po == nil || time.Now().Before(po.EndsAt) {
-				break
-			}
-			p.pool.Broadcast(&message{
+		case <-p.pool.managerInbox:
+			// Votes came in or a voter left, so polls may close early
+		}
+		if wake != nil {
+			wake.Stop()
+		}
+		p.checkPolls(polls)
+	}
+}
+
+// Finishes the polls that have votes so the crowd's choices aren't lost. Polls without
+// votes are left alone, so they can start over when the battle is rejoined.
+func (p *PollServer) drainPolls(polls map[string]*Poll) {
+	for room, po := range polls {
+		p.open.close(po)
+		if po.tally().Total > 0 {
+			p.finishPoll(po)
+		} else {
+			p.storeEnd(po, "")
+		}
+		delete(polls, room)
+	}
+}
+
+// Returns when the next poll is due to close.
+func nextDue(polls map[string]*Poll) (time.Time, bool) {
+	var next time.Time
+	for _, po := range polls {
+		if next.IsZero() || po.EndsAt.Before(next) {
+			next = po.EndsAt
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// Finishes the polls that should close, and tells voters about polls that were extended.
+func (p *PollServer) checkPolls(polls map[string]*Poll) {
+	now := p.clock.Now()
+	for room, po := range polls {
+		closes, extended := po.closes(p.pollCfg, p.pool.Voters(room), now)
+		if extended {
+			p.pool.BroadcastRoom(room, &message{
 				Type: displayText,
 				Content: displayTextMessage{
-					Clear:   true,
+					Clear:   false,
 					Err:     false,
-					Message: "Please wait...",
+					Message: fmt.Sprintf("It's a tie! Voting is open for %s more.", po.EndsAt.Sub(now).Round(time.Second)),
 				},
 			})
-			winnerT := "move"
-			winnerId := 0
-			winnerCt := int16(-1)
-			tera := ""
-
-			if len(po.Req.ForceSwitch) == 0 && len(po.Req.Active) > 0 {
-				for i, ct := range po.Attack {
-					if ct > winnerCt && !po.Req.Active[0].Moves[i].Disabled {
-						winnerId = i
-						winnerCt = ct
-					}
-				}
-			}
-			for i, ct := range po.Switch {
-				if ct > winnerCt && po.Req.Side.Pokemon[i].Condition != "0 fnt" {
-					winnerT = "switch"
-					winnerId = i
-					winnerCt = ct
-				}
-			}
-			if winnerT == "move" && po.Tera*2 > po.Total {
-				tera = " terastallize"
-			}
-			p.serverOutbox <- &message{
-				Type: results,
-				Content: pollResults{
-					RoomID:  po.RoomID,
-					RQID:    po.Req.RQID,
-					Command: fmt.Sprintf("/choose %s %d%s", winnerT, winnerId+1, tera),
-				},
+		}
+		if !closes {
+			continue
+		}
+		p.finishPoll(po)
+		delete(polls, room)
+	}
+}
+
+// Sends the poll's winning command to the showdown client and resets the room's voters.
+func (p *PollServer) finishPoll(po *Poll) {
+	p.open.close(po)
+	command := po.command()
+	p.recordPoll(po, command)
+	p.storeEnd(po, command)
+	p.pool.BroadcastRoom(po.RoomID, &message{
+		Type: displayText,
+		Content: displayTextMessage{
+			Clear:   true,
+			Err:     false,
+			Message: "Please wait...",
+		},
+	})
+	p.serverOutbox <- &message{
+		Type: results,
+		Content: pollResults{
+			RoomID:  po.RoomID,
+			RQID:    po.Req.RQID,
+			Command: command,
+		},
+	}
+	p.pool.BroadcastRoom(po.RoomID, &message{
+		Type:    clearVote,
+		Content: "",
+	})
+}
+
+// Records how the poll ended, so the crowd's decisions can be looked back on.
+func (p *PollServer) recordPoll(po *Poll, command string) {
+	if p.recorder == nil {
+		return
+	}
+	t := po.tally()
+	var tallies interface{} = t.Slots
+	if po.Req.TeamPreview {
+		tallies = t.Team
+	}
+	bs, err := json.Marshal(tallies)
+	if err != nil {
+		p.log.Errorw("couldn't marshal poll tallies", zap.Error(err))
+		return
+	}
+	p.recorder.Poll(po.RoomID, replay.PollRecord{
+		RQID:    int(po.Req.RQID),
+		Votes:   int(t.Total),
+		Tallies: bs,
+		Command: command,
+	})
+}
+
+// Saves a new poll to the history store.
+func (p *PollServer) storeStart(po *Poll) {
+	if p.store == nil {
+		return
+	}
+	req, err := json.Marshal(po.Req)
+	if err != nil {
+		p.log.Errorw("couldn't marshal poll request", zap.Error(err))
+		return
+	}
+	err = p.store.StartPoll(&store.Poll{
+		ID:        po.ID,
+		RoomID:    po.RoomID,
+		RQID:      int(po.Req.RQID),
+		Request:   req,
+		Strategy:  po.Strategy.Name(),
+		StartedAt: po.StartedAt,
+	})
+	if err != nil {
+		p.log.Errorw("couldn't store poll", zap.String("poll", po.ID), zap.Error(err))
+	}
+}
+
+// Saves a vote to the history store, along with why it was rejected if it was.
+func (p *PollServer) storeVote(po *Poll, v *Vote, rejected error) {
+	if p.store == nil {
+		return
+	}
+	ballot, err := json.Marshal(v)
+	if err != nil {
+		p.log.Errorw("couldn't marshal vote", zap.Error(err))
+		return
+	}
+	sv := &store.Vote{
+		PollID: po.ID,
+		Voter:  v.Voter,
+		At:     p.clock.Now(),
+		Ballot: ballot,
+	}
+	if rejected != nil {
+		sv.Error = rejected.Error()
+	}
+	if err := p.store.AddVote(sv); err != nil {
+		p.log.Errorw("couldn't store vote", zap.String("poll", po.ID), zap.Error(err))
+	}
+}
+
+// Saves a retracted vote to the history store.
+func (p *PollServer) storeRetraction(po *Poll, r retraction) {
+	if p.store == nil {
+		return
+	}
+	ballot, _ := json.Marshal(map[string]int{"slot": r.Slot})
+	err := p.store.AddVote(&store.Vote{
+		PollID:  po.ID,
+		Voter:   r.Voter,
+		At:      p.clock.Now(),
+		Ballot:  ballot,
+		Retract: true,
+	})
+	if err != nil {
+		p.log.Errorw("couldn't store retraction", zap.String("poll", po.ID), zap.Error(err))
+	}
+}
+
+// Marks a poll as over in the history store. command is empty if the poll never finished.
+func (p *PollServer) storeEnd(po *Poll, command string) {
+	if p.store == nil {
+		return
+	}
+	if err := p.store.EndPoll(po.ID, p.clock.Now(), command); err != nil {
+		p.log.Errorw("couldn't store end of poll", zap.String("poll", po.ID), zap.Error(err))
+	}
+}
+
+// How many polls /history returns at once by default, and at most.
+const (
+	historyPageSize    = 50
+	maxHistoryPageSize = 500
+)
+
+// Lists a page of the polls run in a room, or every room if none is given, with all of
+// their votes. Callers need the history token, since votes say who cast them.
+func (p *PollServer) historyHandler(w http.ResponseWriter, r *http.Request) {
+	if p.store == nil || p.historyToken == "" {
+		http.Error(w, "poll history isn't available", http.StatusNotFound)
+		return
+	}
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(p.historyToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "a valid history token is needed", http.StatusUnauthorized)
+		return
+	}
+	q := store.Query{RoomID: r.URL.Query().Get("room"), Limit: historyPageSize}
+	for name, v := range map[string]*int{"offset": &q.Offset, "limit": &q.Limit} {
+		if s := r.URL.Query().Get(name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				http.Error(w, fmt.Sprintf("%s must be a number of polls", name), http.StatusBadRequest)
+				return
 			}
-			po = nil
-			p.pool.Broadcast(&message{
-				Type:    clearVote,
-				Content: "",
-			})
+			*v = n
 		}
 	}
+	if q.Limit == 0 || q.Limit > maxHistoryPageSize {
+		q.Limit = maxHistoryPageSize
+	}
+	polls, err := p.store.Polls(q)
+	if err != nil {
+		p.log.Errorw("couldn't read poll history", zap.Error(err))
+		http.Error(w, "couldn't read poll history", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(polls)
+}
+
+// Lists the open battle rooms and how many voters are in each, so clients can pick one
+// to join with /ws?room=ROOM.
+func (p *PollServer) roomsHandler(w http.ResponseWriter, r *http.Request) {
+	type roomInfo struct {
+		Room   string `json:"room"`
+		Voters int    `json:"voters"`
+	}
+	counts := p.pool.Rooms()
+	rooms := make([]roomInfo, 0, len(counts))
+	for _, room := range sortedKeys(counts) {
+		rooms = append(rooms, roomInfo{Room: room, Voters: counts[room]})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rooms)
+}
+
+// Reports how messages to voters are being delivered, in the Prometheus text format.
+func (p *PollServer) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := p.pool.Stats()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP msb_voter_messages_total Messages sent to voters, by what happened to them.")
+	fmt.Fprintln(w, "# TYPE msb_voter_messages_total counter")
+	fmt.Fprintf(w, "msb_voter_messages_total{result=\"queued\"} %d\n", stats.Queued.Load())
+	fmt.Fprintf(w, "msb_voter_messages_total{result=\"coalesced\"} %d\n", stats.Coalesced.Load())
+	fmt.Fprintf(w, "msb_voter_messages_total{result=\"dropped\"} %d\n", stats.Dropped.Load())
+	fmt.Fprintln(w, "# HELP msb_voters_evicted_total Voters disconnected for falling too far behind.")
+	fmt.Fprintln(w, "# TYPE msb_voters_evicted_total counter")
+	fmt.Fprintf(w, "msb_voters_evicted_total %d\n", stats.Evicted.Load())
+	fmt.Fprintln(w, "# HELP msb_voters Voters connected.")
+	fmt.Fprintln(w, "# TYPE msb_voters gauge")
+	fmt.Fprintf(w, "msb_voters %d\n", p.pool.Size())
 }
 
 func (p *PollServer) GetRecvChan() chan *message {
@@ -313,12 +555,58 @@ func (p *PollServer) SetSendChan(send chan *message) {
 	p.serverOutbox = send
 }
 
+// Keeps the history of every poll and vote in s.
+func (p *PollServer) SetStore(s store.Store) {
+	p.store = s
+}
+
+// Records how each poll ends. A nil recorder records nothing.
+func (p *PollServer) SetRecorder(r *replay.Recorder) {
+	p.recorder = r
+}
+
+// Sets the tracker used to attach battle state to the polls sent to voters.
+func (p *PollServer) SetBattleTracker(t *battle.Tracker) {
+	p.battles = t
+}
+
+// Sets the data polls describe moves and Pokémon with and estimate damage from. Without it
+// they're sent as Showdown gives them.
+func (p *PollServer) SetDex(d *dex.Dex) {
+	p.dex = d
+}
+
+// Returns the current state of the room's battle, or nil if it isn't known.
+func (p *PollServer) battleSnapshot(roomID string) *battle.State {
+	if p.battles == nil {
+		return nil
+	}
+	return p.battles.Snapshot(roomID)
+}
+
+// Returns the poll's battle as our side sees it, or nil if it isn't being tracked.
+func (p *PollServer) battleView(po *Poll) *battle.View {
+	s := p.battleSnapshot(po.RoomID)
+	if s == nil {
+		return nil
+	}
+	v := s.View(po.Req.Side.ID)
+	p.addTypes(v)
+	return v
+}
+
 // The websocket handler stores its information and sends/receives through a worker.
 // Essentially, this is the poll worker loop.
 func (p *PollServer) wsServerHandler(w http.ResponseWriter, r *http.Request) {
-	ws, err := p.upgrader.Upgrade(w, r, nil)
-	worker := p.pool.NewWorker()
-	errct := 0
+	// Voters keep their identity across reloads and reconnects, so new tabs don't get
+	// new votes. First time voters are given an anonymous one.
+	sess := p.session(r)
+	header := http.Header{}
+	if sess == nil {
+		sess = p.signer.Anonymous()
+		header.Add("Set-Cookie", p.sessionCookie(sess).String())
+	}
+	ws, err := p.upgrader.Upgrade(w, r, header)
 	if err != nil {
 		p.log.Error("error upgrading to websocket connection",
 			zap.Error(err),
@@ -327,7 +615,19 @@ func (p *PollServer) wsServerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer ws.Close()
+	if !p.greet(ws) {
+		return
+	}
+	// Clients can pick a battle to vote in, otherwise they're assigned one
+	worker := p.pool.NewWorker(r.URL.Query().Get("room"), sess)
+	errct := 0
+	// Bad messages in a row, which end the connection once there are too many
+	bad := 0
 	wsChan := make(chan interface{})
+	// Closed when the handler returns, so the reader doesn't wait forever to hand over
+	// what it read last
+	done := make(chan struct{})
+	defer close(done)
 	go func() {
 		for {
 			t, bytes, err := ws.ReadMessage()
@@ -335,161 +635,206 @@ func (p *PollServer) wsServerHandler(w http.ResponseWriter, r *http.Request) {
 				close(wsChan)
 				return
 			}
+			var msg interface{} = bytes
 			if err != nil {
-				errct++
-				wsChan <- err
-			} else {
-				errct = 0
-				wsChan <- bytes
+				msg = err
+			}
+			select {
+			case wsChan <- msg:
+			case <-done:
+				return
 			}
 		}
 	}()
 
-	p.pool.managerInbox <- &message{
-		Type: updateRequest,
-		Content: updateRequestMessage{
-			From:  worker.id,
-			Voted: false,
-		},
-	}
+	p.answerUpdate(worker, false)
+	p.sendBacklog(worker)
+	// The results and battle log lines this voter was last sent, so they can be sent just
+	// what's new
+	var shown shownResults
+	var logged shownLog
 	for {
 		select {
-		case msg := <-worker.inbox:
-			switch msg.Type {
-			case voteOk:
-				fallthrough
-			case displayText:
-				fallthrough
-			case updateResponse:
-				ws.WriteJSON(msg)
-			case clearVote:
-				worker.voted = false
+		case <-worker.ready:
+			msgs, closed := worker.take()
+			for _, msg := range msgs {
+				switch msg.Type {
+				case clearVote:
+					if slot, ok := msg.Content.(int); ok {
+						delete(worker.voted, slot)
+					} else {
+						clear(worker.voted)
+					}
+					continue
+				case resultsDelta:
+					d, ok := msg.Content.(resultsDeltaMessage)
+					if !ok {
+						continue
+					}
+					if msg, shown = p.resultsFor(worker, shown, d); msg == nil {
+						continue
+					}
+				case battleLog:
+					l, ok := msg.Content.(battleLogMessage)
+					if !ok {
+						continue
+					}
+					if l.Lines, logged = logged.unseen(l); len(l.Lines) == 0 {
+						continue
+					}
+					msg = &message{Type: battleLog, Content: l}
+				case updateResponse:
+					if u, ok := msg.Content.(updateResponseMessage); ok {
+						shown = shownResults{}
+						if u.Results {
+							shown = shownResults{u.Poll, u.Version}
+						}
+					}
+				case voteOk, displayText, protocolError:
+				default:
+					continue
+				}
+				ws.SetWriteDeadline(time.Now().Add(voterWriteWait))
+				if err := ws.WriteJSON(msg); err != nil {
+					p.log.Warnw("terminating worker because its websocket couldn't be written to",
+						zap.String("worker_id", worker.id),
+						zap.Error(err))
+					p.pool.KillWorker(worker.id)
+					p.wakeManager(workerLeft)
+					return
+				}
+			}
+			if closed {
+				// The pool was shut down, or the voter fell too far behind
+				p.log.Infow("disconnecting worker",
+					zap.String("worker_id", worker.id),
+					zap.String("reason", worker.closeText))
+				ws.SetWriteDeadline(time.Now().Add(voterWriteWait))
+				ws.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(worker.closeCode, worker.closeText))
+				return
 			}
 		case msg := <-wsChan:
 			if msg == nil {
 				p.log.Infow("terminating worker because websocket was closed",
 					zap.String("worker_id", worker.id))
 				p.pool.KillWorker(worker.id)
+				p.wakeManager(workerLeft)
 				return
 			}
 			if err, ok := msg.(error); ok {
 				p.log.Errorw("error reading from websocket",
 					zap.String("worker_id", worker.id),
 					zap.Error(err))
+				errct++
 				if errct > 5 {
 					p.log.Errorw("terminating worker because there were too many errors",
 						zap.String("worker_id", worker.id))
 					p.pool.KillWorker(worker.id)
+					p.wakeManager(workerLeft)
 					return
 				}
 				break
 			}
+			errct = 0
 			bytes := msg.([]byte)
 			p.log.Infow("received from worker websocket",
 				zap.String("worker_id", worker.id),
 				zap.ByteString("bytes", bytes))
-			m := &message{}
-			err = json.Unmarshal(bytes, m)
-			if err != nil {
-				p.log.Errorf("couldn't unmarshal message json", zap.Error(err))
-				break
+			typ, content, perr := decodeClientMessage(bytes)
+			if perr == nil && typ == hello {
+				perr = &errorMessage{Code: errCodeOutOfOrder, Type: typ, Message: "already said hello"}
 			}
-			switch m.Type {
-			case vote:
-				if worker.voted {
-					p.log.Infow("received a vote from a client who already voted",
+			if perr != nil {
+				p.log.Warnw("received bad message from worker",
+					zap.String("worker_id", worker.id),
+					zap.Error(perr))
+				bad++
+				if bad >= maxBadMessages {
+					p.log.Warnw("terminating worker because it sent too many bad messages",
 						zap.String("worker_id", worker.id))
-					break
+					p.pool.KillWorker(worker.id)
+					p.wakeManager(workerLeft)
+					closeWithError(ws, perr, websocket.CloseProtocolError)
+					return
 				}
-				content, ok := m.Content.(map[string]interface{})
-				if !ok {
-					p.log.Errorw("received request with unexpected payload (expected Vote)",
-						zap.String("type", string(m.Type)),
-						zap.Any("content", m.Content))
+				writeProtocolError(ws, perr)
+				break
+			}
+			bad = 0
+			switch typ {
+			case vote:
+				if p.requireLogin && !worker.loggedIn {
+					writeProtocolError(ws, &errorMessage{Code: errCodeLoginRequired, Type: vote, Message: "log in to vote"})
 					break
 				}
-				v := &Vote{
-					From: worker.id,
-					Type: content["type"].(string),
-					Idx:  int(content["idx"].(float64)),
-					Tera: content["tera"].(bool),
+				v := content.(*voteRequest).vote(worker.id, worker.voter)
+				if worker.voted[v.Slot] {
+					p.log.Infow("changing vote",
+						zap.String("worker_id", worker.id),
+						zap.Int("slot", v.Slot))
 				}
 				p.log.Infow("voted", zap.Any("vote", v))
-				p.pool.managerInbox <- &message{
-					Type:    vote,
-					Content: v,
-				}
-				worker.voted = true
+				p.castVote(v)
+				worker.voted[v.Slot] = true
+			case retractVote:
+				p.retract(retraction{
+					From:  worker.id,
+					Voter: worker.voter,
+					Slot:  content.(*retractRequest).Slot,
+				})
 			case updateRequest:
-				p.pool.managerInbox <- &message{
-					Type: updateRequest,
-					Content: updateRequestMessage{
-						From:  worker.id,
-						Voted: worker.voted,
-					},
-				}
+				p.answerUpdate(worker, len(worker.voted) > 0)
 			}
 		}
 	}
 }
 
-// Initializes a poll worker pool.
-func initPollWorkerPool() *pollWorkerPool {
-	return &pollWorkerPool{
-		managerInbox: make(chan *message, 40),
-		workers:      make(map[string]*pollWorker, 40),
+// Waits for the client to say hello and welcomes it with the protocol version to speak.
+// Clients that don't say hello in time, or don't speak a version the server does, are sent
+// an error and disconnected.
+func (p *PollServer) greet(ws *websocket.Conn) bool {
+	ws.SetReadDeadline(time.Now().Add(helloWait))
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		p.log.Infow("client left before saying hello", zap.Error(err))
+		return false
 	}
-}
-
-// Creates a worker for the pool and returns the newly created worker.
-func (wp *pollWorkerPool) NewWorker() *pollWorker {
-	id := ksuid.New().String()
-	w := &pollWorker{
-		id:    id,
-		inbox: make(chan *message, 3),
-	}
-	wp.Lock()
-	wp.workers[id] = w
-	wp.Unlock()
-	return w
-}
-
-// Sends a message to all workers in the pool.
-func (wp *pollWorkerPool) Broadcast(msg *message) {
-	wp.Lock()
-	for _, w := range wp.workers {
-		w.inbox <- msg
+	ws.SetReadDeadline(time.Time{})
+	typ, content, perr := decodeClientMessage(data)
+	if perr == nil && typ != hello {
+		perr = &errorMessage{Code: errCodeOutOfOrder, Type: typ, Message: "say hello first"}
 	}
-	wp.Unlock()
-}
-
-// Sends a message to the specified worker.
-func (wp *pollWorkerPool) SendToWorker(id string, msg *message) {
-	wp.Lock()
-	wp.workers[id].inbox <- msg
-	wp.Unlock()
+	var version int
+	if perr == nil {
+		var ok bool
+		if version, ok = negotiateVersion(content.(*helloMessage).Versions); !ok {
+			perr = &errorMessage{
+				Code:    errCodeUnsupportedVersion,
+				Type:    hello,
+				Message: fmt.Sprintf("the server speaks versions %d to %d", minProtocolVersion, protocolVersion),
+			}
+		}
+	}
+	if perr != nil {
+		p.log.Infow("rejected client's hello", zap.Error(perr))
+		closeWithError(ws, perr, websocket.CloseProtocolError)
+		return false
+	}
+	p.log.Infow("welcomed client", zap.Int("protocol", version))
+	ws.SetWriteDeadline(time.Now().Add(voterWriteWait))
+	return ws.WriteJSON(&message{Type: welcome, Content: welcomeMessage{Version: version}}) == nil
 }
 
-// Deletes a single worker from the pool.
-func (wp *pollWorkerPool) KillWorker(id string) {
-	wp.Lock()
-	delete(wp.workers, id)
-	wp.Unlock()
+func writeProtocolError(ws *websocket.Conn, e *errorMessage) error {
+	ws.SetWriteDeadline(time.Now().Add(voterWriteWait))
+	return ws.WriteJSON(&message{Type: protocolError, Content: e})
 }
 
-// Closes all channels for all workers in the pool.
-func (wp *pollWorkerPool) Shutdown(msg *message) {
-	wp.Lock()
-	for _, w := range wp.workers {
-		close(w.inbox)
+// Sends the error and then closes the connection with the code.
+func closeWithError(ws *websocket.Conn, e *errorMessage, code int) {
+	if writeProtocolError(ws, e) != nil {
+		return
 	}
-	wp.Unlock()
-}
-
-func (wp *pollWorkerPool) WorkerHasVoted(id string) bool {
-	var voted bool
-	wp.Lock()
-	voted = wp.workers[id].voted
-	wp.Unlock()
-	return voted
+	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, e.Code))
 }
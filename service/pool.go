@@ -0,0 +1,352 @@
+package service
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"github.com/segmentio/ksuid"
+	"surrealchemist.com/mass-showdown-backend/identity"
+)
+
+// How many messages a worker can fall behind by before it's disconnected. Sending to
+// workers never waits, so one stalled browser can't hold up every other voter.
+const maxQueuedMessages = 16
+
+type pollWorker struct {
+	id string
+	// The identity the worker's votes are counted against. Every connection from the same
+	// voter shares it.
+	voter string
+	// Whether the voter logged in rather than being anonymous.
+	loggedIn bool
+	// The battle room the worker votes in, or "" until one is assigned.
+	// Only read or written with the pool locked.
+	room string
+	// The slots this worker has voted for in the current poll.
+	voted map[int]bool
+
+	mu sync.Mutex
+	// Messages waiting to be sent to the voter.
+	queue []*message
+	// Signalled whenever there's something in the queue or the worker is disconnected.
+	ready chan struct{}
+	// Set once the worker is disconnected, with the close frame to send the voter.
+	closed    bool
+	closeCode int
+	closeText string
+}
+
+// Queues a message for the voter. A newer update replaces one that hasn't been sent yet,
+// since voters only need the latest state. The stale update is dropped and the new one
+// goes to the back of the queue, so it still arrives after anything queued before it, like
+// a clearVote. Returns false if the worker is too far behind to take it.
+func (w *pollWorker) push(msg *message, stats *broadcastStats) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		stats.Dropped.Add(1)
+		return true
+	}
+	if msg.Type == updateResponse {
+		for i, queued := range w.queue {
+			if queued.Type == updateResponse {
+				w.queue = append(w.queue[:i], w.queue[i+1:]...)
+				w.queue = append(w.queue, msg)
+				stats.Coalesced.Add(1)
+				return true
+			}
+		}
+	}
+	if len(w.queue) >= maxQueuedMessages {
+		return false
+	}
+	w.queue = append(w.queue, msg)
+	stats.Queued.Add(1)
+	w.signal()
+	return true
+}
+
+// Takes every queued message. closed is set once the worker was disconnected and
+// nothing else will be queued.
+func (w *pollWorker) take() (msgs []*message, closed bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	msgs, w.queue = w.queue, nil
+	return msgs, w.closed
+}
+
+// Disconnects the worker. Queued messages are still sent unless discard is set, in which
+// case they're counted as dropped.
+func (w *pollWorker) close(code int, text string, discard bool, stats *broadcastStats) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	if discard {
+		stats.Dropped.Add(uint64(len(w.queue)))
+		w.queue = nil
+	}
+	w.closed, w.closeCode, w.closeText = true, code, text
+	w.signal()
+}
+
+// Must be called with the worker locked.
+func (w *pollWorker) signal() {
+	select {
+	case w.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Counts what happens to messages sent to workers.
+type broadcastStats struct {
+	// Messages added to a worker's queue.
+	Queued atomic.Uint64
+	// Updates that replaced one that was still queued.
+	Coalesced atomic.Uint64
+	// Messages that were never sent, because their worker was disconnected.
+	Dropped atomic.Uint64
+	// Workers disconnected for falling too far behind.
+	Evicted atomic.Uint64
+}
+
+type pollWorkerPool struct {
+	sync.Mutex
+	managerInbox chan *message
+	workers      map[string]*pollWorker
+	// Battle rooms that are open for voting.
+	rooms map[string]bool
+	// Set once the pool is shut down.
+	closed bool
+	stats  broadcastStats
+}
+
+// Initializes a poll worker pool.
+func initPollWorkerPool() *pollWorkerPool {
+	return &pollWorkerPool{
+		managerInbox: make(chan *message, 40),
+		workers:      make(map[string]*pollWorker, 40),
+		rooms:        make(map[string]bool),
+	}
+}
+
+// Creates a worker for the pool and returns the newly created worker.
+// The worker votes in the given room if it's open, otherwise in the open room with the
+// fewest voters, or is assigned one once a room opens.
+func (wp *pollWorkerPool) NewWorker(room string, sess *identity.Session) *pollWorker {
+	id := ksuid.New().String()
+	w := &pollWorker{
+		id:       id,
+		voter:    sess.VoterID,
+		loggedIn: sess.LoggedIn(),
+		voted:    make(map[int]bool),
+		ready:    make(chan struct{}, 1),
+	}
+	wp.Lock()
+	if wp.rooms[room] {
+		w.room = room
+	} else {
+		w.room = wp.leastLoadedRoom()
+	}
+	if wp.closed {
+		// Too late to vote, so the worker disconnects straight away
+		w.close(websocket.CloseGoingAway, "server shutting down", false, &wp.stats)
+	} else {
+		wp.workers[id] = w
+	}
+	wp.Unlock()
+	return w
+}
+
+// Sends a message to all workers in the pool.
+func (wp *pollWorkerPool) Broadcast(msg *message) {
+	wp.Lock()
+	for _, w := range wp.workers {
+		wp.send(w, msg)
+	}
+	wp.Unlock()
+}
+
+// Sends a message to all workers voting in the room.
+func (wp *pollWorkerPool) BroadcastRoom(room string, msg *message) {
+	wp.Lock()
+	for _, w := range wp.workers {
+		if w.room == room {
+			wp.send(w, msg)
+		}
+	}
+	wp.Unlock()
+}
+
+// Sends a message to the workers in the room whose voters have voted.
+func (wp *pollWorkerPool) BroadcastVoted(room string, voted func(voter string) bool, msg *message) {
+	wp.Lock()
+	for _, w := range wp.workers {
+		if w.room == room && voted(w.voter) {
+			wp.send(w, msg)
+		}
+	}
+	wp.Unlock()
+}
+
+// Sends a message to the specified worker.
+func (wp *pollWorkerPool) SendToWorker(id string, msg *message) {
+	wp.Lock()
+	if w, ok := wp.workers[id]; ok {
+		wp.send(w, msg)
+	}
+	wp.Unlock()
+}
+
+// Queues the message for the worker, evicting the worker if it's fallen too far behind.
+// Must be called with the pool locked.
+func (wp *pollWorkerPool) send(w *pollWorker, msg *message) {
+	if wp.closed || w.push(msg, &wp.stats) {
+		return
+	}
+	wp.stats.Dropped.Add(1)
+	wp.stats.Evicted.Add(1)
+	delete(wp.workers, w.id)
+	w.close(websocket.CloseTryAgainLater, "too far behind", true, &wp.stats)
+}
+
+// Returns the pool's broadcast counters.
+func (wp *pollWorkerPool) Stats() *broadcastStats {
+	return &wp.stats
+}
+
+// Returns how many workers are connected.
+func (wp *pollWorkerPool) Size() int {
+	wp.Lock()
+	defer wp.Unlock()
+	return len(wp.workers)
+}
+
+// Deletes a single worker from the pool.
+func (wp *pollWorkerPool) KillWorker(id string) {
+	wp.Lock()
+	delete(wp.workers, id)
+	wp.Unlock()
+}
+
+// Sends a last message to every worker, then disconnects them all. Nothing can be sent to
+// workers afterwards.
+func (wp *pollWorkerPool) Shutdown(msg *message) {
+	wp.Lock()
+	for _, w := range wp.workers {
+		if msg != nil {
+			// Workers that are too far behind to take it just get disconnected
+			w.push(msg, &wp.stats)
+		}
+		w.close(websocket.CloseGoingAway, "server shutting down", false, &wp.stats)
+	}
+	wp.closed = true
+	wp.Unlock()
+}
+
+// Opens a battle room for voting. Workers that were waiting for a room are assigned this
+// one and returned, so they can be caught up on it.
+func (wp *pollWorkerPool) OpenRoom(room string) []*pollWorker {
+	wp.Lock()
+	defer wp.Unlock()
+	wp.rooms[room] = true
+	var assigned []*pollWorker
+	for _, w := range wp.workers {
+		if w.room == "" {
+			w.room = room
+			assigned = append(assigned, w)
+		}
+	}
+	return assigned
+}
+
+// Closes a battle room. Its workers are moved to the open rooms with the fewest voters,
+// or unassigned until a room opens if there are none. Returns the workers that were moved
+// to another room, which need to be sent what's happening there.
+func (wp *pollWorkerPool) CloseRoom(room string) []*pollWorker {
+	wp.Lock()
+	defer wp.Unlock()
+	delete(wp.rooms, room)
+	var moved []*pollWorker
+	for _, id := range sortedKeys(wp.workers) {
+		w := wp.workers[id]
+		if w.room != room {
+			continue
+		}
+		if w.room = wp.leastLoadedRoom(); w.room != "" {
+			moved = append(moved, w)
+		}
+	}
+	return moved
+}
+
+// Returns the room the worker votes in, or "" if there are no open rooms.
+func (wp *pollWorkerPool) RoomOf(id string) string {
+	wp.Lock()
+	defer wp.Unlock()
+	w, ok := wp.workers[id]
+	if !ok {
+		return ""
+	}
+	return w.room
+}
+
+// Must be called with the pool locked.
+func (wp *pollWorkerPool) leastLoadedRoom() string {
+	counts := wp.roomCounts()
+	best := ""
+	for _, room := range sortedKeys(counts) {
+		if best == "" || counts[room] < counts[best] {
+			best = room
+		}
+	}
+	return best
+}
+
+// Must be called with the pool locked.
+func (wp *pollWorkerPool) roomCounts() map[string]int {
+	counts := make(map[string]int, len(wp.rooms))
+	for room := range wp.rooms {
+		counts[room] = 0
+	}
+	for _, w := range wp.workers {
+		if wp.rooms[w.room] {
+			counts[w.room]++
+		}
+	}
+	return counts
+}
+
+// Returns every open room with the number of workers voting in it.
+func (wp *pollWorkerPool) Rooms() map[string]int {
+	wp.Lock()
+	defer wp.Unlock()
+	return wp.roomCounts()
+}
+
+// Returns the voters connected to the room. Voters with several connections are listed once.
+func (wp *pollWorkerPool) Voters(room string) []string {
+	wp.Lock()
+	defer wp.Unlock()
+	seen := make(map[string]bool)
+	var voters []string
+	for _, w := range wp.workers {
+		if w.room == room && !seen[w.voter] {
+			seen[w.voter] = true
+			voters = append(voters, w.voter)
+		}
+	}
+	return voters
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
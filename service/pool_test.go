@@ -0,0 +1,127 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"surrealchemist.com/mass-showdown-backend/identity"
+)
+
+func TestPoolAssignsLeastLoadedRoom(t *testing.T) {
+	wp := initPollWorkerPool()
+	anon := &identity.Session{VoterID: "anon:test"}
+	wp.OpenRoom("battle-a")
+	wp.OpenRoom("battle-b")
+	chosen := wp.NewWorker("battle-a", anon)
+	if room := wp.RoomOf(chosen.id); room != "battle-a" {
+		t.Errorf("Expected worker to keep its chosen room but got '%s'", room)
+	}
+	first := wp.NewWorker("", anon)
+	if room := wp.RoomOf(first.id); room != "battle-b" {
+		t.Errorf("Expected worker to be assigned the emptier room but got '%s'", room)
+	}
+	second := wp.NewWorker("", anon)
+	if room := wp.RoomOf(second.id); room != "battle-a" {
+		t.Errorf("Expected ties to go to the first room but got '%s'", room)
+	}
+
+	// Rooms that aren't open can't be picked
+	stale := wp.NewWorker("battle-z", anon)
+	if room := wp.RoomOf(stale.id); room != "battle-b" {
+		t.Errorf("Expected a worker asking for a closed room to be assigned one but got '%s'", room)
+	}
+
+	moved := wp.CloseRoom("battle-a")
+	if len(moved) != 2 {
+		t.Errorf("Expected both of battle-a's workers to be moved but got %d", len(moved))
+	}
+	if room := wp.RoomOf(chosen.id); room != "battle-b" {
+		t.Errorf("Expected worker to move rooms when its room closed but got '%s'", room)
+	}
+	if counts := wp.Rooms(); len(counts) != 1 || counts["battle-b"] != 4 {
+		t.Errorf("Expected all 4 workers in battle-b but got %v", counts)
+	}
+	if moved := wp.CloseRoom("battle-b"); len(moved) != 0 || wp.RoomOf(chosen.id) != "" {
+		t.Errorf("Expected workers to be unassigned with no rooms left but %d moved", len(moved))
+	}
+}
+
+func TestPoolShutdownDisconnectsWorkers(t *testing.T) {
+	wp := initPollWorkerPool()
+	anon := &identity.Session{VoterID: "anon:test"}
+	w := wp.NewWorker("battle-a", anon)
+	wp.Shutdown(&message{Type: displayText})
+	msgs, closed := w.take()
+	if len(msgs) != 1 || msgs[0].Type != displayText || !closed {
+		t.Errorf("Expected a last message before disconnecting but got %v, closed %v", msgs, closed)
+	}
+	// Broadcasting after shutdown does nothing, and new workers are disconnected straight away
+	wp.Broadcast(&message{Type: displayText})
+	if msgs, _ := w.take(); len(msgs) != 0 {
+		t.Errorf("Expected nothing to be sent after shutdown but got %v", msgs)
+	}
+	late := wp.NewWorker("battle-a", anon)
+	if _, closed := late.take(); !closed {
+		t.Error("Expected a worker created after shutdown to be closed")
+	}
+}
+
+func TestPoolEvictsSlowWorkers(t *testing.T) {
+	wp := initPollWorkerPool()
+	anon := &identity.Session{VoterID: "anon:test"}
+	wp.OpenRoom("battle-a")
+	slow := wp.NewWorker("battle-a", anon)
+	fast := wp.NewWorker("battle-a", anon)
+
+	// Updates to a voter who isn't keeping up replace each other
+	for i := 0; i < 100; i++ {
+		wp.BroadcastRoom("battle-a", &message{Type: updateResponse, Content: i})
+	}
+	msgs, _ := fast.take()
+	if len(msgs) != 1 || msgs[0].Content != 99 {
+		t.Fatalf("Expected only the latest update but got %v", msgs)
+	}
+	if n := wp.Stats().Coalesced.Load(); n != 198 {
+		t.Errorf("Expected 198 coalesced updates but got %d", n)
+	}
+
+	// Other messages pile up until the worker is disconnected, without blocking anyone else
+	for i := 0; i < maxQueuedMessages-1; i++ {
+		wp.BroadcastRoom("battle-a", &message{Type: displayText})
+		fast.take()
+	}
+	if slow.closed {
+		t.Fatal("Expected the slow worker to be connected while it has room")
+	}
+	wp.BroadcastRoom("battle-a", &message{Type: displayText})
+	msgs, closed := slow.take()
+	if !closed || slow.closeCode != websocket.CloseTryAgainLater || len(msgs) != 0 {
+		t.Errorf("Expected the slow worker to be evicted but got %d messages, closed %v", len(msgs), closed)
+	}
+	if _, closed := fast.take(); closed {
+		t.Error("Expected the fast worker to stay connected")
+	}
+	if voters := wp.Size(); voters != 1 {
+		t.Errorf("Expected 1 voter left but got %d", voters)
+	}
+	stats := wp.Stats()
+	if stats.Evicted.Load() != 1 || stats.Dropped.Load() != maxQueuedMessages+1 {
+		t.Errorf("Expected 1 eviction and %d drops but got %d and %d",
+			maxQueuedMessages+1, stats.Evicted.Load(), stats.Dropped.Load())
+	}
+}
+
+func TestPoolKeepsUpdatesInOrder(t *testing.T) {
+	wp := initPollWorkerPool()
+	wp.OpenRoom("battle-a")
+	w := wp.NewWorker("battle-a", &identity.Session{VoterID: "anon:test"})
+
+	// A newer update is still sent after messages queued since the one it replaces
+	wp.BroadcastRoom("battle-a", &message{Type: updateResponse, Content: 1})
+	wp.BroadcastRoom("battle-a", &message{Type: clearVote})
+	wp.BroadcastRoom("battle-a", &message{Type: updateResponse, Content: 2})
+	msgs, _ := w.take()
+	if len(msgs) != 2 || msgs[0].Type != clearVote || msgs[1].Content != 2 {
+		t.Errorf("Expected the clear and then the latest update but got %v", msgs)
+	}
+}
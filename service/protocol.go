@@ -0,0 +1,226 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+// Voters' clients talk to /ws in JSON messages with a type and content, the same as the
+// server's messages to them. Clients start by saying hello with the protocol versions
+// they speak, and the server welcomes them with the one it picked, or sends an error and
+// closes the connection if there isn't one in common.
+const (
+	// The newest protocol version the server speaks, and the oldest it still accepts.
+	protocolVersion    = 1
+	minProtocolVersion = 1
+	// How long clients have to say hello after connecting.
+	helloWait = 10 * time.Second
+	// Clients are disconnected after this many bad messages in a row.
+	maxBadMessages = 5
+)
+
+type helloMessage struct {
+	Versions []int `json:"versions"`
+}
+
+type welcomeMessage struct {
+	Version int `json:"version"`
+}
+
+// What clients are told when the server can't act on one of their messages.
+type errorMessage struct {
+	Code string `json:"code"`
+	// The type of the message at fault, if it got that far.
+	Type    messageType `json:"type,omitempty"`
+	Message string      `json:"message"`
+}
+
+func (e *errorMessage) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Error codes clients can act on.
+const (
+	// Not a JSON object with a type and content.
+	errCodeBadMessage  = "bad_message"
+	errCodeUnknownType = "unknown_type"
+	// The content doesn't fit the message's type.
+	errCodeBadContent = "bad_content"
+	// A hello that wasn't first, or something else that was.
+	errCodeOutOfOrder         = "out_of_order"
+	errCodeUnsupportedVersion = "unsupported_version"
+	// Votes that were understood but couldn't be counted. Most get the code for why the
+	// poll rejected them, from voteErrorCodes.
+	errCodeLoginRequired = "login_required"
+	errCodeNoPoll        = "no_poll"
+	errCodeInvalidVote   = "invalid_vote"
+)
+
+// The code for each reason a poll rejects a vote.
+var voteErrorCodes = map[error]string{
+	errSlotOutOfBounds:  "slot_out_of_bounds",
+	errSlotHasNoChoice:  "slot_has_no_choice",
+	errIdxOutOfBounds:   "idx_out_of_bounds",
+	errMoveOnSwitch:     "must_switch",
+	errDisabledMove:     "disabled_move",
+	errInvalidTarget:    "invalid_target",
+	errFaintedPokemon:   "fainted_pokemon",
+	errActivePokemon:    "active_pokemon",
+	errTrapped:          "trapped",
+	errUnknownVoteType:  "unknown_vote_type",
+	errNoPokemonForSlot: "no_pokemon_for_slot",
+	errNotTeamPreview:   "not_team_preview",
+	errTeamPreview:      "team_preview",
+	errInvalidOrder:     "invalid_order",
+	errDuplicateChoice:  "duplicate_choice",
+	errPollClosed:       "poll_closed",
+}
+
+// Describes why a vote was rejected for the voter's client.
+func voteError(err error) *errorMessage {
+	code, ok := voteErrorCodes[err]
+	if !ok {
+		code = errCodeInvalidVote
+	}
+	return &errorMessage{Code: code, Type: vote, Message: err.Error()}
+}
+
+// A vote as clients send it. Who it's from is filled in by the server.
+type voteRequest struct {
+	Slot   int      `json:"slot"`
+	Type   string   `json:"type"`
+	Idx    int      `json:"idx"`
+	Target int      `json:"target"`
+	Tera   bool     `json:"tera"`
+	Order  []int    `json:"order"`
+	Also   []Choice `json:"also"`
+}
+
+func (r *voteRequest) validate() error {
+	if !slices.Contains([]string{"move", "switch", "team"}, r.Type) {
+		return fmt.Errorf("type must be move, switch or team, not %q", r.Type)
+	}
+	for _, c := range r.Also {
+		if c.Type != "move" && c.Type != "switch" {
+			return fmt.Errorf("further choices must be moves or switches, not %q", c.Type)
+		}
+	}
+	return nil
+}
+
+func (r *voteRequest) vote(from, voter string) *Vote {
+	return &Vote{
+		From:   from,
+		Voter:  voter,
+		Slot:   r.Slot,
+		Type:   r.Type,
+		Idx:    r.Idx,
+		Target: r.Target,
+		Tera:   r.Tera,
+		Order:  r.Order,
+		Also:   r.Also,
+	}
+}
+
+// Takes back a vote. Clients voting in singles can leave the content out.
+type retractRequest struct {
+	Slot int `json:"slot"`
+}
+
+func (r *retractRequest) validate() error {
+	if r.Slot < 0 {
+		return errors.New("slot can't be negative")
+	}
+	return nil
+}
+
+func (h *helloMessage) validate() error {
+	if len(h.Versions) == 0 {
+		return errors.New("versions must list at least one protocol version")
+	}
+	return nil
+}
+
+type clientContent interface {
+	validate() error
+}
+
+// Decodes a message from a client into the content for its type, which is nil for
+// messages without any. Unknown fields and trailing data are errors, so clients find out
+// when they've drifted from the server.
+func decodeClientMessage(data []byte) (messageType, clientContent, *errorMessage) {
+	var env struct {
+		Type    messageType     `json:"type"`
+		Content json.RawMessage `json:"content"`
+	}
+	if err := decodeStrict(data, &env); err != nil || env.Type == "" {
+		if err == nil {
+			err = errors.New("missing type")
+		}
+		return "", nil, &errorMessage{Code: errCodeBadMessage, Message: err.Error()}
+	}
+	var content clientContent
+	optional := false
+	switch env.Type {
+	case hello:
+		content = &helloMessage{}
+	case vote:
+		content = &voteRequest{}
+	case retractVote:
+		content, optional = &retractRequest{}, true
+	case updateRequest:
+	default:
+		return env.Type, nil, &errorMessage{
+			Code:    errCodeUnknownType,
+			Type:    env.Type,
+			Message: fmt.Sprintf("unknown message type %q", env.Type),
+		}
+	}
+	bad := func(err error) (messageType, clientContent, *errorMessage) {
+		return env.Type, nil, &errorMessage{Code: errCodeBadContent, Type: env.Type, Message: err.Error()}
+	}
+	empty := len(env.Content) == 0 || bytes.Equal(env.Content, []byte("null"))
+	switch {
+	case content == nil && !empty:
+		return bad(errors.New("takes no content"))
+	case content == nil || empty && optional:
+		return env.Type, content, nil
+	case empty:
+		return bad(errors.New("missing content"))
+	}
+	if err := decodeStrict(env.Content, content); err != nil {
+		return bad(err)
+	}
+	if err := content.validate(); err != nil {
+		return bad(err)
+	}
+	return env.Type, content, nil
+}
+
+func decodeStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("unexpected data after the message")
+	}
+	return nil
+}
+
+// Picks the newest version both sides speak, or false if there isn't one.
+func negotiateVersion(versions []int) (int, bool) {
+	best := 0
+	for _, v := range versions {
+		if v >= minProtocolVersion && v <= protocolVersion && v > best {
+			best = v
+		}
+	}
+	return best, best != 0
+}
@@ -0,0 +1,189 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"surrealchemist.com/mass-showdown-backend/config"
+)
+
+// Connects to the server as a voter and says hello.
+func dialVoter(t *testing.T, url string, header http.Header) (*websocket.Conn, *http.Response) {
+	t.Helper()
+	ws, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.WriteJSON(&message{Type: hello, Content: helloMessage{Versions: []int{protocolVersion}}})
+	readUntil(t, ws, welcome)
+	return ws, resp
+}
+
+func TestDecodeClientMessage(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		data string
+		code string
+	}{
+		{"vote", `{"type":"VOTE","content":{"type":"move","idx":1,"tera":true}}`, ""},
+		{"team vote", `{"type":"VOTE","content":{"type":"team","order":[2,0]}}`, ""},
+		{"retract in singles", `{"type":"RETRACT"}`, ""},
+		{"update", `{"type":"UPDATE_REQ"}`, ""},
+		{"old update", `u`, errCodeBadMessage},
+		{"old vote", `v{"type":"move","idx":1}`, errCodeBadMessage},
+		{"no type", `{"content":{}}`, errCodeBadMessage},
+		{"trailing data", `{"type":"UPDATE_REQ"}{}`, errCodeBadMessage},
+		{"unknown type", `{"type":"RESULTS"}`, errCodeUnknownType},
+		{"unknown field", `{"type":"VOTE","content":{"type":"move","idx":1,"power":9000}}`, errCodeBadContent},
+		{"wrong field type", `{"type":"VOTE","content":{"type":"move","idx":"1"}}`, errCodeBadContent},
+		{"bad vote type", `{"type":"VOTE","content":{"type":"run","idx":0}}`, errCodeBadContent},
+		{"vote without content", `{"type":"VOTE"}`, errCodeBadContent},
+		{"update with content", `{"type":"UPDATE_REQ","content":1}`, errCodeBadContent},
+		{"hello without versions", `{"type":"HELLO","content":{"versions":[]}}`, errCodeBadContent},
+	} {
+		_, _, err := decodeClientMessage([]byte(c.data))
+		switch {
+		case c.code == "" && err != nil:
+			t.Errorf("%s: expected %s to decode but got %v", c.name, c.data, err)
+		case c.code != "" && (err == nil || err.Code != c.code):
+			t.Errorf("%s: expected %s to fail with %s but got %v", c.name, c.data, c.code, err)
+		}
+	}
+
+	typ, content, _ := decodeClientMessage([]byte(`{"type":"VOTE","content":{"slot":1,"type":"move","idx":2,"target":-1,"tera":false}}`))
+	v := content.(*voteRequest).vote("worker", "voter")
+	if typ != vote || v.From != "worker" || v.Voter != "voter" || v.Slot != 1 || v.Idx != 2 || v.Target != -1 {
+		t.Errorf("Expected the vote to keep its fields but got %+v", v)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	p := NewPollServer(&sync.WaitGroup{}, config.Default())
+	srv := httptest.NewServer(http.HandlerFunc(p.wsServerHandler))
+	defer srv.Close()
+	p.cfg.AuthorizedHosts = config.StringList{strings.TrimPrefix(srv.URL, "http://")}
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	rejected := func(first *message, code string) {
+		t.Helper()
+		ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+		ws.WriteJSON(first)
+		var reply struct {
+			Type    messageType  `json:"type"`
+			Content errorMessage `json:"content"`
+		}
+		if err := ws.ReadJSON(&reply); err != nil || reply.Type != protocolError || reply.Content.Code != code {
+			t.Errorf("Expected a %s error but got %+v, %v", code, reply, err)
+		}
+		if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseProtocolError) {
+			t.Errorf("Expected the connection to be closed but got %v", err)
+		}
+	}
+	rejected(&message{Type: hello, Content: helloMessage{Versions: []int{protocolVersion + 1}}}, errCodeUnsupportedVersion)
+	rejected(&message{Type: updateRequest}, errCodeOutOfOrder)
+
+	// Clients that speak newer versions too get the newest the server speaks
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.WriteJSON(&message{Type: hello, Content: helloMessage{Versions: []int{protocolVersion, protocolVersion + 1}}})
+	var welcomed struct {
+		Type    messageType    `json:"type"`
+		Content welcomeMessage `json:"content"`
+	}
+	if err := ws.ReadJSON(&welcomed); err != nil || welcomed.Type != welcome || welcomed.Content.Version != protocolVersion {
+		t.Fatalf("Expected to be welcomed with version %d but got %+v, %v", protocolVersion, welcomed, err)
+	}
+	// Bad messages after the handshake get errors without ending the connection
+	ws.WriteMessage(websocket.TextMessage, []byte(`v{"type":"move","idx":0}`))
+	var e errorMessage
+	if err := json.Unmarshal(readUntil(t, ws, protocolError), &e); err != nil || e.Code != errCodeBadMessage {
+		t.Errorf("Expected a bad_message error but got %+v, %v", e, err)
+	}
+	ws.WriteJSON(&message{Type: updateRequest})
+	readUntil(t, ws, displayText)
+}
+
+func TestDisconnectStopsReader(t *testing.T) {
+	p := NewPollServer(&sync.WaitGroup{}, config.Default())
+	p.log = zap.NewNop().Sugar()
+	srv := httptest.NewServer(http.HandlerFunc(p.wsServerHandler))
+	defer srv.Close()
+	p.cfg.AuthorizedHosts = config.StringList{strings.TrimPrefix(srv.URL, "http://")}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.manage(ctx)
+	before := runtime.NumGoroutine()
+
+	// The messages after the ones that get the voter disconnected are read but never
+	// handled
+	ws, _ := dialVoter(t, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	defer ws.Close()
+	for i := 0; i < maxBadMessages+5; i++ {
+		ws.WriteMessage(websocket.TextMessage, []byte("u"))
+	}
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			break
+		}
+	}
+	ws.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the connection's goroutines to finish but %d are left over",
+				runtime.NumGoroutine()-before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRejectedVotesGetCodes(t *testing.T) {
+	p := NewPollServer(&sync.WaitGroup{}, config.Default())
+	p.log = zap.NewNop().Sugar()
+	srv := httptest.NewServer(http.HandlerFunc(p.wsServerHandler))
+	defer srv.Close()
+	p.cfg.AuthorizedHosts = config.StringList{strings.TrimPrefix(srv.URL, "http://")}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.manage(ctx)
+
+	ws, _ := dialVoter(t, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	defer ws.Close()
+	rejected := func(content map[string]interface{}, code string) {
+		t.Helper()
+		ws.WriteJSON(map[string]interface{}{"type": vote, "content": content})
+		var e errorMessage
+		if err := json.Unmarshal(readUntil(t, ws, protocolError), &e); err != nil || e.Code != code || e.Type != vote {
+			t.Errorf("Expected a %s error but got %+v, %v", code, e, err)
+		}
+	}
+	rejected(map[string]interface{}{"type": "move", "idx": 0}, errCodeNoPoll)
+
+	req := &PSBattleRequest{}
+	if err := json.Unmarshal([]byte(doublesRequest), req); err != nil {
+		t.Fatal(err)
+	}
+	p.serverInbox <- &message{
+		Type:    showdownRequest,
+		Content: showdownRequestMessage{RoomID: "battle-1", Req: req},
+	}
+	readUntil(t, ws, updateResponse)
+	rejected(map[string]interface{}{"slot": 1, "type": "move", "idx": 1, "target": 1}, "invalid_target")
+	rejected(map[string]interface{}{"slot": 5, "type": "move", "idx": 0}, "slot_out_of_bounds")
+}
@@ -1,74 +1,254 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
 	"net/http"
-	"net/url"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
+	"surrealchemist.com/mass-showdown-backend/battle"
+	"surrealchemist.com/mass-showdown-backend/config"
 	"surrealchemist.com/mass-showdown-backend/messages"
+	"surrealchemist.com/mass-showdown-backend/replay"
 )
 
-const SIM_URL = "wss://sim3.psim.us/showdown/websocket"
-const SIM_ACTION_URL = "https://play.pokemonshowdown.com/~~showdown/action.php"
-const AUTHORIZED_OPP = "hosergang"
-const AUTHORIZED_FORMAT = "gen9randombattle"
+// How long an accepted challenge can take to start a battle before its battle slot is
+// freed up again, e.g. when the challenger's team was rejected.
+const pendingChallengeTimeout = time.Minute
 
 type PSClient struct {
-	username, pass string
-	log            *zap.SugaredLogger
-	inbox          chan *message
-	outbox         chan *message
-	wg             *sync.WaitGroup
-	inBattle       bool
+	cfg    config.Showdown
+	log    *zap.SugaredLogger
+	inbox  chan *message
+	outbox chan *message
+	wg     *sync.WaitGroup
+	// Battle rooms the bot is playing in. Only changed with roomsMu held, so it can be
+	// read from outside the connection's goroutine.
+	rooms   map[string]bool
+	roomsMu sync.Mutex
+	// When each challenger's accepted challenge was accepted, until its battle room opens.
+	// They hold a battle slot for up to pendingTimeout, in case the battle never starts.
+	pending        map[string]time.Time
+	pendingTimeout time.Duration
+	maxBattles     int
+	battles        *battle.Tracker
+	// The connection results are sent over, or nil while disconnected.
+	conn   *psConn
+	connMu sync.Mutex
+	// Results for each room that couldn't be sent because we were disconnected
+	held      map[string]pollResults
+	policy    ChallengePolicy
+	transport Transport
+	auth      Authenticator
+	recorder  *replay.Recorder
+	// Closed when the client starts shutting down.
+	done <-chan struct{}
+	// Closed once every result from the poll server has been sent.
+	drained chan struct{}
 }
 
-func NewPSClient(wg *sync.WaitGroup) *PSClient {
+func NewPSClient(wg *sync.WaitGroup, cfg *config.Config) *PSClient {
 	return &PSClient{
-		username: "cruisergang",
-		pass:     "groovedune",
-		log:      zap.NewExample().Sugar().Named("ps_client"),
-		inbox:    make(chan *message),
-		wg:       wg,
-		inBattle: false,
+		cfg:            cfg.Showdown,
+		log:            zap.NewExample().Sugar().Named("ps_client"),
+		inbox:          make(chan *message),
+		wg:             wg,
+		rooms:          make(map[string]bool),
+		pending:        make(map[string]time.Time),
+		pendingTimeout: pendingChallengeTimeout,
+		maxBattles:     cfg.Challenges.MaxBattles,
+		battles:        battle.NewTracker(),
+		held:           make(map[string]pollResults),
+		drained:        make(chan struct{}),
+		transport:      &WebsocketTransport{Dialer: websocket.DefaultDialer},
+		auth:           &ActionAuthenticator{URL: cfg.Showdown.ActionURL, Client: http.DefaultClient},
+		policy:         NewAllowlistPolicy(cfg.Challenges),
 	}
 }
 
+// Replaces how the client connects to the server. Mostly useful for testing.
+func (p *PSClient) SetTransport(t Transport) {
+	p.transport = t
+}
+
+// Replaces how the client gets the assertion it logs in with. Mostly useful for testing.
+func (p *PSClient) SetAuthenticator(a Authenticator) {
+	p.auth = a
+}
+
+// Records every battle room frame received. A nil recorder records nothing.
+func (p *PSClient) SetRecorder(r *replay.Recorder) {
+	p.recorder = r
+}
+
+// Replaces the policy deciding which challenges are accepted.
+func (p *PSClient) SetChallengePolicy(policy ChallengePolicy) {
+	p.policy = policy
+}
+
 func (p *PSClient) GetRecvChan() chan *message {
 	return p.inbox
 }
 
+// Returns the tracker holding the state of every battle the client is in.
+func (p *PSClient) Battles() *battle.Tracker {
+	return p.battles
+}
+
 func (p *PSClient) SetSendChan(send chan *message) {
 	p.outbox = send
 }
 
-func (p *PSClient) LoginAndStart() {
+// Delays between attempts to reconnect to the server. The delay doubles after every
+// failed attempt, and goes back to the minimum once a connection stays up.
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
+)
+
+// A websocket connection that's safe to write to from multiple goroutines.
+type psConn struct {
+	sync.Mutex
+	ws Conn
+}
+
+func (c *psConn) WriteJSON(v interface{}) error {
+	c.Lock()
+	defer c.Unlock()
+	return c.ws.WriteJSON(v)
+}
+
+func (c *psConn) WriteMessage(messageType int, data []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	return c.ws.WriteMessage(messageType, data)
+}
+
+// Connects to the server and keeps reconnecting whenever the connection is lost.
+// Poll results are forwarded to the server as long as it's connected. Once ctx is done,
+// the last results from the poll server are sent and the connection is closed.
+func (p *PSClient) LoginAndStart(ctx context.Context) {
 	defer p.wg.Done()
 	if p.outbox == nil {
 		p.log.Fatalw("showdown client currently has no channel set for communicating with poll server")
 	}
-	c, _, err := websocket.DefaultDialer.Dial(SIM_URL, nil)
-	if err != nil {
-		p.log.Fatalw("Error opening Websocket", zap.Error(err))
+	p.done = ctx.Done()
+	go p.sendResults()
+	delay := minReconnectDelay
+	for {
+		started := time.Now()
+		err := p.runSession(ctx)
+		if ctx.Err() != nil {
+			p.log.Info("showdown client stopped")
+			return
+		}
+		if time.Since(started) > maxReconnectDelay {
+			delay = minReconnectDelay
+		}
+		p.log.Errorw("lost connection to showdown, reconnecting",
+			zap.Error(err),
+			zap.Duration("delay", delay))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			p.log.Info("showdown client stopped")
+			return
+		}
+		delay = min(2*delay, maxReconnectDelay)
 	}
-	defer c.Close()
+}
 
+// Runs a single connection to the server until it fails or ctx is done, and returns why
+// it ended.
+func (p *PSClient) runSession(ctx context.Context) error {
+	ws, err := p.transport.Dial(p.cfg.SimURL)
+	if err != nil {
+		return fmt.Errorf("opening websocket: %w", err)
+	}
+	defer ws.Close()
+	defer p.setConn(nil)
+	// Challenges accepted on the old connection won't start on this one
+	clear(p.pending)
+	c := &psConn{ws: ws}
+	ended := make(chan struct{})
+	defer close(ended)
 	go func() {
-		for {
-			_, bs, err := c.ReadMessage()
-			if err != nil {
-				p.log.Fatalw("Error reading websocket message", zap.Error(err))
-			}
-			p.handleWS(bs, c)
+		select {
+		case <-ended:
+		case <-ctx.Done():
+			p.closeSession(c)
 		}
 	}()
+	for {
+		_, bs, err := ws.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("reading websocket message: %w", err)
+		}
+		if err := p.handleWS(bs, c); err != nil {
+			return err
+		}
+	}
+}
+
+// Closes the connection once the poll server's last results have been sent, forfeiting
+// every battle first if the bot is configured to. Unblocks runSession's read.
+func (p *PSClient) closeSession(c *psConn) {
+	select {
+	case <-p.drained:
+	case <-time.After(shutdownTimeout):
+		p.log.Warn("gave up waiting for the last poll results")
+	}
+	if p.cfg.ForfeitOnShutdown {
+		for _, room := range p.battleRooms() {
+			wsm := fmt.Sprintf("%s|/forfeit", room)
+			p.log.Infow("sending message", zap.String("content", wsm))
+			c.WriteMessage(websocket.TextMessage, []byte(wsm))
+		}
+	}
+	c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	c.ws.Close()
+}
+
+// Returns the battle rooms the bot is playing in.
+func (p *PSClient) battleRooms() []string {
+	p.roomsMu.Lock()
+	defer p.roomsMu.Unlock()
+	return sortedKeys(p.rooms)
+}
+
+// Sends a message to the poll server, unless the client is shutting down and the poll
+// server may not be listening any more.
+func (p *PSClient) toPollServer(msg *message) {
+	select {
+	case p.outbox <- msg:
+	case <-p.done:
+	}
+}
+
+// Sets the connection results are sent over, or nil while disconnected. Results held
+// while disconnected are sent as soon as there's a connection again.
+func (p *PSClient) setConn(c *psConn) {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	p.conn = c
+	if c == nil {
+		return
+	}
+	for room, res := range p.held {
+		if p.writeResults(res) {
+			delete(p.held, room)
+		}
+	}
+}
 
+// Forwards poll results to the server until the inbox is closed.
+func (p *PSClient) sendResults() {
+	defer close(p.drained)
 	for msg := range p.inbox {
 		switch msg.Type {
 		case results:
@@ -77,111 +257,212 @@ func (p *PSClient) LoginAndStart() {
 				p.log.Warn("Got pollResults message from poll server with unrecognized payload")
 				break
 			}
-			wsm := fmt.Sprintf("%s|%s|%d", content.RoomID, content.Command, content.RQID)
-			p.log.Infow("sending message to server",
-				zap.String("content", wsm))
-			c.WriteMessage(websocket.TextMessage, []byte(wsm))
+			p.connMu.Lock()
+			if !p.writeResults(content) {
+				p.log.Warnw("holding poll results until showdown reconnects",
+					zap.String("room", content.RoomID))
+				p.held[content.RoomID] = content
+			}
+			p.connMu.Unlock()
 		}
 	}
 }
 
-func (p *PSClient) handleWS(bs []byte, c *websocket.Conn) {
+// Sends the results over the current connection. Must be called with connMu held.
+func (p *PSClient) writeResults(content pollResults) bool {
+	if p.conn == nil {
+		return false
+	}
+	wsm := fmt.Sprintf("%s|%s|%d", content.RoomID, content.Command, content.RQID)
+	p.log.Infow("sending message to server",
+		zap.String("content", wsm))
+	if err := p.conn.WriteMessage(websocket.TextMessage, []byte(wsm)); err != nil {
+		p.log.Errorw("couldn't send poll results", zap.Error(err))
+		return false
+	}
+	return true
+}
+
+// Handles a frame from the server. Returns an error if the session can't continue.
+func (p *PSClient) handleWS(bs []byte, c *psConn) error {
 	msg, err := messages.ParseServerMessage(bs)
 	if err != nil {
-		p.log.Fatalw("Error parsing websocket message", zap.Error(err))
+		p.log.Errorw("Error parsing websocket message", zap.Error(err))
+		return nil
+	}
+	events, err := messages.DecodeEvents(msg)
+	if err != nil {
+		p.log.Warnw("couldn't decode message from server", zap.Error(err))
+	}
+	if strings.HasPrefix(msg.RoomID, "battle-") {
+		for _, ev := range events {
+			if _, ok := ev.(*messages.InitEvent); ok {
+				// A finished battle that's joined again carries on being recorded
+				p.recorder.Open(msg.RoomID)
+			}
+		}
+		p.recorder.Frame(msg.RoomID, bs)
 	}
-	for _, m := range msg.Messages {
+	if lines := p.battles.ApplyMessage(msg, events); len(lines) > 0 {
+		p.toPollServer(&message{
+			Type:    battleLog,
+			Content: battleLogMessage{Room: msg.RoomID, Lines: lines},
+		})
+	}
+	for i, ev := range events {
+		m := msg.Messages[i]
 		p.log.Infow("Received websocket message from server",
 			zap.String("room", msg.RoomID),
 			zap.String("type", m.Type),
 			zap.Strings("data", m.Data),
 			zap.Int("length", len(m.Data)),
 		)
-		switch m.Type {
-		case "challstr":
-			r, err := p.login(m.Data)
+		switch e := ev.(type) {
+		case *messages.ChallstrEvent:
+			assertion, err := p.auth.Login(p.cfg.Username, p.cfg.Password, e.Challstr)
 			if err != nil {
-				p.log.Fatalw("Error logging in", zap.Error(err))
+				return fmt.Errorf("logging in: %w", err)
 			}
-			c.WriteJSON([]string{fmt.Sprintf("|/trn %s,0,%s", p.username, r.Assertion)})
+			err = c.WriteJSON([]string{fmt.Sprintf("|/trn %s,0,%s", p.cfg.Username, assertion)})
 			if err != nil {
-				p.log.Fatalw("Error logging in", zap.Error(err))
+				return fmt.Errorf("logging in: %w", err)
+			}
+		case *messages.UpdateUserEvent:
+			if !e.Named {
+				break
+			}
+			// Showdown sends the battle log and current request again when we rejoin,
+			// so any poll in progress picks back up where it left off
+			for room := range p.rooms {
+				p.log.Infow("rejoining battle", zap.String("room", room))
+				c.WriteJSON([]string{fmt.Sprintf("|/join %s", room)})
+			}
+			p.setConn(c)
+		case *messages.PMEvent:
+			ch := parseChallenge(e.From, e.Message)
+			if ch == nil {
+				if strings.TrimSpace(e.Message) == "/challenge" {
+					// The challenger cancelled, so their battle won't start
+					delete(p.pending, messages.ToID(e.From))
+				}
+				break
+			}
+			accept, reason := p.policy.Evaluate(ch)
+			if accept && len(p.rooms)+p.pendingCount() >= p.maxBattles {
+				accept, reason = false, "Sorry, I'm already in as many battles as I can play."
 			}
-		case "pm":
-			if !strings.HasPrefix(m.Data[2], "/challenge") {
+			if !accept {
+				p.log.Infow("rejecting challenge",
+					zap.String("from", ch.From),
+					zap.String("format", ch.Format),
+					zap.String("reason", reason))
+				c.WriteJSON([]string{fmt.Sprintf("|/reject %s", ch.From)})
+				c.WriteJSON([]string{fmt.Sprintf("|/pm %s, %s", ch.From, reason)})
 				break
 			}
-			if m.Data[0][1:] != AUTHORIZED_OPP || m.Data[2] != "/challenge "+AUTHORIZED_FORMAT || p.inBattle {
-				c.WriteJSON([]string{fmt.Sprintf("|/reject%s", m.Data[0])})
+			c.WriteJSON([]string{fmt.Sprintf("|/accept %s", ch.From)})
+			p.pending[ch.From] = time.Now()
+		case *messages.PlayerEvent:
+			if strings.HasPrefix(msg.RoomID, "battle-") {
+				delete(p.pending, messages.ToID(e.Username))
+			}
+		case *messages.GenericEvent:
+			if e.Type == "popup" && len(p.pending) > 0 {
+				// Popups are how Showdown says accepting a challenge failed, without
+				// saying whose, so none of them are counted on starting any more
+				p.log.Infow("forgetting accepted challenges after popup",
+					zap.Strings("popup", e.Data),
+					zap.Int("pending", len(p.pending)))
+				clear(p.pending)
+			}
+		case *messages.InitEvent:
+			if e.RoomType != "battle" || p.rooms[msg.RoomID] {
 				break
 			}
-			c.WriteJSON([]string{fmt.Sprintf("|/accept%s", m.Data[0])})
-			p.inBattle = true
-		case "|request":
+			p.roomsMu.Lock()
+			p.rooms[msg.RoomID] = true
+			p.roomsMu.Unlock()
+			p.log.Infow("joined battle",
+				zap.String("room", msg.RoomID),
+				zap.Int("battles", len(p.rooms)))
+		case *messages.RequestEvent:
 			// each battle starts with a blank request which needs to be ignored
-			if m.Data[0] == "" {
+			if e.JSON == "" {
 				break
 			}
 			wsm := fmt.Sprintf("|/join %s", msg.RoomID)
 			p.log.Infow("sending message", zap.String("content", wsm))
 			c.WriteJSON([]string{})
 			req := &PSBattleRequest{}
-			err = json.Unmarshal([]byte(m.Data[0]), req)
+			err = json.Unmarshal([]byte(e.JSON), req)
 			if err != nil {
 				p.log.Errorf("couldn't unmarshal showdown json", zap.Error(err))
 				break
 			}
-			p.outbox <- &message{
+			p.toPollServer(&message{
 				Type: showdownRequest,
 				Content: showdownRequestMessage{
 					RoomID: msg.RoomID,
 					Req:    req,
 				},
+			})
+		case *messages.InactiveEvent:
+			// Polls have to finish before the battle timer runs out
+			var deadline time.Time
+			if left, ok := e.TimeLeft(p.cfg.Username); ok {
+				deadline = time.Now().Add(left)
+			} else if !e.Off {
+				break
 			}
-		case "win":
+			p.toPollServer(&message{
+				Type: battleTimer,
+				Content: battleTimerMessage{
+					RoomID:   msg.RoomID,
+					Deadline: deadline,
+				},
+			})
+		case *messages.WinEvent, *messages.TieEvent:
 			wsm := fmt.Sprintf("|/leave %s", msg.RoomID)
 			p.log.Infow("sending message", zap.String("content", wsm))
 			c.WriteMessage(websocket.TextMessage, []byte(wsm))
-			p.inBattle = false
-			// resp := <-p.inbox
-			// if resp.Type == wait {
-			// 	break
-			// }
-			// wsm = fmt.Sprintf("%s|%s|%d", msg.RoomID, resp.Content, req.RQID)
-			// p.log.Infow("sending message to server",
-			// 	zap.String("content", wsm))
-			// c.WriteMessage(websocket.TextMessage, []byte(wsm))
-			// c.WriteJSON([]string{wsm})
+			p.endBattle(msg.RoomID)
+		case *messages.DeinitEvent:
+			p.endBattle(msg.RoomID)
+		case *messages.NoInitEvent:
+			// Happens when a battle we were in ended while we were disconnected
+			p.log.Infow("couldn't rejoin battle",
+				zap.String("room", msg.RoomID),
+				zap.String("reason", e.Message))
+			p.endBattle(msg.RoomID)
 		}
 	}
+	return nil
 }
 
-type loginResponse struct {
-	ActionSuccess bool
-	Assertion     string
-	CurrentUser   map[string]interface{}
+// Returns how many accepted challenges may still start a battle, forgetting the ones that
+// have taken too long.
+func (p *PSClient) pendingCount() int {
+	for from, at := range p.pending {
+		if time.Since(at) > p.pendingTimeout {
+			p.log.Infow("gave up on accepted challenge", zap.String("from", from))
+			delete(p.pending, from)
+		}
+	}
+	return len(p.pending)
 }
 
-func (p *PSClient) login(challdata []string) (*loginResponse, error) {
-	log := zap.NewExample().Sugar().Named("login")
-	resp, err := http.PostForm(SIM_ACTION_URL, url.Values{
-		"act":      {"login"},
-		"name":     {p.username},
-		"pass":     {p.pass},
-		"challstr": {strings.Join(challdata, "|")},
-	})
-	if err != nil {
-		return nil, err
+// Forgets a battle room and tells the poll server it's over.
+func (p *PSClient) endBattle(roomID string) {
+	if !p.rooms[roomID] {
+		return
 	}
-	lr := &loginResponse{}
-	respBytes, _ := io.ReadAll(resp.Body)
-	err = json.Unmarshal(respBytes[1:], lr)
-	if err != nil {
-		return nil, err
-	}
-	if !lr.ActionSuccess {
-		return nil, errors.New("failed logging in")
-	}
-	log.Infow("Got response from server on login", zap.ByteString("response", respBytes))
-	return lr, err
+	p.roomsMu.Lock()
+	delete(p.rooms, roomID)
+	p.roomsMu.Unlock()
+	p.battles.Remove(roomID)
+	p.recorder.Close(roomID)
+	p.toPollServer(&message{
+		Type:    battleEnded,
+		Content: roomID,
+	})
 }
@@ -0,0 +1,224 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"surrealchemist.com/mass-showdown-backend/battle"
+	"surrealchemist.com/mass-showdown-backend/config"
+	"surrealchemist.com/mass-showdown-backend/replay"
+	"surrealchemist.com/mass-showdown-backend/showdowntest"
+)
+
+const testRequest = `{"active":[{"moves":[{"move":"Thunderbolt","id":"thunderbolt","pp":24,"maxpp":24,"target":"normal","disabled":false}]}],"side":{"name":"massbot","id":"p1","pokemon":[{"ident":"p1: Pikachu","details":"Pikachu, L84","condition":"211/211","active":true}]},"rqid":3}`
+
+func newTestClient(srv *showdowntest.Server) (*PSClient, chan *message) {
+	cfg := config.Default()
+	cfg.Showdown.SimURL = srv.URL
+	cfg.Showdown.ActionURL = srv.ActionURL
+	cfg.Showdown.Username = "massbot"
+	cfg.Showdown.Password = "hunter2"
+	srv.AddAccount("massbot", "hunter2")
+	psc := NewPSClient(&sync.WaitGroup{}, cfg)
+	out := make(chan *message, 10)
+	psc.SetSendChan(out)
+	return psc, out
+}
+
+func startTestClient(t *testing.T, srv *showdowntest.Server) (*PSClient, chan *message) {
+	t.Helper()
+	psc, out := newTestClient(srv)
+	psc.wg.Add(1)
+	go psc.LoginAndStart(context.Background())
+	if _, err := srv.WaitForLogin(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	return psc, out
+}
+
+// Waits for the room's request to be forwarded, and returns the battle log forwarded
+// before it.
+func expectRequest(t *testing.T, out chan *message, roomID string) []battle.LogLine {
+	t.Helper()
+	var lines []battle.LogLine
+	for {
+		select {
+		case msg := <-out:
+			if l, ok := msg.Content.(battleLogMessage); ok && l.Room == roomID {
+				lines = append(lines, l.Lines...)
+				continue
+			}
+			content, ok := msg.Content.(showdownRequestMessage)
+			if msg.Type != showdownRequest || !ok || content.RoomID != roomID {
+				t.Fatalf("Expected a request for %s but got %+v", roomID, msg)
+			}
+			if content.Req.RQID != 3 {
+				t.Errorf("Expected request 3 but got %d", content.Req.RQID)
+			}
+			return lines
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the request to be forwarded")
+		}
+	}
+}
+
+func TestPSClientPlaysBattle(t *testing.T) {
+	srv := showdowntest.NewServer()
+	defer srv.Close()
+	psc, out := startTestClient(t, srv)
+
+	if err := srv.Challenge("hosergang", "gen9randombattle"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.Expect("/accept hosergang", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	room := "battle-gen9randombattle-1"
+	srv.StartBattle(room, "|player|p1|massbot|1", "|player|p2|hosergang|2", "|start")
+	srv.Request(room, testRequest)
+	if lines := expectRequest(t, out, room); len(lines) != 1 || lines[0].Text != "The battle started!" {
+		t.Errorf("Expected the start of the battle to be logged but got %+v", lines)
+	}
+
+	psc.GetRecvChan() <- &message{
+		Type:    results,
+		Content: pollResults{RoomID: room, RQID: 3, Command: "/choose move 1"},
+	}
+	if _, err := srv.Expect(room+"|/choose move 1|3", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// After reconnecting, the client rejoins the battle and gets the request again
+	srv.Disconnect()
+	if _, err := srv.WaitForLogin(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.Expect("/join "+room, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	expectRequest(t, out, room)
+}
+
+func TestPSClientRejectsChallenge(t *testing.T) {
+	srv := showdowntest.NewServer()
+	defer srv.Close()
+	startTestClient(t, srv)
+
+	if err := srv.Challenge("stranger", "gen9randombattle"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.Expect("/reject stranger", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPSClientPlaysBackRecording(t *testing.T) {
+	room := "battle-gen9randombattle-1"
+	rec := replay.NewRecorder(t.TempDir())
+	rec.Frame(room, []byte(">"+room+"\n|init|battle\n|player|p1|massbot|1\n|start"))
+	rec.Frame(room, []byte(">"+room+"\n|request|"+testRequest))
+	rec.Close(room)
+
+	psc := NewPSClient(&sync.WaitGroup{}, config.Default())
+	psc.SetTransport(&PlaybackTransport{Path: rec.Path(room)})
+	out := make(chan *message, 10)
+	psc.SetSendChan(out)
+	psc.wg.Add(1)
+	go psc.LoginAndStart(context.Background())
+	expectRequest(t, out, room)
+	if s := psc.Battles().Snapshot(room); s == nil || !s.Started {
+		t.Errorf("Expected the recorded battle to be tracked but got %+v", s)
+	}
+}
+
+func TestPSClientShutsDown(t *testing.T) {
+	srv := showdowntest.NewServer()
+	defer srv.Close()
+	psc, out := newTestClient(srv)
+	psc.cfg.ForfeitOnShutdown = true
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	psc.wg.Add(1)
+	go psc.LoginAndStart(ctx)
+	if _, err := srv.WaitForLogin(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	room := "battle-gen9randombattle-1"
+	srv.StartBattle(room, "|player|p1|massbot|1", "|start")
+	srv.Request(room, testRequest)
+	expectRequest(t, out, room)
+
+	// The poll server sends its last results, then closes the channel
+	cancel()
+	psc.GetRecvChan() <- &message{
+		Type:    results,
+		Content: pollResults{RoomID: room, RQID: 3, Command: "/choose move 1"},
+	}
+	close(psc.GetRecvChan())
+	if _, err := srv.Expect(room+"|/choose move 1|3", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.Expect(room+"|/forfeit", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		psc.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the client to stop")
+	}
+}
+
+func TestPSClientFreesChallengesThatNeverStart(t *testing.T) {
+	srv := showdowntest.NewServer()
+	defer srv.Close()
+	startTestClient(t, srv)
+
+	challenge := func(want string) {
+		t.Helper()
+		if err := srv.Challenge("hosergang", "gen9randombattle"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := srv.Expect(want+" hosergang", 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	challenge("/accept")
+	// The accepted challenge holds the only battle slot until it starts
+	challenge("/reject")
+
+	// Cancelling frees it up again
+	srv.Send("|pm| hosergang| massbot|/challenge")
+	challenge("/accept")
+
+	// So does a popup saying it couldn't start
+	srv.Send("|popup|Your team was rejected for the following reasons:")
+	challenge("/accept")
+}
+
+func TestPSClientGivesUpOnChallengesThatNeverStart(t *testing.T) {
+	srv := showdowntest.NewServer()
+	defer srv.Close()
+	psc, _ := newTestClient(srv)
+	psc.pendingTimeout = 0
+	psc.wg.Add(1)
+	go psc.LoginAndStart(context.Background())
+	if _, err := srv.WaitForLogin(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		if err := srv.Challenge("hosergang", "gen9randombattle"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := srv.Expect("/accept hosergang", 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
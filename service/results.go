@@ -0,0 +1,119 @@
+package service
+
+import "fmt"
+
+// The vote shares of a poll at one moment, as shown to voters. Never changed once made, so
+// the same results can be sent to any number of voters.
+type Results struct {
+	// The poll's version when the results were made.
+	Version uint64
+	// A copy of the poll's request with the vote shares filled in.
+	Req   *PSBattleRequest
+	Total int
+}
+
+// Returns the latest results, making them first if there aren't any yet.
+func (po *Poll) latestResults() *Results {
+	if res := po.results.Load(); res != nil {
+		return res
+	}
+	res, _ := po.refreshResults()
+	return res
+}
+
+// Makes new results if any votes changed since the last ones. Reports whether they did.
+func (po *Poll) refreshResults() (*Results, bool) {
+	version := po.version.Load()
+	if res := po.results.Load(); res != nil && res.Version == version {
+		return res, false
+	}
+	res := &Results{
+		Version: version,
+		Req:     po.Req.clone(),
+	}
+	t := po.tally()
+	res.Total = t.Total
+	fillShares(res.Req, t)
+	po.results.Store(res)
+	return res, true
+}
+
+// Fills in the vote shares on a copy of the request.
+func fillShares(req *PSBattleRequest, t *Tally) {
+	if t.Total == 0 {
+		return
+	}
+	if req.TeamPreview {
+		points := 0
+		for _, pts := range t.Team {
+			points += pts
+		}
+		for k, sp := range req.Side.Pokemon {
+			sp.Votes = float32(t.Team[k]) / float32(points)
+		}
+		return
+	}
+	switches := make([]int, len(req.Side.Pokemon))
+	for i, st := range t.Slots {
+		for k, ct := range st.Switch {
+			switches[k] += ct
+		}
+		if i >= len(req.Active) || st.Total == 0 {
+			continue
+		}
+		a := req.Active[i]
+		for j, m := range a.Moves {
+			m.Votes = float32(st.Attack[j]) / float32(st.Total)
+		}
+		a.TeraVotes = float32(st.Tera) / float32(st.Total)
+	}
+	for k, sp := range req.Side.Pokemon {
+		sp.Votes = float32(switches[k]) / float32(t.Total)
+	}
+}
+
+// Lists the vote shares that differ between two results for the same poll.
+func diffResults(prev, next *Results) []shareChange {
+	var changes []shareChange
+	for i, a := range next.Req.Active {
+		pa := prev.Req.Active[i]
+		for j, m := range a.Moves {
+			if m.Votes != pa.Moves[j].Votes {
+				changes = append(changes, shareChange{Path: fmt.Sprintf("active.%d.moves.%d", i, j), Field: "votes", Share: m.Votes})
+			}
+		}
+		if a.TeraVotes != pa.TeraVotes {
+			changes = append(changes, shareChange{Path: fmt.Sprintf("active.%d", i), Field: "teraVotes", Share: a.TeraVotes})
+		}
+	}
+	for k, sp := range next.Req.Side.Pokemon {
+		if sp.Votes != prev.Req.Side.Pokemon[k].Votes {
+			changes = append(changes, shareChange{Path: fmt.Sprintf("side.pokemon.%d", k), Field: "votes", Share: sp.Votes})
+		}
+	}
+	return changes
+}
+
+// Copies the request deeply enough that vote shares can be filled into the copy without
+// touching the original.
+func (r *PSBattleRequest) clone() *PSBattleRequest {
+	c := *r
+	if r.Active != nil {
+		c.Active = make([]*PSActivePokemon, len(r.Active))
+	}
+	for i, a := range r.Active {
+		ac := *a
+		ac.Moves = make([]*PSMoveInfo, len(a.Moves))
+		for j, m := range a.Moves {
+			mc := *m
+			ac.Moves[j] = &mc
+		}
+		c.Active[i] = &ac
+	}
+	c.Side.Pokemon = make([]*PSSidePokemon, len(r.Side.Pokemon))
+	for i, sp := range r.Side.Pokemon {
+		spc := *sp
+		c.Side.Pokemon[i] = &spc
+	}
+	return &c
+}
@@ -0,0 +1,164 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"surrealchemist.com/mass-showdown-backend/config"
+)
+
+func TestResultsAreSnapshots(t *testing.T) {
+	po := newTestPoll(t, doublesRequest)
+	po.addVote(&Vote{Voter: "a", Slot: 0, Type: "move", Idx: 1, Target: 1})
+	first, changed := po.refreshResults()
+	if !changed || first.Total != 1 || first.Req.Active[0].Moves[1].Votes != 1 {
+		t.Fatalf("Expected results with a's vote but got %+v", first)
+	}
+	if po.Req.Active[0].Moves[1].Votes != 0 {
+		t.Error("Expected the poll's request to be left alone")
+	}
+	if again, changed := po.refreshResults(); changed || again != first {
+		t.Error("Expected the same results while the votes stay the same")
+	}
+
+	po.addVote(&Vote{Voter: "b", Slot: 0, Type: "move", Idx: 0})
+	second, changed := po.refreshResults()
+	if !changed || second.Req.Active[0].Moves[1].Votes != 0.5 {
+		t.Errorf("Expected new results with both votes but got %+v", second)
+	}
+	if first.Req.Active[0].Moves[1].Votes != 1 {
+		t.Error("Expected the earlier results to stay as they were")
+	}
+}
+
+func TestVotesCountedConcurrently(t *testing.T) {
+	po := newTestPoll(t, doublesRequest)
+	var wg sync.WaitGroup
+	for g := 0; g < 50; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				voter := fmt.Sprintf("%d-%d", g, i)
+				po.addVote(&Vote{Voter: voter, Slot: 0, Type: "move", Idx: i % 2})
+				po.addVote(&Vote{Voter: voter, Slot: 1, Type: "switch", Idx: 3})
+				if i%4 == 0 {
+					po.retractVote(voter, 1)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	po.close()
+	if err := po.addVote(&Vote{Voter: "late", Slot: 0, Type: "move", Idx: 0}); err != errPollClosed {
+		t.Errorf("Expected votes after closing to be rejected but got %v", err)
+	}
+	tally := po.tally()
+	if tally.Voters != 1000 || tally.Slots[0].Total != 1000 || tally.Slots[1].Switch[3] != 750 {
+		t.Errorf("Expected 1000 voters with 750 switching but got %d voters, %+v", tally.Voters, tally.Slots[1])
+	}
+}
+
+func TestCountsPastUint16(t *testing.T) {
+	po := newTestPoll(t, doublesRequest)
+	const voters = 70000
+	for i := 0; i < voters; i++ {
+		po.addVote(&Vote{Voter: fmt.Sprint(i), Slot: 0, Type: "move", Idx: 1, Target: 1})
+	}
+	tally := po.tally()
+	if st := tally.Slots[0]; tally.Total != voters || st.Attack[1] != voters || st.Targets[1][1] != voters {
+		t.Errorf("Expected %d votes for the second move but got %d in total and %+v", voters, tally.Total, st)
+	}
+	res, _ := po.refreshResults()
+	if res.Total != voters || res.Req.Active[0].Moves[1].Votes != 1 {
+		t.Errorf("Expected results for %d votes but got %d", voters, res.Total)
+	}
+	if cmd := po.command(); cmd != "/choose move 2 1, move 1" {
+		t.Errorf("Expected the second move to win but got %q", cmd)
+	}
+}
+
+// Reads messages from the websocket until one of the given type arrives.
+func readUntil(t *testing.T, ws *websocket.Conn, typ messageType) json.RawMessage {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var m struct {
+			Type    messageType     `json:"type"`
+			Content json.RawMessage `json:"content"`
+		}
+		if err := ws.ReadJSON(&m); err != nil {
+			t.Fatalf("Expected a %s message but got %v", typ, err)
+		}
+		if m.Type == typ {
+			return m.Content
+		}
+	}
+}
+
+func TestResultsPushedAsDeltas(t *testing.T) {
+	cfg := config.Default()
+	cfg.Poll.CloseWhenAllVoted = false
+	cfg.Poll.ResultsInterval = config.Duration{Duration: 50 * time.Millisecond}
+	p := NewPollServer(&sync.WaitGroup{}, cfg)
+	p.log = zap.NewNop().Sugar()
+	srv := httptest.NewServer(http.HandlerFunc(p.wsServerHandler))
+	defer srv.Close()
+	p.cfg.AuthorizedHosts = config.StringList{strings.TrimPrefix(srv.URL, "http://")}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.manage(ctx)
+	req := &PSBattleRequest{}
+	if err := json.Unmarshal([]byte(doublesRequest), req); err != nil {
+		t.Fatal(err)
+	}
+	p.serverInbox <- &message{
+		Type:    showdownRequest,
+		Content: showdownRequestMessage{RoomID: "battle-1", Req: req},
+	}
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	vote := func(idx int) *websocket.Conn {
+		ws, _ := dialVoter(t, url, nil)
+		readUntil(t, ws, updateResponse)
+		ws.WriteJSON(map[string]interface{}{
+			"type":    vote,
+			"content": map[string]interface{}{"type": "move", "idx": idx, "tera": false},
+		})
+		readUntil(t, ws, voteOk)
+		return ws
+	}
+
+	first := vote(0)
+	defer first.Close()
+	var full updateResponseMessage
+	json.Unmarshal(readUntil(t, first, updateResponse), &full)
+	if !full.Results || full.Total != 1 {
+		t.Fatalf("Expected the first voter to be pushed the results in full but got %+v", full)
+	}
+
+	second := vote(1)
+	defer second.Close()
+	var delta resultsDeltaMessage
+	json.Unmarshal(readUntil(t, first, resultsDelta), &delta)
+	if delta.Poll != full.Poll || delta.From != full.Version || delta.Total != 2 {
+		t.Errorf("Expected a delta following on from version %d but got %+v", full.Version, delta)
+	}
+	if len(delta.Changes) != 2 || delta.Changes[0] != (shareChange{"active.0.moves.0", "votes", 0.5}) {
+		t.Errorf("Expected both moves' shares to change but got %+v", delta.Changes)
+	}
+	// The second voter was never shown the earlier results, so gets them in full
+	var caughtUp updateResponseMessage
+	json.Unmarshal(readUntil(t, second, updateResponse), &caughtUp)
+	if !caughtUp.Results || caughtUp.Total != 2 {
+		t.Errorf("Expected the second voter to be sent the results in full but got %+v", caughtUp)
+	}
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// How many shards a poll's votes are split over. Each voter always lands in the same shard,
+// so counting their votes only locks that shard.
+const voteShards = 32
+
+// The votes of the voters in one shard, with their tallies.
+type voteShard struct {
+	sync.Mutex
+	// Each voter's current vote for each slot. Team preview votes are for slot 0.
+	votes map[string]map[int]*Vote
+	tally Tally
+}
+
+// The counts of the votes in a poll, or in one shard of it.
+type Tally struct {
+	Slots []*SlotTally
+	// Borda points for each pokemon on the side during team preview.
+	Team  []int
+	Total int
+	// How many voters have a vote in.
+	Voters int
+}
+
+// Makes an empty tally for the request.
+func newTally(req *PSBattleRequest) Tally {
+	var t Tally
+	if req.TeamPreview {
+		t.Team = make([]int, len(req.Side.Pokemon))
+		return t
+	}
+	slots := max(len(req.Active), len(req.ForceSwitch))
+	for i := 0; i < slots; i++ {
+		st := &SlotTally{
+			Switch: make([]int, len(req.Side.Pokemon)),
+		}
+		if i < len(req.Active) {
+			st.Attack = make([]int, len(req.Active[i].Moves))
+			st.Targets = make([]map[int]int, len(req.Active[i].Moves))
+			for j := range st.Targets {
+				st.Targets[j] = make(map[int]int)
+			}
+		}
+		t.Slots = append(t.Slots, st)
+	}
+	return t
+}
+
+// Adds a valid vote to the tally when delta is 1, or takes it back out when it's -1.
+func (t *Tally) count(v *Vote, delta int) {
+	t.Total += delta
+	if t.Team != nil {
+		// A Borda count: with n pokemon, the first choice gets n points, the second
+		// n-1 and so on
+		n := len(t.Team)
+		for i, idx := range v.Order {
+			t.Team[idx] += delta * (n - i)
+		}
+		return
+	}
+	st := t.Slots[v.Slot]
+	st.Total += delta
+	if v.Type == "switch" {
+		st.Switch[v.Idx] += delta
+		return
+	}
+	st.Attack[v.Idx] += delta
+	if v.Target != 0 {
+		st.Targets[v.Idx][v.Target] += delta
+	}
+	if v.Tera {
+		st.Tera += delta
+	}
+}
+
+// Adds another tally for the same request to this one.
+func (t *Tally) add(o *Tally) {
+	t.Total += o.Total
+	t.Voters += o.Voters
+	for i, pts := range o.Team {
+		t.Team[i] += pts
+	}
+	for i, st := range o.Slots {
+		sum := t.Slots[i]
+		sum.Total += st.Total
+		sum.Tera += st.Tera
+		for j, ct := range st.Attack {
+			sum.Attack[j] += ct
+		}
+		for j, targets := range st.Targets {
+			for target, ct := range targets {
+				sum.Targets[j][target] += ct
+			}
+		}
+		for j, ct := range st.Switch {
+			sum.Switch[j] += ct
+		}
+	}
+}
+
+// The shard the voter's votes are kept in.
+func (po *Poll) shard(voter string) *voteShard {
+	h := fnv.New32a()
+	h.Write([]byte(voter))
+	return &po.shards[h.Sum32()%voteShards]
+}
+
+// Sums up the votes in every shard. Votes counted while it runs may or may not be
+// included, so it's only exact once the poll is closed.
+func (po *Poll) tally() *Tally {
+	t := newTally(po.Req)
+	for i := range po.shards {
+		sh := &po.shards[i]
+		sh.Lock()
+		t.add(&sh.tally)
+		sh.Unlock()
+	}
+	return &t
+}
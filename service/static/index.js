@@ -1,47 +1,119 @@
 /* showActive(req.active[0]);
  * showSide(req.side.pokemon); */
-const socket = new WebSocket("ws://localhost:8080/ws");
+// Pass ?room=ROOM through to pick which battle to vote in
+const socket = new WebSocket("ws://localhost:8080/ws" + window.location.search);
+
+// The protocol versions this page speaks, newest last
+const protocolVersions = [1];
+
+function send(type, content) {
+  socket.send(JSON.stringify(content === undefined ? { type } : { type, content }));
+}
 
 socket.onopen = function (event) {
   console.log("WebSocket connected.");
-  const intervalId = setInterval(() => {
-    socket.send("u");
-  }, 1000);
+  send("HELLO", { versions: protocolVersions });
 };
 
+// Once we've voted the server pushes the results, first in full and then just the
+// shares that changed
+var results = null;
+
+// The strategy the poll is decided by. In instant runoff and approval polls voters pick
+// several choices for a slot before voting.
+var strategy = null;
+const ranked_strategies = ["instant-runoff", "approval"];
+
+function clearPoll() {
+  document.getElementById("moves").innerHTML = "";
+  document.getElementById("switch").innerHTML = "";
+  document.getElementById("tera").innerHTML = "";
+  document.getElementById("ballot").innerHTML = "";
+  document.getElementById("voted").innerHTML = "";
+  document.getElementById("messages").innerHTML = "";
+}
+
 socket.onmessage = function (event) {
-  if (event.data == "inactive") {
-    document.getElementById("moves").innerHTML = "";
-    document.getElementById("switch").innerHTML = "";
-    document.getElementById("tera").innerHTML = "";
-    document.getElementById("messages").innerHTML = "";
-    document.getElementById("messages").innerHTML = "Please wait...";
-    return;
+  console.log("Message from server:", event.data);
+  const recv = JSON.parse(event.data);
+  const content = recv.content;
+  switch (recv.type) {
+    case "WELCOME":
+      console.log(`Speaking protocol version ${content.version}`);
+      return;
+    case "ERROR":
+      console.error(`Server couldn't handle our ${content.type ?? "message"}:`, content);
+      if (content.type == "VOTE") {
+        // The server keeps any earlier vote for the slot
+        pending = null;
+      }
+      document.getElementById("messages").innerHTML = `Error: ${content.message}`;
+      return;
+    case "DISPLAY_TEXT":
+      if (content.clear) {
+        clearPoll();
+        results = null;
+        voted = [];
+      }
+      document.getElementById("messages").innerHTML = content.message;
+      return;
+    case "VOTE_OK":
+      document.getElementById("messages").innerHTML = "Vote counted!";
+      if (pending != null) {
+        voted[pending.slot] = pending.ballot;
+        pending = null;
+        showVoted();
+      }
+      return;
+    case "RESULTS_DELTA":
+      applyDelta(content);
+      return;
+    case "BATTLE_LOG":
+      showLog(content);
+      return;
+    case "UPDATE_RESP":
+      strategy = content.strategy ?? null;
+      if (content.results) {
+        results = content;
+        showResults(results.update, results.total);
+      } else {
+        showPoll(content.update);
+      }
+      showField(content.field);
+      return;
   }
-  if (event. data == "uperr") {
-    document.getElementById("messages").innerHTML =
-      "Error getting update from server.";
+};
+
+function showPoll(req) {
+  clearPoll();
+  document.getElementById("results").innerHTML = "";
+  results = null;
+  tera = [];
+  ballots = [];
+  voted = [];
+  poll = req;
+  if (req.wait) {
     return;
   }
-  const recv = JSON.parse(event.data);
-  if (Array.isArray(recv)) {
-    document.getElementById("messages").innerHTML = event.data;
+  if (req.teamPreview) {
+    showTeamPreview(req.side.pokemon);
     return;
   }
-  if (recv.wait) {
-    return;
+  const force_switch = req.forceSwitch ?? [];
+  const slots = Math.max(req.active?.length ?? 0, force_switch.length);
+  for (let slot = 0; slot < slots; slot++) {
+    if (force_switch.length == 0) {
+      showActive(req.active[slot], slot, slots);
+      showTera(req.active[slot], slot);
+    }
+    if (force_switch.length == 0 || force_switch[slot]) {
+      showSide(req.side.pokemon, slot);
+    }
   }
-  document.getElementById("moves").innerHTML = "";
-  document.getElementById("switch").innerHTML = "";
-  document.getElementById("tera").innerHTML = "";
-  document.getElementById("messages").innerHTML = "";
-  var must_switch = recv.forceSwitch?.[0];
-  if (must_switch != true) {
-    showActive(recv.active[0]);
+  if (ranked_strategies.includes(strategy)) {
+    showBallots();
   }
-  showSide(recv.side.pokemon);
-  console.log("Message from server:", event.data);
-};
+}
 
 socket.onerror = function (error) {
   console.error("WebSocket Error:", error);
@@ -55,45 +127,450 @@ socket.onclose = function (event) {
   }
 };
 
-function showActive(active) {
+// Move targets that the voter picks in doubles and triples
+const chosen_targets = [
+  "normal",
+  "any",
+  "adjacentAlly",
+  "adjacentFoe",
+  "adjacentAllyOrSelf",
+];
+
+// Reports whether a move from the slot can hit the target, the same way the server checks
+// votes. Foes are 1 to slots and allies -1 to -slots.
+function validTarget(slot, slots, move_target, target) {
+  if (target > 0) {
+    if (move_target == "adjacentAlly" || move_target == "adjacentAllyOrSelf") {
+      return false;
+    }
+    // Foe slots are mirrored, so our slot 0 faces their last slot
+    return move_target == "any" || Math.abs(slots - 1 - slot - (target - 1)) <= 1;
+  }
+  const ally = -target - 1;
+  switch (move_target) {
+    case "adjacentFoe":
+      return false;
+    case "adjacentAllyOrSelf":
+      return Math.abs(ally - slot) <= 1;
+    case "any":
+      return ally != slot;
+  }
+  return ally != slot && Math.abs(ally - slot) <= 1;
+}
+
+// The targets to offer for a move, foes first, or just 0 when it doesn't take one
+function targetsFor(move, slot, slots) {
+  if (slots < 2 || !chosen_targets.includes(move.target)) {
+    return [0];
+  }
+  var targets = [];
+  for (let t = 1; t <= slots; t++) {
+    targets.push(t);
+  }
+  for (let t = 1; t <= slots; t++) {
+    targets.push(-t);
+  }
+  targets = targets.filter((t) => validTarget(slot, slots, move.target, t));
+  return targets.length > 0 ? targets : [0];
+}
+
+// Whether the voter wants each slot to terastallize with its move
+var tera = [];
+
+function showTera(active, slot) {
+  if (!active.canTerastallize) {
+    return;
+  }
+  var tdiv = document.getElementById("tera");
+  var label = document.createElement("label");
+  var box = document.createElement("input");
+  box.type = "checkbox";
+  box.checked = tera[slot] ?? false;
+  box.addEventListener("change", (e) => {
+    tera[slot] = e.target.checked;
+  });
+  label.appendChild(box);
+  label.append(` Terastallize ${active.canTerastallize} with slot ${slot + 1}'s move`);
+  tdiv.appendChild(label);
+  tdiv.appendChild(document.createElement("br"));
+}
+
+function showActive(active, slot, slots) {
   var adiv = document.getElementById("moves");
-  adiv.innerHTML = "";
   var i = 0;
   for (const move of active.moves) {
-    var b = document.createElement("button");
-    b.innerHTML = `${move.move}\n${move.pp}/${move.maxpp}`;
-    b.addEventListener("click", makeVote(i, "move"));
-    b.disabled = move.disabled;
+    for (const target of targetsFor(move, slot, slots)) {
+      var b = document.createElement("button");
+      b.innerHTML = `${move.move}\n${move.pp}/${move.maxpp}`;
+      if (move.dex) {
+        b.innerHTML += `\n${move.dex.type} ${move.dex.category}`;
+        if (move.dex.basePower) {
+          b.innerHTML += ` ${move.dex.basePower}`;
+        }
+        b.title = move.dex.shortDesc;
+      }
+      if (target > 0) {
+        b.innerHTML += `\n→ foe ${target}`;
+      } else if (target < 0) {
+        b.innerHTML += `\n→ ally ${-target}`;
+      }
+      for (const hint of hintsFor(move, target)) {
+        b.innerHTML += `\n${hint.target}: ${hint.min}-${hint.max}% (${hint.summary})`;
+      }
+      b.addEventListener("click", makeVote(i, "move", slot, target));
+      tagChoice(b, slot, { type: "move", idx: i, target: target });
+      b.disabled = move.disabled;
+      adiv.appendChild(b);
+    }
     i++;
-    adiv.appendChild(b);
   }
+  adiv.appendChild(document.createElement("br"));
 }
 
-function showSide(side) {
+// The damage estimates for a move button: the one against the foe it targets, or all of
+// them when the move doesn't need a target picked
+function hintsFor(move, target) {
+  const hints = move.hints ?? [];
+  if (target > 0) {
+    return hints.filter((h) => h.location == target);
+  }
+  return target < 0 ? [] : hints;
+}
+
+function showSide(side, slot) {
   var sdiv = document.getElementById("switch");
-  sdiv.innerHTML = "";
   var i = 0;
   for (const p of side) {
     var b = document.createElement("button");
     b.innerHTML = `${p.details} ${p.condition}`;
+    describeDex(b, p.dex);
     if (p.active || p.condition === "0 fnt") {
       b.disabled = true;
     }
-    b.addEventListener("click", makeVote(i, "switch"));
+    b.addEventListener("click", makeVote(i, "switch", slot, 0));
+    tagChoice(b, slot, { type: "switch", idx: i, target: 0 });
+    i++;
+    sdiv.appendChild(b);
+  }
+  sdiv.appendChild(document.createElement("br"));
+}
+
+// Adds a pokemon's types to its button, and its ability, item and moves to the tooltip
+function describeDex(b, info) {
+  if (!info) {
+    return;
+  }
+  if (info.types) {
+    b.innerHTML += `\n${info.types.join("/")}`;
+  }
+  var tips = [];
+  for (const effect of [info.ability, info.item]) {
+    if (effect) {
+      tips.push(`${effect.name}: ${effect.shortDesc}`);
+    }
+  }
+  for (const move of info.moves ?? []) {
+    if (move) {
+      tips.push(`${move.name} (${move.type} ${move.category}${move.basePower ? " " + move.basePower : ""})`);
+    }
+  }
+  b.title = tips.join("\n");
+}
+
+// Voters click pokemon in the order they want them brought, then submit.
+// Submitting after a single click votes for just the lead.
+function showTeamPreview(side) {
+  var sdiv = document.getElementById("switch");
+  var order = [];
+  var i = 0;
+  for (const p of side) {
+    var b = document.createElement("button");
+    b.innerHTML = p.details;
+    describeDex(b, p.dex);
+    b.addEventListener("click", ((idx) => (e) => {
+      order.push(idx);
+      e.target.disabled = true;
+      e.target.innerHTML += ` (${order.length})`;
+    })(i));
     i++;
     sdiv.appendChild(b);
   }
+  var submit = document.createElement("button");
+  submit.innerHTML = "Vote";
+  submit.addEventListener("click", (e) => {
+    if (order.length == 0) {
+      return;
+    }
+    send("VOTE", {
+      type: "team",
+      order: order,
+      tera: false,
+    });
+    pending = { slot: 0, ballot: [{ type: "team", order: [...order] }] };
+  });
+  sdiv.appendChild(document.createElement("br"));
+  sdiv.appendChild(submit);
 }
 
-function makeVote(i, t) {
+function makeVote(i, t, slot, target) {
   return (e) => {
-    socket.send(
-      "v" +
-        JSON.stringify({
-          type: t,
-          idx: i,
-          tera: false,
-        }),
-    );
+    const choice = { type: t, idx: i, target: target };
+    if (ranked_strategies.includes(strategy)) {
+      pick(slot, choice);
+    } else {
+      sendVote(slot, [choice]);
+    }
   };
 }
+
+// Votes for the choices in order of preference. Only the first choice's target is sent.
+function sendVote(slot, ballot) {
+  pending = { slot: slot, ballot: [...ballot] };
+  const [first, ...rest] = ballot;
+  send("VOTE", {
+    slot: slot,
+    type: first.type,
+    idx: first.idx,
+    target: first.target,
+    tera: first.type == "move" && (tera[slot] ?? false),
+    also: rest.map((c) => ({ type: c.type, idx: c.idx })),
+  });
+}
+
+// The request being voted on, and the choices picked so far for each of its slots in a
+// ranked or approval poll
+var poll = null;
+var ballots = [];
+
+// Adds a choice to the end of the slot's ballot. Picking it again takes it back off, and
+// picking the same move with another target changes the target.
+function pick(slot, choice) {
+  var ballot = ballots[slot] ?? [];
+  const at = ballot.findIndex((c) => c.type == choice.type && c.idx == choice.idx);
+  if (at < 0) {
+    ballot.push(choice);
+  } else if (ballot[at].target != choice.target) {
+    ballot[at] = choice;
+  } else {
+    ballot.splice(at, 1);
+  }
+  ballots[slot] = ballot;
+  showBallots();
+}
+
+function choiceName(slot, c) {
+  if (c.type == "team") {
+    return c.order.map((idx) => poll.side.pokemon[idx].details).join(", ");
+  }
+  if (c.type == "switch") {
+    return poll.side.pokemon[c.idx].details;
+  }
+  var name = poll.active[slot].moves[c.idx].move;
+  if (c.target > 0) {
+    name += ` → foe ${c.target}`;
+  } else if (c.target < 0) {
+    name += ` → ally ${-c.target}`;
+  }
+  return name;
+}
+
+// Shows each slot's ballot so far, with buttons to vote it in or start over
+function showBallots() {
+  var bdiv = document.getElementById("ballot");
+  bdiv.innerHTML =
+    strategy == "approval"
+      ? "Pick every choice you'd be happy with, then vote.<br>"
+      : "Pick your choices from most to least preferred, then vote.<br>";
+  ballots.forEach((ballot, slot) => {
+    if (ballot.length == 0) {
+      return;
+    }
+    const names = ballot.map((c, i) => (strategy == "approval" ? "" : `${i + 1}. `) + choiceName(slot, c));
+    bdiv.append(`Slot ${slot + 1}: ${names.join(", ")} `);
+    var submit = document.createElement("button");
+    submit.innerHTML = "Vote";
+    submit.addEventListener("click", (e) => sendVote(slot, ballot));
+    var clear = document.createElement("button");
+    clear.innerHTML = "Clear";
+    clear.addEventListener("click", (e) => {
+      ballots[slot] = [];
+      showBallots();
+    });
+    bdiv.appendChild(submit);
+    bdiv.appendChild(clear);
+    bdiv.appendChild(document.createElement("br"));
+  });
+}
+
+// The ballot the server has counted for each slot, and the one we're waiting to hear back
+// about
+var voted = [];
+var pending = null;
+
+// Marks a button with the choice it votes for, so it can be highlighted once voted for
+function tagChoice(b, slot, choice) {
+  b.dataset.slot = slot;
+  b.dataset.type = choice.type;
+  b.dataset.idx = choice.idx;
+  b.dataset.target = choice.target;
+}
+
+// Highlights the buttons of the choices we've voted for, the first choice in bold, and
+// lists each slot's vote with a button to take it back
+function showVoted() {
+  for (const b of document.querySelectorAll("#moves button, #switch button")) {
+    if (b.dataset.slot === undefined) {
+      continue;
+    }
+    const ballot = voted[b.dataset.slot] ?? [];
+    const rank = ballot.findIndex(
+      (c) => c.type == b.dataset.type && c.idx == b.dataset.idx && c.target == b.dataset.target,
+    );
+    b.style.outline = rank >= 0 ? "2px solid #2a7" : "";
+    b.style.fontWeight = rank == 0 ? "bold" : "";
+  }
+  var vdiv = document.getElementById("voted");
+  vdiv.innerHTML = "";
+  voted.forEach((ballot, slot) => {
+    if (ballot == null) {
+      return;
+    }
+    const label = poll.teamPreview ? "Your team order" : `Your vote for slot ${slot + 1}`;
+    vdiv.append(`${label}: ${ballot.map((c) => choiceName(slot, c)).join(", ")} `);
+    var retract = document.createElement("button");
+    retract.innerHTML = "Retract";
+    retract.addEventListener("click", (e) => {
+      send("RETRACT", { slot: slot });
+      voted[slot] = null;
+      if (poll.teamPreview) {
+        // Start the order over
+        showPoll(poll);
+      } else {
+        showVoted();
+      }
+    });
+    vdiv.appendChild(retract);
+    vdiv.appendChild(document.createElement("br"));
+  });
+}
+
+// The room and last line of the battle log we've shown
+var logRoom = null;
+var logSeq = 0;
+
+function showLog(log) {
+  var ldiv = document.getElementById("log");
+  if (log.room != logRoom) {
+    ldiv.innerHTML = "";
+    logRoom = log.room;
+    logSeq = 0;
+  }
+  for (const line of log.lines) {
+    if (line.seq <= logSeq) {
+      continue;
+    }
+    logSeq = line.seq;
+    var p = document.createElement("div");
+    p.textContent = line.text;
+    if (line.kind == "turn") {
+      p.style.fontWeight = "bold";
+    }
+    ldiv.appendChild(p);
+  }
+  ldiv.scrollTop = ldiv.scrollHeight;
+}
+
+// Shows what we're up against: the opponents' pokemon, and the weather, terrain and
+// hazards on the field
+function showField(field) {
+  var fdiv = document.getElementById("field");
+  fdiv.innerHTML = "";
+  if (field == null) {
+    return;
+  }
+  const conditions = (c) =>
+    Object.entries(c ?? {})
+      .map(([name, layers]) => (layers > 1 ? `${name} x${layers}` : name))
+      .join(", ");
+  const effects = [field.weather, field.terrain, ...(field.field ?? [])].filter((e) => e);
+  if (effects.length > 0) {
+    fdiv.innerHTML += `Field: ${effects.join(", ")}<br>`;
+  }
+  if (field.conditions) {
+    fdiv.innerHTML += `Our side: ${conditions(field.conditions)}<br>`;
+  }
+  for (const opp of field.opponents ?? []) {
+    fdiv.innerHTML += `${opp.username}'s side: ${conditions(opp.conditions)}<br>`;
+    for (const p of opp.active ?? []) {
+      if (p != null) {
+        fdiv.innerHTML += `Out: ${describe(p)}<br>`;
+      }
+    }
+    const bench = (opp.team ?? []).filter((p) => !p.active).map(describe);
+    const unseen = Math.max(0, opp.teamSize - (opp.team?.length ?? 0));
+    if (unseen > 0) {
+      bench.push(`${unseen} unseen`);
+    }
+    if (bench.length > 0) {
+      fdiv.innerHTML += `Team: ${bench.join(", ")}<br>`;
+    }
+  }
+}
+
+function describe(p) {
+  if (p.fainted) {
+    return `${p.species} (fainted)`;
+  }
+  var s = `${p.species} ${p.hp}%`;
+  if (p.types) {
+    s += ` [${p.types.join("/")}]`;
+  }
+  if (p.status) {
+    s += ` ${p.status}`;
+  }
+  if (p.terastallized) {
+    s += ` (tera ${p.teraType})`;
+  }
+  for (const [stat, n] of Object.entries(p.boosts ?? {})) {
+    s += ` ${n > 0 ? "+" : ""}${n} ${stat}`;
+  }
+  return s;
+}
+
+// Applies the changed shares to the results we were shown. If we missed some, the
+// server sends the results in full instead.
+function applyDelta(delta) {
+  if (results == null || results.poll != delta.poll || results.version != delta.from) {
+    send("UPDATE_REQ");
+    return;
+  }
+  for (const change of delta.changes) {
+    var target = results.update;
+    for (const key of change.path.split(".")) {
+      target = target[key];
+    }
+    target[change.field] = change.share;
+  }
+  results.version = delta.to;
+  results.total = delta.total;
+  showResults(results.update, results.total);
+}
+
+function showResults(req, total) {
+  var rdiv = document.getElementById("results");
+  rdiv.innerHTML = `${total} votes<br>`;
+  const pct = (share) => `${Math.round((share ?? 0) * 100)}%`;
+  for (const active of req.active ?? []) {
+    for (const move of active.moves) {
+      rdiv.innerHTML += `${move.move}: ${pct(move.votes)}<br>`;
+    }
+    if (active.canTerastallize) {
+      rdiv.innerHTML += `Terastallize: ${pct(active.teraVotes)}<br>`;
+    }
+  }
+  for (const p of req.side.pokemon) {
+    if (p.votes) {
+      rdiv.innerHTML += `${p.details}: ${pct(p.votes)}<br>`;
+    }
+  }
+}
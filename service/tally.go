@@ -0,0 +1,229 @@
+package service
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"surrealchemist.com/mass-showdown-backend/config"
+)
+
+// One of the choices a slot can make: a move or a switch, by index.
+type Choice struct {
+	Type string `json:"type"`
+	Idx  int    `json:"idx"`
+}
+
+// A voter's choices for a slot, in order of preference.
+type Ballot []Choice
+
+// Decides which choice a slot makes from the ballots cast for it. Targets and
+// terastallizing are still decided by plurality once the choice is made.
+type TallyStrategy interface {
+	// The name the strategy is configured by and shown to voters as.
+	Name() string
+	// Picks the winner from candidates, which are never empty and are listed in the order
+	// ties are broken in. Choices on ballots that aren't candidates any more, like a pokemon
+	// another slot is switching in, are skipped.
+	Winner(candidates []Choice, ballots []Ballot) Choice
+	// Reports whether the winner would only be decided by breaking a tie, so the poll is
+	// worth keeping open for more votes.
+	Tied(candidates []Choice, ballots []Ballot) bool
+}
+
+// Returns the strategy with the given name, as used in the config.
+func TallyStrategyByName(name string) (TallyStrategy, error) {
+	switch name {
+	case config.TallyPlurality:
+		return Plurality{}, nil
+	case config.TallyInstantRunoff:
+		return InstantRunoff{}, nil
+	case config.TallyApproval:
+		return Approval{}, nil
+	case config.TallyWeightedRandom:
+		return &WeightedRandom{}, nil
+	}
+	return nil, fmt.Errorf("unknown tally strategy %q", name)
+}
+
+// Returns the strategy for polls in the battle room, which is the one configured for the
+// battle's format if there is one. Room IDs look like "battle-gen9randombattle-123".
+func (p *PollServer) strategyFor(room string) TallyStrategy {
+	parts := strings.Split(room, "-")
+	if len(parts) > 1 {
+		if s, ok := p.formatStrategies[parts[1]]; ok {
+			return s
+		}
+	}
+	return p.strategy
+}
+
+// Counts each ballot once, for its highest choice that's still a candidate.
+func firstChoices(candidates []Choice, ballots []Ballot, skip map[Choice]bool) map[Choice]int {
+	valid := make(map[Choice]bool, len(candidates))
+	for _, c := range candidates {
+		valid[c] = !skip[c]
+	}
+	counts := make(map[Choice]int)
+	for _, b := range ballots {
+		for _, c := range b {
+			if valid[c] {
+				counts[c]++
+				break
+			}
+		}
+	}
+	return counts
+}
+
+// Returns the candidate with the most votes, with ties going to the earliest.
+func mostVoted(candidates []Choice, counts map[Choice]int) Choice {
+	winner := candidates[0]
+	for _, c := range candidates[1:] {
+		if counts[c] > counts[winner] {
+			winner = c
+		}
+	}
+	return winner
+}
+
+// Whether the most votes any candidate has are shared with another candidate.
+func topTied(candidates []Choice, counts map[Choice]int) bool {
+	tallies := make([]int, len(candidates))
+	for i, c := range candidates {
+		tallies[i] = counts[c]
+	}
+	first, second := topTwo(tallies)
+	return first > 0 && first == second
+}
+
+// The choice with the most first preferences wins.
+type Plurality struct{}
+
+func (Plurality) Name() string { return config.TallyPlurality }
+
+func (Plurality) Winner(candidates []Choice, ballots []Ballot) Choice {
+	return mostVoted(candidates, firstChoices(candidates, ballots, nil))
+}
+
+func (Plurality) Tied(candidates []Choice, ballots []Ballot) bool {
+	return topTied(candidates, firstChoices(candidates, ballots, nil))
+}
+
+// Ranked choice voting. Until a choice has a majority of the first preferences, the choice
+// with the fewest is eliminated and its ballots go to their next preference. Ties for
+// elimination knock out the latest candidate.
+type InstantRunoff struct{}
+
+func (InstantRunoff) Name() string { return config.TallyInstantRunoff }
+
+func (InstantRunoff) Winner(candidates []Choice, ballots []Ballot) Choice {
+	winner, _ := runoff(candidates, ballots)
+	return winner
+}
+
+// Tied when the last two choices standing had as many votes as each other.
+func (InstantRunoff) Tied(candidates []Choice, ballots []Ballot) bool {
+	_, tied := runoff(candidates, ballots)
+	return tied
+}
+
+func runoff(candidates []Choice, ballots []Ballot) (winner Choice, tied bool) {
+	eliminated := make(map[Choice]bool)
+	remaining := len(candidates)
+	for {
+		counts := firstChoices(candidates, ballots, eliminated)
+		total := 0
+		for _, n := range counts {
+			total += n
+		}
+		var leader, loser Choice
+		leaderCt, loserCt := -1, -1
+		for _, c := range candidates {
+			if eliminated[c] {
+				continue
+			}
+			if counts[c] > leaderCt {
+				leader, leaderCt = c, counts[c]
+			}
+			if loserCt < 0 || counts[c] <= loserCt {
+				loser, loserCt = c, counts[c]
+			}
+		}
+		if remaining == 1 || leaderCt*2 > total || total == 0 {
+			return leader, tied && remaining == 1
+		}
+		tied = topTied(candidates, counts) && remaining == 2
+		eliminated[loser] = true
+		remaining--
+	}
+}
+
+// Every choice on a ballot counts as one vote, regardless of order.
+type Approval struct{}
+
+func (Approval) Name() string { return config.TallyApproval }
+
+func (Approval) Winner(candidates []Choice, ballots []Ballot) Choice {
+	return mostVoted(candidates, approvals(candidates, ballots))
+}
+
+func (Approval) Tied(candidates []Choice, ballots []Ballot) bool {
+	return topTied(candidates, approvals(candidates, ballots))
+}
+
+func approvals(candidates []Choice, ballots []Ballot) map[Choice]int {
+	valid := make(map[Choice]bool, len(candidates))
+	for _, c := range candidates {
+		valid[c] = true
+	}
+	counts := make(map[Choice]int)
+	for _, b := range ballots {
+		seen := make(map[Choice]bool, len(b))
+		for _, c := range b {
+			if valid[c] && !seen[c] {
+				counts[c]++
+				seen[c] = true
+			}
+		}
+	}
+	return counts
+}
+
+// Chaos mode: picks a choice at random, weighted by its first preferences, so every choice
+// with a vote has a chance. With no votes, the first candidate is picked.
+type WeightedRandom struct {
+	// Where randomness comes from. Uses the math/rand default source if nil.
+	Rand *rand.Rand
+}
+
+func (*WeightedRandom) Name() string { return config.TallyWeightedRandom }
+
+func (w *WeightedRandom) Winner(candidates []Choice, ballots []Ballot) Choice {
+	counts := firstChoices(candidates, ballots, nil)
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	if total == 0 {
+		return candidates[0]
+	}
+	var pick int
+	if w.Rand != nil {
+		pick = w.Rand.Intn(total)
+	} else {
+		pick = rand.Intn(total)
+	}
+	for _, c := range candidates {
+		if pick < counts[c] {
+			return c
+		}
+		pick -= counts[c]
+	}
+	return candidates[0]
+}
+
+// The draw is random anyway, so more votes wouldn't settle anything.
+func (*WeightedRandom) Tied(candidates []Choice, ballots []Ballot) bool {
+	return false
+}
@@ -0,0 +1,171 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+	"surrealchemist.com/mass-showdown-backend/config"
+)
+
+var (
+	move1   = Choice{Type: "move", Idx: 0}
+	move2   = Choice{Type: "move", Idx: 1}
+	switch4 = Choice{Type: "switch", Idx: 3}
+)
+
+func TestTallyStrategies(t *testing.T) {
+	candidates := []Choice{move1, move2, switch4}
+	// move1 leads on first preferences, but everyone else prefers switch4 to it
+	ballots := []Ballot{
+		{move1},
+		{move1},
+		{move1},
+		{move1},
+		{move2, switch4},
+		{move2, switch4},
+		{switch4, move2},
+		{switch4, move2},
+		{switch4, move2},
+	}
+	cases := map[TallyStrategy]Choice{
+		Plurality{}:     move1,
+		InstantRunoff{}: switch4,
+		Approval{}:      move2,
+	}
+	for s, want := range cases {
+		if got := s.Winner(candidates, ballots); got != want {
+			t.Errorf("Expected %s to pick %+v but got %+v", s.Name(), want, got)
+		}
+	}
+}
+
+func TestTallyTies(t *testing.T) {
+	candidates := []Choice{move1, move2, switch4}
+	ballots := []Ballot{{move2}, {switch4}}
+	for _, s := range []TallyStrategy{Plurality{}, InstantRunoff{}, Approval{}} {
+		if got := s.Winner(candidates, ballots); got != move2 {
+			t.Errorf("Expected %s to break ties by candidate order but got %+v", s.Name(), got)
+		}
+		if !s.Tied(candidates, ballots) {
+			t.Errorf("Expected %s to report the tie", s.Name())
+		}
+		if s.Tied(candidates, append(ballots, Ballot{move2})) {
+			t.Errorf("Expected %s to report no tie once one choice leads", s.Name())
+		}
+		if got := s.Winner(candidates, nil); got != move1 {
+			t.Errorf("Expected %s to pick the first candidate with no votes but got %+v", s.Name(), got)
+		}
+	}
+}
+
+func TestWeightedRandom(t *testing.T) {
+	candidates := []Choice{move1, move2, switch4}
+	ballots := []Ballot{{move2}, {move2}, {move2}, {switch4}}
+	w := &WeightedRandom{Rand: rand.New(rand.NewSource(1))}
+	picks := make(map[Choice]int)
+	for i := 0; i < 1000; i++ {
+		picks[w.Winner(candidates, ballots)]++
+	}
+	if picks[move1] != 0 {
+		t.Errorf("Expected choices without votes never to be picked but got %d", picks[move1])
+	}
+	if picks[move2] < 650 || picks[move2] > 850 || picks[switch4] < 150 {
+		t.Errorf("Expected picks to follow the votes 3 to 1 but got %v", picks)
+	}
+}
+
+func TestPollUsesStrategy(t *testing.T) {
+	po := newTestPoll(t, doublesRequest)
+	po.Strategy = InstantRunoff{}
+	votes := []*Vote{
+		{Slot: 0, Type: "move", Idx: 0},
+		{Slot: 0, Type: "move", Idx: 0},
+		{Slot: 0, Type: "switch", Idx: 3, Also: []Choice{{Type: "move", Idx: 1}}},
+		{Slot: 0, Type: "move", Idx: 1, Target: 1},
+		{Slot: 0, Type: "move", Idx: 1, Target: 1},
+	}
+	for _, v := range votes {
+		if err := po.addVote(v); err != nil {
+			t.Fatalf("Expected vote %+v to be valid but got %v", v, err)
+		}
+	}
+	bad := &Vote{Slot: 0, Type: "move", Idx: 0, Also: []Choice{{Type: "switch", Idx: 1}}}
+	if err := po.addVote(bad); err != errActivePokemon {
+		t.Errorf("Expected further choices to be validated but got %v", err)
+	}
+	dup := &Vote{Slot: 0, Type: "move", Idx: 0, Also: []Choice{{Type: "move", Idx: 0}}}
+	if err := po.addVote(dup); err != errDuplicateChoice {
+		t.Errorf("Expected repeated choices to be rejected but got %v", err)
+	}
+	if cmd := po.command(); cmd != "/choose move 2 1, move 1" {
+		t.Errorf("Expected the switch vote to go to Thunderbolt but got '%s'", cmd)
+	}
+}
+
+func TestStrategyPerFormat(t *testing.T) {
+	cfg := config.Default()
+	cfg.Poll.FormatStrategies = config.StringMap{"gen9OU": config.TallyApproval}
+	p := NewPollServer(&sync.WaitGroup{}, cfg)
+	if s := p.strategyFor("battle-gen9ou-123"); s.Name() != config.TallyApproval {
+		t.Errorf("Expected the format's strategy but got %s", s.Name())
+	}
+	if s := p.strategyFor("battle-gen9randombattle-456"); s.Name() != config.TallyPlurality {
+		t.Errorf("Expected the default strategy for other formats but got %s", s.Name())
+	}
+}
+
+func TestRankedBallotsOverWebsocket(t *testing.T) {
+	cfg := config.Default()
+	cfg.Poll.Strategy = config.TallyInstantRunoff
+	cfg.Poll.CloseWhenAllVoted = false
+	p := NewPollServer(&sync.WaitGroup{}, cfg)
+	p.log = zap.NewNop().Sugar()
+	srv := httptest.NewServer(http.HandlerFunc(p.wsServerHandler))
+	defer srv.Close()
+	p.cfg.AuthorizedHosts = config.StringList{strings.TrimPrefix(srv.URL, "http://")}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.manage(ctx)
+	req := &PSBattleRequest{}
+	if err := json.Unmarshal([]byte(doublesRequest), req); err != nil {
+		t.Fatal(err)
+	}
+	p.serverInbox <- &message{
+		Type:    showdownRequest,
+		Content: showdownRequestMessage{RoomID: "battle-1", Req: req},
+	}
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	// As in TestPollUsesStrategy, the switch voter's second choice decides it
+	ballots := []map[string]interface{}{
+		{"type": "move", "idx": 0},
+		{"type": "move", "idx": 0},
+		{"type": "switch", "idx": 3, "also": []Choice{{Type: "move", Idx: 1}}},
+		{"type": "move", "idx": 1, "target": 1},
+		{"type": "move", "idx": 1, "target": 1},
+	}
+	for _, b := range ballots {
+		ws, _ := dialVoter(t, url, nil)
+		defer ws.Close()
+		var poll updateResponseMessage
+		json.Unmarshal(readUntil(t, ws, updateResponse), &poll)
+		if poll.Strategy != config.TallyInstantRunoff {
+			t.Fatalf("Expected voters to be told the poll is instant runoff but got %q", poll.Strategy)
+		}
+		ws.WriteJSON(map[string]interface{}{"type": vote, "content": b})
+		readUntil(t, ws, voteOk)
+	}
+	po := p.open.get("battle-1")
+	if po == nil {
+		t.Fatal("Expected the poll to still be open")
+	}
+	if cmd := po.command(); cmd != "/choose move 2 1, move 1" {
+		t.Errorf("Expected the switch vote to go to Thunderbolt but got '%s'", cmd)
+	}
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"time"
+
+	"surrealchemist.com/mass-showdown-backend/config"
+)
+
+// How long after the battle timer is reported a new poll still goes by it. The timer is
+// reported around the same time as the request it applies to, in either order.
+const timerGrace = 2 * time.Second
+
+// Makes the poll close by deadline at the latest.
+func (po *Poll) capAt(deadline time.Time) {
+	po.Deadline = deadline
+	if po.EndsAt.After(deadline) {
+		po.EndsAt = deadline
+	}
+}
+
+// Decides whether the poll should close at now, given the voters connected to its room.
+// Polls close early once the quorum is reached or every voter has voted, and a tied poll
+// is extended instead of closing, as long as the battle timer allows. Reports whether
+// the poll was extended.
+func (po *Poll) closes(cfg config.Poll, voters []string, now time.Time) (closes, extended bool) {
+	if !po.Deadline.IsZero() && !now.Before(po.Deadline) {
+		return true, false
+	}
+	t := po.tally()
+	if t.Total > 0 {
+		if cfg.Quorum > 0 && t.Voters >= cfg.Quorum {
+			return true, false
+		}
+		if cfg.CloseWhenAllVoted && po.allVoted(voters) {
+			return true, false
+		}
+	}
+	if now.Before(po.EndsAt) {
+		return false, false
+	}
+	if po.Extensions >= cfg.MaxTieExtensions || !po.tied(t) {
+		return true, false
+	}
+	ends := now.Add(cfg.TieExtension.Duration)
+	if !po.Deadline.IsZero() && ends.After(po.Deadline) {
+		ends = po.Deadline
+	}
+	if !ends.After(now) {
+		return true, false
+	}
+	po.EndsAt = ends
+	po.Extensions++
+	return false, true
+}
+
+// The slots that need a choice this turn.
+func (po *Poll) openSlots() []int {
+	if po.Req.TeamPreview {
+		return []int{0}
+	}
+	var slots []int
+	for i := 0; i < po.slotCount(); i++ {
+		if !po.passes(i) {
+			slots = append(slots, i)
+		}
+	}
+	return slots
+}
+
+// Whether every voter has voted for every slot that needs a choice.
+func (po *Poll) allVoted(voters []string) bool {
+	if len(voters) == 0 {
+		return false
+	}
+	slots := po.openSlots()
+	for _, voter := range voters {
+		for _, slot := range slots {
+			if !po.hasVotedFor(voter, slot) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Whether the poll's strategy would have to break a tie to pick any slot's choice, or the
+// team preview lead is tied.
+func (po *Poll) tied(t *Tally) bool {
+	if po.Req.TeamPreview {
+		first, second := topTwo(t.Team)
+		return first > 0 && first == second
+	}
+	strategy := po.tallyStrategy()
+	for _, slot := range po.openSlots() {
+		if strategy.Tied(po.candidates(slot, nil), po.ballots(slot)) {
+			return true
+		}
+	}
+	return false
+}
+
+func topTwo(tallies []int) (first, second int) {
+	for _, n := range tallies {
+		if n > first {
+			first, second = n, first
+		} else if n > second {
+			second = n
+		}
+	}
+	return first, second
+}
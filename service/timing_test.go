@@ -0,0 +1,80 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"surrealchemist.com/mass-showdown-backend/config"
+)
+
+func TestPollClosesEarly(t *testing.T) {
+	cfg := config.Default().Poll
+	if cfg.CloseWhenAllVoted {
+		t.Error("Expected polls to stay open for vote changes by default")
+	}
+	cfg.CloseWhenAllVoted = true
+	po := newTestPoll(t, doublesRequest)
+	now := po.StartedAt
+	voters := []string{"a", "b"}
+	po.addVote(&Vote{Voter: "a", Slot: 0, Type: "move", Idx: 0})
+	po.addVote(&Vote{Voter: "a", Slot: 1, Type: "move", Idx: 0})
+	po.addVote(&Vote{Voter: "b", Slot: 0, Type: "move", Idx: 0})
+	if closes, _ := po.closes(cfg, voters, now); closes {
+		t.Error("Expected the poll to stay open until b votes for every slot")
+	}
+	po.addVote(&Vote{Voter: "b", Slot: 1, Type: "switch", Idx: 3})
+	if closes, _ := po.closes(cfg, voters, now); !closes {
+		t.Error("Expected the poll to close once every voter voted")
+	}
+
+	cfg.CloseWhenAllVoted = false
+	if closes, _ := po.closes(cfg, voters, now); closes {
+		t.Error("Expected the poll to stay open without the early close rules")
+	}
+	cfg.Quorum = 2
+	if closes, _ := po.closes(cfg, voters, now); !closes {
+		t.Error("Expected the poll to close once the quorum voted")
+	}
+}
+
+func TestTiedPollIsExtended(t *testing.T) {
+	cfg := config.Default().Poll
+	po := newTestPoll(t, doublesRequest)
+	po.addVote(&Vote{Voter: "a", Slot: 0, Type: "move", Idx: 0})
+	po.addVote(&Vote{Voter: "b", Slot: 0, Type: "switch", Idx: 3})
+	closes, extended := po.closes(cfg, nil, po.EndsAt)
+	if closes || !extended {
+		t.Fatalf("Expected a tied poll to be extended but got closes=%t extended=%t", closes, extended)
+	}
+	if want := 10 * time.Second; po.EndsAt.Sub(po.StartedAt) != 30*time.Second+want {
+		t.Errorf("Expected the poll to be extended by %v but it ends %v after starting", want, po.EndsAt.Sub(po.StartedAt))
+	}
+	if closes, _ := po.closes(cfg, nil, po.EndsAt); !closes {
+		t.Error("Expected a poll that's still tied to close after its last extension")
+	}
+
+	// Ties are whatever the poll's strategy can't settle, not just even first preferences
+	po = newTestPoll(t, doublesRequest)
+	po.Strategy = Approval{}
+	po.addVote(&Vote{Voter: "a", Slot: 0, Type: "move", Idx: 0, Also: []Choice{{Type: "switch", Idx: 3}}})
+	po.addVote(&Vote{Voter: "b", Slot: 0, Type: "switch", Idx: 3})
+	if closes, extended := po.closes(cfg, nil, po.EndsAt); !closes || extended {
+		t.Errorf("Expected an approval poll with a clear winner to close but got closes=%t extended=%t", closes, extended)
+	}
+}
+
+func TestPollCappedByBattleTimer(t *testing.T) {
+	cfg := config.Default().Poll
+	po := newTestPoll(t, doublesRequest)
+	deadline := po.StartedAt.Add(12 * time.Second)
+	po.capAt(deadline)
+	if !po.EndsAt.Equal(deadline) {
+		t.Errorf("Expected the poll to end with the battle timer but it ends at %v", po.EndsAt)
+	}
+	// Ties can't be extended past the timer
+	po.addVote(&Vote{Voter: "a", Slot: 0, Type: "move", Idx: 0})
+	po.addVote(&Vote{Voter: "b", Slot: 0, Type: "move", Idx: 1, Target: 1})
+	if closes, extended := po.closes(cfg, nil, deadline); !closes || extended {
+		t.Errorf("Expected the poll to close at the battle timer but got closes=%t extended=%t", closes, extended)
+	}
+}
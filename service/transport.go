@@ -0,0 +1,87 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// Opens connections to a Showdown server.
+type Transport interface {
+	Dial(url string) (Conn, error)
+}
+
+// A connection to a Showdown server. *websocket.Conn satisfies it.
+type Conn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	WriteJSON(v interface{}) error
+	Close() error
+}
+
+// Gets the assertion a client sends with /trn to log in, given the server's challstr.
+type Authenticator interface {
+	Login(username, password, challstr string) (assertion string, err error)
+}
+
+// Connects over a real websocket.
+type WebsocketTransport struct {
+	Dialer *websocket.Dialer
+}
+
+func (t *WebsocketTransport) Dial(url string) (Conn, error) {
+	c, _, err := t.Dialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Logs in through Showdown's action.php, as the official client does.
+type ActionAuthenticator struct {
+	URL    string
+	Client *http.Client
+}
+
+type loginResponse struct {
+	ActionSuccess bool
+	Assertion     string
+	CurrentUser   map[string]interface{}
+}
+
+func (a *ActionAuthenticator) Login(username, password, challstr string) (string, error) {
+	log := zap.NewExample().Sugar().Named("login")
+	resp, err := a.Client.PostForm(a.URL, url.Values{
+		"act":      {"login"},
+		"name":     {username},
+		"pass":     {password},
+		"challstr": {challstr},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	lr := &loginResponse{}
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	// The response JSON is prefixed with "]" to stop it from being run as a script
+	if len(respBytes) == 0 {
+		return "", errors.New("empty login response")
+	}
+	err = json.Unmarshal(respBytes[1:], lr)
+	if err != nil {
+		return "", err
+	}
+	if !lr.ActionSuccess {
+		return "", errors.New("failed logging in")
+	}
+	log.Infow("Got response from server on login", zap.ByteString("response", respBytes))
+	return lr.Assertion, nil
+}
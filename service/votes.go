@@ -0,0 +1,210 @@
+package service
+
+import (
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// The open poll for each battle room. Only the manager opens and closes polls, but
+// voters' connections look them up to vote in, so votes never wait on the manager.
+type openPolls struct {
+	sync.RWMutex
+	m map[string]*Poll
+}
+
+func (op *openPolls) get(room string) *Poll {
+	op.RLock()
+	defer op.RUnlock()
+	return op.m[room]
+}
+
+// Opens the poll for votes, replacing any other poll in its room.
+func (op *openPolls) set(po *Poll) {
+	op.Lock()
+	if op.m == nil {
+		op.m = make(map[string]*Poll)
+	}
+	op.m[po.RoomID] = po
+	op.Unlock()
+}
+
+// Closes the poll, and forgets it if it's still the open one in its room.
+func (op *openPolls) close(po *Poll) {
+	op.Lock()
+	if op.m[po.RoomID] == po {
+		delete(op.m, po.RoomID)
+	}
+	op.Unlock()
+	po.close()
+}
+
+// Counts a vote in the open poll of the voter's room and tells the voter how it went.
+// Called from the voter's connection.
+func (p *PollServer) castVote(v *Vote) {
+	po := p.open.get(p.pool.RoomOf(v.From))
+	if po == nil {
+		p.log.Warnw("received vote but no poll was active",
+			zap.String("id", v.From))
+		p.pool.SendToWorker(v.From, &message{
+			Type:    protocolError,
+			Content: &errorMessage{Code: errCodeNoPoll, Type: vote, Message: "there's no poll to vote in"},
+		})
+		return
+	}
+	err := po.addVote(v)
+	p.storeVote(po, v, err)
+	if err != nil {
+		p.log.Warnw("rejected vote",
+			zap.String("id", v.From),
+			zap.Error(err))
+		// A rejected change leaves the earlier vote standing
+		if !po.hasVotedFor(v.Voter, po.voteSlot(v)) {
+			p.pool.SendToWorker(v.From, &message{
+				Type:    clearVote,
+				Content: v.Slot,
+			})
+		}
+		p.pool.SendToWorker(v.From, &message{
+			Type:    protocolError,
+			Content: voteError(err),
+		})
+		return
+	}
+	p.pool.SendToWorker(v.From, &message{
+		Type: voteOk,
+	})
+	p.wakeManager(votesChanged)
+}
+
+// Takes back a vote in the open poll of the voter's room. Called from the voter's connection.
+func (p *PollServer) retract(r retraction) {
+	po := p.open.get(p.pool.RoomOf(r.From))
+	if po == nil {
+		return
+	}
+	if err := po.retractVote(r.Voter, r.Slot); err != nil {
+		p.log.Infow("ignored retraction", zap.String("voter", r.Voter), zap.Error(err))
+		return
+	}
+	p.storeRetraction(po, r)
+	p.pool.SendToWorker(r.From, &message{
+		Type:    clearVote,
+		Content: r.Slot,
+	})
+	p.wakeManager(votesChanged)
+}
+
+// Sends the worker what it should show: the poll to vote in, the latest results once its
+// voter has voted, or a wait message between polls.
+func (p *PollServer) answerUpdate(w *pollWorker, voted bool) {
+	po := p.open.get(p.pool.RoomOf(w.id))
+	switch {
+	case po == nil:
+		p.pool.SendToWorker(w.id, &message{
+			Type: displayText,
+			Content: displayTextMessage{
+				Clear:   true,
+				Err:     false,
+				Message: "Please wait...",
+			},
+		})
+	case !voted && !po.hasVoted(w.voter):
+		p.pool.SendToWorker(w.id, p.pollMessage(po))
+	default:
+		p.pool.SendToWorker(w.id, p.resultsMessage(po, po.latestResults()))
+	}
+}
+
+// Sends what changed in every poll's results to the voters who have voted in it. Voters
+// who haven't been shown the previous results are sent them in full instead when the
+// change reaches their connection.
+func (p *PollServer) pushResults(polls map[string]*Poll) {
+	for room, po := range polls {
+		prev := po.results.Load()
+		res, changed := po.refreshResults()
+		if !changed {
+			continue
+		}
+		msg := p.resultsMessage(po, res)
+		if prev != nil {
+			msg = &message{
+				Type: resultsDelta,
+				Content: resultsDeltaMessage{
+					Poll:    po.ID,
+					From:    prev.Version,
+					To:      res.Version,
+					Total:   res.Total,
+					Changes: diffResults(prev, res),
+				},
+			}
+		}
+		p.pool.BroadcastVoted(room, po.hasVoted, msg)
+	}
+}
+
+// The poll for voters to vote in.
+func (p *PollServer) pollMessage(po *Poll) *message {
+	return &message{
+		Type: updateResponse,
+		Content: updateResponseMessage{
+			Room:     po.RoomID,
+			Results:  false,
+			Update:   po.Req,
+			Field:    p.battleView(po),
+			Strategy: po.Strategy.Name(),
+		},
+	}
+}
+
+func (p *PollServer) resultsMessage(po *Poll, res *Results) *message {
+	return &message{
+		Type: updateResponse,
+		Content: updateResponseMessage{
+			Room:     po.RoomID,
+			Results:  true,
+			Update:   res.Req,
+			Field:    p.battleView(po),
+			Strategy: po.Strategy.Name(),
+			Poll:     po.ID,
+			Version:  res.Version,
+			Total:    res.Total,
+		},
+	}
+}
+
+// The results a voter's connection was last sent.
+type shownResults struct {
+	poll    string
+	version uint64
+}
+
+// Returns the message to send the voter for a results delta, and the results they'll have
+// been shown after it. Deltas that don't follow on from what the voter was shown are
+// replaced by the poll's latest results in full, or skipped if the voter already has newer
+// ones. Returns nil if there's nothing to send.
+func (p *PollServer) resultsFor(w *pollWorker, shown shownResults, d resultsDeltaMessage) (*message, shownResults) {
+	if shown.poll == d.Poll {
+		if shown.version == d.From {
+			return &message{Type: resultsDelta, Content: d}, shownResults{d.Poll, d.To}
+		}
+		if shown.version >= d.To {
+			return nil, shown
+		}
+	}
+	po := p.open.get(p.pool.RoomOf(w.id))
+	if po == nil || po.ID != d.Poll {
+		return nil, shown
+	}
+	res := po.latestResults()
+	return p.resultsMessage(po, res), shownResults{po.ID, res.Version}
+}
+
+// Wakes the manager to check whether polls should close early. Never waits, since the
+// manager checks every poll whenever it wakes up anyway.
+func (p *PollServer) wakeManager(reason messageType) {
+	select {
+	case p.pool.managerInbox <- &message{Type: reason}:
+	default:
+	}
+}
@@ -0,0 +1,68 @@
+package showdowntest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Runs a script against the server. Each line of a script is one of:
+//
+//	# a comment
+//	login                      wait for the client to log in
+//	challenge USER FORMAT      challenge the client
+//	expect TEXT                wait for the client to send a message containing TEXT
+//	sleep DURATION             pause, e.g. "sleep 2s"
+//	send                       send the lines that follow, up to a blank line, as one frame
+//
+// Frames are sent with Send, so battle rooms can be rejoined. Waiting steps give up after timeout.
+func (s *Server) RunScript(r io.Reader, timeout time.Duration) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		var err error
+		switch cmd {
+		case "login":
+			_, err = s.WaitForLogin(timeout)
+		case "challenge":
+			user, format, ok := strings.Cut(arg, " ")
+			if !ok {
+				err = fmt.Errorf("challenge needs a user and a format")
+				break
+			}
+			err = s.Challenge(user, format)
+		case "expect":
+			_, err = s.Expect(arg, timeout)
+		case "sleep":
+			var d time.Duration
+			if d, err = time.ParseDuration(arg); err == nil {
+				time.Sleep(d)
+			}
+		case "send":
+			var frame []string
+			for sc.Scan() {
+				lineNo++
+				if sc.Text() == "" {
+					break
+				}
+				frame = append(frame, sc.Text())
+			}
+			err = s.Send(strings.Join(frame, "\n"))
+		default:
+			err = fmt.Errorf("unknown command %q", cmd)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lineNo, err)
+		}
+	}
+	return sc.Err()
+}
@@ -0,0 +1,294 @@
+// Package showdowntest provides an in-process stand-in for a Pokémon Showdown server,
+// for testing and rehearsing without a live account.
+package showdowntest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/segmentio/ksuid"
+	"surrealchemist.com/mass-showdown-backend/messages"
+)
+
+var ErrNoClient = errors.New("no client is connected")
+
+// A fake Showdown server with a websocket endpoint and an action.php login stand-in.
+// It accepts one client at a time; a new connection replaces the old one.
+//
+// Battle frames sent through the server are remembered per room, so a client that
+// rejoins a room with /join gets the room's log and latest request again, like it
+// would from the real server.
+type Server struct {
+	// The websocket URL to use as the sim URL.
+	URL string
+	// The URL to use as the login action URL.
+	ActionURL string
+
+	srv      *httptest.Server
+	upgrader websocket.Upgrader
+
+	mu sync.Mutex
+	// Held while writing to a connection, since websockets allow only one writer at a time
+	writeMu sync.Mutex
+	// Accounts that can log in, mapped to their passwords. Any login succeeds if empty.
+	accounts map[string]string
+	// Assertions handed out by the login stand-in, mapped to the user they're for
+	assertions map[string]string
+	conn       *websocket.Conn
+	// The name the current client logged in as
+	user     string
+	rooms    map[string]*room
+	commands chan string
+	loggedIn chan string
+}
+
+type room struct {
+	log     []string
+	request string
+}
+
+// Starts a fake server. Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		accounts:   make(map[string]string),
+		assertions: make(map[string]string),
+		rooms:      make(map[string]*room),
+		commands:   make(chan string, 100),
+		loggedIn:   make(chan string, 10),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/showdown/websocket", s.handleWS)
+	mux.HandleFunc("/action.php", s.handleAction)
+	s.srv = httptest.NewServer(mux)
+	s.URL = "ws" + strings.TrimPrefix(s.srv.URL, "http") + "/showdown/websocket"
+	s.ActionURL = s.srv.URL + "/action.php"
+	return s
+}
+
+// Only lets the given account log in from now on.
+func (s *Server) AddAccount(username, password string) {
+	s.mu.Lock()
+	s.accounts[messages.ToID(username)] = password
+	s.mu.Unlock()
+}
+
+func (s *Server) Close() {
+	s.Disconnect()
+	s.srv.Close()
+}
+
+// Drops the current client's connection, as if the server had hiccuped.
+func (s *Server) Disconnect() {
+	s.mu.Lock()
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	s.user = ""
+	s.mu.Unlock()
+}
+
+func (s *Server) handleAction(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.Form.Get("act") != "login" {
+		http.Error(w, "unsupported action", http.StatusBadRequest)
+		return
+	}
+	name := r.Form.Get("name")
+	s.mu.Lock()
+	pass, known := s.accounts[messages.ToID(name)]
+	ok := len(s.accounts) == 0 || (known && pass == r.Form.Get("pass"))
+	assertion := ""
+	if ok {
+		assertion = ksuid.New().String()
+		s.assertions[assertion] = messages.ToID(name)
+	}
+	s.mu.Unlock()
+	// The real server prefixes its JSON responses with "]"
+	resp, _ := json.Marshal(map[string]interface{}{
+		"actionsuccess": ok,
+		"assertion":     assertion,
+	})
+	w.Write(append([]byte("]"), resp...))
+}
+
+func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
+	c, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.conn = c
+	s.user = ""
+	s.mu.Unlock()
+	s.write(c, "|challstr|4|"+ksuid.New().String())
+	for {
+		_, bs, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		// Clients send either a JSON array of messages or a single raw message
+		var msgs []string
+		if json.Unmarshal(bs, &msgs) != nil {
+			msgs = []string{string(bs)}
+		}
+		for _, m := range msgs {
+			s.handleCommand(c, m)
+		}
+	}
+}
+
+// Handles a "ROOM|TEXT" message from the client.
+func (s *Server) handleCommand(c *websocket.Conn, msg string) {
+	roomID, text, _ := strings.Cut(msg, "|")
+	switch {
+	case strings.HasPrefix(text, "/trn "):
+		name, rest, _ := strings.Cut(strings.TrimPrefix(text, "/trn "), ",")
+		_, assertion, _ := strings.Cut(rest, ",")
+		s.mu.Lock()
+		ok := s.assertions[assertion] == messages.ToID(name)
+		if ok {
+			s.user = name
+		}
+		s.mu.Unlock()
+		if !ok {
+			s.write(c, "|popup|Invalid assertion")
+			break
+		}
+		s.write(c, fmt.Sprintf("|updateuser| %s|1|1|{}", name))
+		select {
+		case s.loggedIn <- name:
+		default:
+		}
+	case strings.HasPrefix(text, "/join "):
+		s.rejoin(c, strings.TrimSpace(strings.TrimPrefix(text, "/join ")))
+	}
+	if roomID != "" {
+		msg = roomID + "|" + text
+	} else {
+		msg = text
+	}
+	for {
+		select {
+		case s.commands <- msg:
+			return
+		default:
+			// Nobody is reading commands, so drop the oldest
+			select {
+			case <-s.commands:
+			default:
+			}
+		}
+	}
+}
+
+func (s *Server) rejoin(c *websocket.Conn, roomID string) {
+	s.mu.Lock()
+	r, ok := s.rooms[roomID]
+	var frames []string
+	if ok {
+		frames = append(frames, ">"+roomID+"\n"+strings.Join(r.log, "\n"))
+		if r.request != "" {
+			frames = append(frames, ">"+roomID+"\n|request|"+r.request)
+		}
+	} else {
+		frames = append(frames, ">"+roomID+"\n|noinit|nonexistent|The room \""+roomID+"\" does not exist.")
+	}
+	s.mu.Unlock()
+	for _, f := range frames {
+		s.write(c, f)
+	}
+}
+
+// Sends a frame to the client. Lines in frames for battle rooms are remembered for rejoins,
+// with |request| lines replacing the room's previous request instead of being logged.
+func (s *Server) Send(frame string) error {
+	s.mu.Lock()
+	if roomID, body, ok := strings.Cut(frame, "\n"); ok && strings.HasPrefix(roomID, ">battle-") {
+		r, ok := s.rooms[roomID[1:]]
+		if !ok {
+			r = &room{}
+			s.rooms[roomID[1:]] = r
+		}
+		for _, line := range strings.Split(body, "\n") {
+			if req, ok := strings.CutPrefix(line, "|request|"); ok {
+				r.request = req
+			} else {
+				r.log = append(r.log, line)
+			}
+		}
+	}
+	c := s.conn
+	s.mu.Unlock()
+	if c == nil {
+		return ErrNoClient
+	}
+	return s.write(c, frame)
+}
+
+// Sends a challenge to the logged in client.
+func (s *Server) Challenge(from, format string) error {
+	s.mu.Lock()
+	user := s.user
+	s.mu.Unlock()
+	return s.Send(fmt.Sprintf("|pm| %s| %s|/challenge %s|%s|||", from, user, format, format))
+}
+
+// Starts a battle room, sending |init| followed by the given lines.
+func (s *Server) StartBattle(roomID string, lines ...string) error {
+	s.mu.Lock()
+	delete(s.rooms, roomID)
+	s.mu.Unlock()
+	return s.Battle(roomID, append([]string{"|init|battle"}, lines...)...)
+}
+
+// Sends lines of a battle log to the room.
+func (s *Server) Battle(roomID string, lines ...string) error {
+	return s.Send(">" + roomID + "\n" + strings.Join(lines, "\n"))
+}
+
+// Sends a request to the room. req is the request JSON.
+func (s *Server) Request(roomID, req string) error {
+	return s.Send(">" + roomID + "\n|request|" + req)
+}
+
+// Waits for the client to send a message containing text, skipping other messages,
+// and returns the whole message.
+func (s *Server) Expect(text string, timeout time.Duration) (string, error) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case m := <-s.commands:
+			if strings.Contains(m, text) {
+				return m, nil
+			}
+		case <-deadline:
+			return "", fmt.Errorf("timed out waiting for client to send %q", text)
+		}
+	}
+}
+
+// Waits for a client to log in and returns the name it logged in as.
+func (s *Server) WaitForLogin(timeout time.Duration) (string, error) {
+	select {
+	case name := <-s.loggedIn:
+		return name, nil
+	case <-time.After(timeout):
+		return "", errors.New("timed out waiting for client to log in")
+	}
+}
+
+func (s *Server) write(c *websocket.Conn, frame string) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return c.WriteMessage(websocket.TextMessage, []byte(frame))
+}
@@ -0,0 +1,200 @@
+// Package store keeps the history of every poll: the request it was for, every vote cast in
+// it and the command it ended with, for analytics and settling disputes.
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A poll as it was run.
+type Poll struct {
+	ID     string `json:"id"`
+	RoomID string `json:"room"`
+	RQID   int    `json:"rqid"`
+	// The request the poll was for, as sent by the server.
+	Request   json.RawMessage `json:"request"`
+	Strategy  string          `json:"strategy,omitempty"`
+	StartedAt time.Time       `json:"startedAt"`
+	// Zero until the poll ends.
+	EndedAt time.Time `json:"endedAt"`
+	// The command sent when the poll ended, or empty if it never finished, like when the
+	// battle ended first.
+	Command string  `json:"command,omitempty"`
+	Votes   []*Vote `json:"votes,omitempty"`
+}
+
+// A vote cast in a poll, including rejected ones. A voter's latest vote for a slot replaces
+// their earlier ones.
+type Vote struct {
+	PollID string    `json:"poll"`
+	Voter  string    `json:"voter"`
+	At     time.Time `json:"at"`
+	// The vote as the voter sent it.
+	Ballot json.RawMessage `json:"ballot"`
+	// Why the vote was rejected, or empty if it was counted.
+	Error string `json:"error,omitempty"`
+	// Whether the voter took back their vote for the slot in the ballot instead.
+	Retract bool `json:"retract,omitempty"`
+}
+
+// Where poll history is kept. Implementations must be safe to use from multiple goroutines.
+type Store interface {
+	StartPoll(p *Poll) error
+	AddVote(v *Vote) error
+	EndPoll(id string, at time.Time, command string) error
+	// Returns a page of the polls matching q with their votes, oldest first.
+	Polls(q Query) ([]*Poll, error)
+	Close() error
+}
+
+// Which polls to read from a Store.
+type Query struct {
+	// The room the polls were run in, or empty for every room.
+	RoomID string
+	// How many matching polls to skip, and the most to return. Every poll after Offset is
+	// returned if Limit is 0.
+	Offset, Limit int
+}
+
+// A Store that appends every change to a file of JSON lines, so nothing written is lost
+// if the process dies. Reading history replays the file from its own file descriptor, so
+// it doesn't hold up writes.
+type FileStore struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	// How much of the file is complete lines. Reads stop there, so they never see a line
+	// that's still being written.
+	size atomic.Int64
+}
+
+// One line of the file. Exactly one field is set.
+type record struct {
+	Start *Poll    `json:"start,omitempty"`
+	Vote  *Vote    `json:"vote,omitempty"`
+	End   *pollEnd `json:"end,omitempty"`
+}
+
+type pollEnd struct {
+	ID      string    `json:"id"`
+	At      time.Time `json:"at"`
+	Command string    `json:"command,omitempty"`
+}
+
+// Opens the store at path, creating it if needed. History already in the file is kept.
+func OpenFile(path string) (*FileStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("creating poll store directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening poll store: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("opening poll store: %w", err)
+	}
+	s := &FileStore{path: path, f: f}
+	s.size.Store(info.Size())
+	return s, nil
+}
+
+func (s *FileStore) write(r record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return errors.New("poll store is closed")
+	}
+	if _, err := s.f.Write(b); err != nil {
+		return err
+	}
+	s.size.Add(int64(len(b)))
+	return nil
+}
+
+func (s *FileStore) StartPoll(p *Poll) error {
+	// Votes are written as they come in
+	start := *p
+	start.Votes = nil
+	return s.write(record{Start: &start})
+}
+
+func (s *FileStore) AddVote(v *Vote) error {
+	return s.write(record{Vote: v})
+}
+
+func (s *FileStore) EndPoll(id string, at time.Time, command string) error {
+	return s.write(record{End: &pollEnd{ID: id, At: at, Command: command}})
+}
+
+func (s *FileStore) Polls(q Query) ([]*Poll, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readPolls(io.NewSectionReader(f, 0, s.size.Load()), q)
+}
+
+// Replays the file, keeping only the polls on the page asked for.
+func readPolls(r io.Reader, q Query) ([]*Poll, error) {
+	var polls []*Poll
+	byID := make(map[string]*Poll)
+	matched := 0
+	sc := bufio.NewScanner(r)
+	// Requests for big teams run to several kilobytes
+	sc.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		var rec record
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("poll store line %d: %w", line, err)
+		}
+		switch {
+		case rec.Start != nil:
+			if q.RoomID != "" && rec.Start.RoomID != q.RoomID {
+				continue
+			}
+			matched++
+			if matched > q.Offset && (q.Limit == 0 || len(polls) < q.Limit) {
+				polls = append(polls, rec.Start)
+				byID[rec.Start.ID] = rec.Start
+			}
+		case rec.Vote != nil:
+			if p, ok := byID[rec.Vote.PollID]; ok {
+				p.Votes = append(p.Votes, rec.Vote)
+			}
+		case rec.End != nil:
+			if p, ok := byID[rec.End.ID]; ok {
+				p.EndedAt = rec.End.At
+				p.Command = rec.End.Command
+			}
+		}
+	}
+	return polls, sc.Err()
+}
+
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
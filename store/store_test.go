@@ -0,0 +1,74 @@
+package store_test
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"surrealchemist.com/mass-showdown-backend/store"
+)
+
+func TestFileStoreHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "polls.jsonl")
+	s, err := store.OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	s.StartPoll(&store.Poll{ID: "a", RoomID: "battle-1", RQID: 3, Request: json.RawMessage(`{"rqid":3}`), StartedAt: start})
+	s.StartPoll(&store.Poll{ID: "b", RoomID: "battle-2", RQID: 1, Request: json.RawMessage(`{"rqid":1}`), StartedAt: start})
+	s.AddVote(&store.Vote{PollID: "a", Voter: "alice", At: start.Add(time.Second), Ballot: json.RawMessage(`{"type":"move","idx":0}`)})
+	s.AddVote(&store.Vote{PollID: "a", Voter: "bob", At: start.Add(2 * time.Second), Ballot: json.RawMessage(`{"type":"move","idx":9}`), Error: "vote with index out of bounds"})
+	s.EndPoll("a", start.Add(30*time.Second), "/choose move 1")
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// History survives reopening the store
+	s, err = store.OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	polls, err := s.Polls(store.Query{RoomID: "battle-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(polls) != 1 {
+		t.Fatalf("Expected only the room's poll but got %d polls", len(polls))
+	}
+	p := polls[0]
+	if p.Command != "/choose move 1" || !p.EndedAt.Equal(start.Add(30*time.Second)) {
+		t.Errorf("Expected the poll's end to be recorded but got %+v", p)
+	}
+	if len(p.Votes) != 2 || p.Votes[0].Voter != "alice" || p.Votes[1].Error == "" {
+		t.Errorf("Expected both votes with the rejection kept but got %+v", p.Votes)
+	}
+	all, _ := s.Polls(store.Query{})
+	if len(all) != 2 || !all[1].EndedAt.IsZero() {
+		t.Errorf("Expected every poll with the unfinished one open but got %+v", all)
+	}
+}
+
+func TestFileStorePages(t *testing.T) {
+	s, err := store.OpenFile(filepath.Join(t.TempDir(), "polls.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, id := range []string{"a", "b", "c", "d"} {
+		s.StartPoll(&store.Poll{ID: id, RoomID: "battle-1"})
+		s.AddVote(&store.Vote{PollID: id, Voter: "alice", Ballot: json.RawMessage(`{}`)})
+	}
+	page, err := s.Polls(store.Query{RoomID: "battle-1", Offset: 1, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 || page[0].ID != "b" || page[1].ID != "c" || len(page[1].Votes) != 1 {
+		t.Errorf("Expected polls b and c with their votes but got %+v", page)
+	}
+	if rest, _ := s.Polls(store.Query{Offset: 3}); len(rest) != 1 || rest[0].ID != "d" {
+		t.Errorf("Expected every poll after the offset but got %+v", rest)
+	}
+}